@@ -21,6 +21,12 @@ func Register(c *gin.Context) {
 		switch err.Error() {
 		case "User already exists!":
 			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		case "Invalid email!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "Registration closed!", "Registration by invitation only!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "Email domain claimed by several organizations!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
 		default:
 			log.Printf("DB Error: %v", err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
@@ -31,6 +37,43 @@ func Register(c *gin.Context) {
 
 	return
 }
+func VerifyEmail(c *gin.Context) {
+	var requestParams models.RVerifyEmail
+	if err := c.ShouldBindQuery(&requestParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.VerifyEmail(requestParams.Token)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid or expired token!":
+			c.Redirect(http.StatusFound, services.FrontendURL()+"/login?emailVerified=false")
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, services.FrontendURL()+"/login?emailVerified=true")
+}
+
+func ResendVerification(c *gin.Context) {
+	var requestBody models.REmail
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ResendVerification(requestBody)
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
 func LoginPassword(c *gin.Context) {
 	var requestBody models.RUserLoginPassword
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -38,35 +81,57 @@ func LoginPassword(c *gin.Context) {
 		return
 	}
 
-	data, err := services.LoginPasswordUser(requestBody, c.Request.UserAgent(), c.RemoteIP())
+	data, err := services.LoginPasswordUser(requestBody, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		switch err.Error() {
+		case "Too many attempts!":
+			c.Header("Retry-After", services.RetryAfterSeconds(err))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
 		case "User doesn't exist!":
 			c.JSON(http.StatusForbidden, gin.H{"status": "Invalid email or password"})
+		case "Email domain not allowed for this organization!", "User belongs to another organization!", "Email not verified!", "User deactivated!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "Email domain claimed by several organizations!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
 		default:
 			log.Printf("DB Error: %v", err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
 		}
 		return
 	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "Failed to encode session"})
+	if data.Challenge != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "challenge", "data": data.Challenge})
 		return
 	}
-	cookie := &http.Cookie{
+	setSessionCookie(c, *data.Session)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// setSessionCookie hands out the access token in session_token and the
+// refresh token in refresh_token, which is only sent to /auth.
+func setSessionCookie(c *gin.Context, session models.USesssion) {
+	http.SetCookie(c.Writer, &http.Cookie{
 		Name:     "session_token",
-		Value:    data.RefreshToken,
+		Value:    session.AccessToken,
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   true,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  session.ExpiresAt,
 		SameSite: http.SameSiteLaxMode,
-	}
-	http.SetCookie(c.Writer, cookie)
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    session.RefreshToken,
+		Path:     "/auth",
+		HttpOnly: true,
+		Secure:   true,
+		Expires:  session.ExpiresAt,
+		SameSite: http.SameSiteStrictMode,
+	})
 }
+
 func Logout(c *gin.Context) {
-	cookie, err := c.Request.Cookie("session_token")
+	cookie, err := c.Request.Cookie("refresh_token")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"status": "Session token not found"})
 		return
@@ -85,6 +150,11 @@ func Logout(c *gin.Context) {
 		}
 		return
 	}
+	clearSessionCookie(c)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func clearSessionCookie(c *gin.Context) {
 	http.SetCookie(c.Writer, &http.Cookie{
 		Name:     "session_token",
 		Value:    "",
@@ -94,21 +164,30 @@ func Logout(c *gin.Context) {
 		Expires:  time.Unix(0, 0),
 		SameSite: http.SameSiteLaxMode,
 	})
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/auth",
+		HttpOnly: true,
+		Secure:   true,
+		Expires:  time.Unix(0, 0),
+		SameSite: http.SameSiteStrictMode,
+	})
 }
+
 func Refresh(c *gin.Context) {
-	userId, exists := c.Get("userId")
-	sUserId, ok := userId.(string)
-	if !exists || !ok || sUserId == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+	cookie, err := c.Request.Cookie("refresh_token")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Session token not found"})
 		return
 	}
 
-	data, err := services.RefreshSession(sUserId, c.Request.UserAgent(), c.Request.RemoteAddr)
+	data, err := services.RefreshSession(cookie.Value, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		switch err.Error() {
 		case "Session doesn't exist!":
-			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			clearSessionCookie(c)
+			c.JSON(http.StatusUnauthorized, gin.H{"status": err.Error()})
 		default:
 			log.Printf("DB Error: %v", err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
@@ -116,9 +195,22 @@ func Refresh(c *gin.Context) {
 		return
 	}
 
+	setSessionCookie(c, data)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
 	return
 }
+
+func JWKS(c *gin.Context) {
+	data, err := services.JWKS()
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, data)
+}
+
 func Me(c *gin.Context) {
 	userId, exists := c.Get("userId")
 	sUserId, ok := userId.(string)
@@ -130,7 +222,7 @@ func Me(c *gin.Context) {
 	data, err := services.Me(sUserId)
 	if err != nil {
 		switch err.Error() {
-		case "Session doesn't exist!":
+		case "User doesn't exist!":
 			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
 		default:
 			log.Printf("DB Error: %v", err.Error())
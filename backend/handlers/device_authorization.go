@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deviceTokenErrors are the RFC 8628 error codes the CLI polls for.
+var deviceTokenErrors = map[string]string{
+	"Authorization pending!": "authorization_pending",
+	"Slow down!":             "slow_down",
+	"Access denied!":         "access_denied",
+	"User deactivated!":      "access_denied",
+	"Expired token!":         "expired_token",
+	"Invalid device code!":   "invalid_grant",
+}
+
+func deviceError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "Too many attempts!":
+		c.Header("Retry-After", services.RetryAfterSeconds(err))
+		c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
+	case "Invalid client name!", "Invalid scope!":
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+	case "Invalid user code!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func RequestDeviceCode(c *gin.Context) {
+	var requestBody models.RDeviceCode
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.RequestDeviceCode(requestBody, c.ClientIP())
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func PollDeviceToken(c *gin.Context) {
+	var requestBody models.RDeviceToken
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.PollDeviceToken(requestBody)
+	if err != nil {
+		if code, found := deviceTokenErrors[err.Error()]; found {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error(), "error": code})
+			return
+		}
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func DeviceRequest(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+	var requestQuery models.RUserCode
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.DeviceRequest(sUserId, requestQuery.UserCode)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func decideDeviceRequest(c *gin.Context, approve bool) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+	var requestBody models.RUserCode
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.DecideDeviceRequest(sUserId, requestBody.UserCode, approve)
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ApproveDevice(c *gin.Context) {
+	decideDeviceRequest(c, true)
+}
+
+func DenyDevice(c *gin.Context) {
+	decideDeviceRequest(c, false)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartImpersonation replaces the super admin's session cookies with a
+// session of the user, so the browser sees exactly what they see.
+func StartImpersonation(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	data, err := services.StartImpersonation(sUserId, c.Param("id"), c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch err.Error() {
+		case "User doesn't exist!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		case "Can't change own account!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "Impersonation not allowed!", "User deactivated!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	setSessionCookie(c, data)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": gin.H{"expiresAt": data.ExpiresAt}})
+}
+
+// StopImpersonation ends the impersonation session. The super admin signs in
+// again afterwards.
+func StopImpersonation(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+	impersonatorId := c.GetString("impersonatorId")
+	if impersonatorId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Not impersonating!"})
+		return
+	}
+
+	err := services.StopImpersonation(impersonatorId, sUserId, c.GetString("sessionId"), c.ClientIP())
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	clearSessionCookie(c)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func Impersonations(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RImpersonationEvents
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.Impersonations(sUserId, requestQuery)
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
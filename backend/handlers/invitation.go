@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func invitationError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "Invitation doesn't exist!", "Organization doesn't exist!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	case "Role doesn't exists!", "Invalid email!":
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+	case "User already exists!":
+		c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func CreateInvitation(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RCreateInvitation
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.CreateInvitation(sUserId, requestBody)
+	if err != nil {
+		invitationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func Invitations(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RInvitations
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.Invitations(sUserId, requestQuery)
+	if err != nil {
+		invitationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func ResendInvitation(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.ResendInvitation(sUserId, c.Param("id"))
+	if err != nil {
+		invitationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func RevokeInvitation(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.RevokeInvitation(sUserId, c.Param("id"))
+	if err != nil {
+		invitationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func Invitation(c *gin.Context) {
+	var requestParams models.RInvitationToken
+	if err := c.ShouldBindQuery(&requestParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.Invitation(requestParams.Token)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid or expired invitation!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func AcceptInvitation(c *gin.Context) {
+	var requestBody models.RAcceptInvitation
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.AcceptInvitation(requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid or expired invitation!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		case "Password too short!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "User already exists!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func LoginHistory(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RLoginEvents
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.LoginHistory(sUserId, requestQuery)
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func LoginEvents(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RLoginEvents
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.LoginEvents(sUserId, requestQuery)
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
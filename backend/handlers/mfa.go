@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func LoginMFA(c *gin.Context) {
+	var requestBody models.RLoginMFA
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.LoginMFA(requestBody, c.Request.UserAgent(), c.RemoteIP())
+	if err != nil {
+		switch err.Error() {
+		case "Too many attempts!":
+			c.Header("Retry-After", services.RetryAfterSeconds(err))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
+		case "Invalid or expired challenge!", "Invalid MFA code!", "User deactivated!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	setSessionCookie(c, data)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func LoginMFAEnroll(c *gin.Context) {
+	var requestBody models.RLoginChallenge
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.LoginMFAEnroll(requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid or expired challenge!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func LoginMFAEnrollConfirm(c *gin.Context) {
+	var requestBody models.RLoginMFA
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.LoginMFAEnrollConfirm(requestBody, c.Request.UserAgent(), c.RemoteIP())
+	if err != nil {
+		switch err.Error() {
+		case "Too many attempts!":
+			c.Header("Retry-After", services.RetryAfterSeconds(err))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
+		case "Invalid or expired challenge!", "Invalid MFA code!", "User deactivated!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "MFA not enrolled!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	setSessionCookie(c, data)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func EnrollMFA(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	data, err := services.EnrollMFA(sUserId)
+	if err != nil {
+		switch err.Error() {
+		case "MFA already enabled!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func ConfirmMFA(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RMFACode
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ConfirmMFA(sUserId, requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Too many attempts!":
+			c.Header("Retry-After", services.RetryAfterSeconds(err))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
+		case "Invalid MFA code!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "MFA already enabled!", "MFA not enrolled!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func DisableMFA(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RMFACode
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.DisableMFA(sUserId, requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Too many attempts!":
+			c.Header("Retry-After", services.RetryAfterSeconds(err))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": err.Error()})
+		case "Invalid MFA code!", "MFA is required by your organization!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "MFA not enabled!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
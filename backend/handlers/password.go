@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ForgotPassword(c *gin.Context) {
+	var requestBody models.REmail
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ForgotPassword(requestBody)
+	if err != nil {
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ResetPassword(c *gin.Context) {
+	var requestBody models.RResetPassword
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ResetPassword(requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Password too short!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "Invalid or expired token!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ChangePassword(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+	var requestBody models.RChangePassword
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ChangePassword(sUserId, c.GetString("sessionId"), requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Password too short!", "Password managed by identity provider!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "Invalid password!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "User doesn't exist!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func UpdateMe(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RUpdateMe
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.UpdateMe(sUserId, requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid name!", "Invalid preferences!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "User doesn't exist!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func ChangeEmail(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RChangeEmail
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.RequestEmailChange(sUserId, requestBody)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid password!", "Email managed by identity provider!", "Email domain not allowed for this organization!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		case "Invalid email!":
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		case "User already exists!", "Email domain claimed by several organizations!":
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+		case "User doesn't exist!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ConfirmEmailChange(c *gin.Context) {
+	var requestParams models.RVerifyEmail
+	if err := c.ShouldBindQuery(&requestParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.ConfirmEmailChange(requestParams.Token)
+	if err != nil {
+		switch err.Error() {
+		case "Invalid or expired token!", "User already exists!":
+			c.Redirect(http.StatusFound, services.FrontendURL()+"/settings?emailChanged=false")
+		default:
+			log.Printf("DB Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, services.FrontendURL()+"/settings?emailChanged=true")
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func scimTokenError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "SCIM token doesn't exist!", "Organization doesn't exist!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func SCIMToken(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RSCIMToken
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.SCIMToken(sUserId, requestQuery)
+	if err != nil {
+		scimTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func CreateSCIMToken(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestBody models.RSCIMToken
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.CreateSCIMToken(sUserId, requestBody)
+	if err != nil {
+		scimTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func RevokeSCIMToken(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	var requestQuery models.RSCIMToken
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	err := services.RevokeSCIMToken(sUserId, requestQuery)
+	if err != nil {
+		scimTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// scimErrorResponse answers in the error format of RFC 7644, section 3.12.
+func scimErrorResponse(c *gin.Context, status int, scimType string, detail string) {
+	c.JSON(status, models.SCIMError{
+		Schemas:  []string{models.SCIMErrorSchema},
+		Status:   strconv.Itoa(status),
+		SCIMType: scimType,
+		Detail:   detail,
+	})
+}
+
+func scimError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "User doesn't exist!", "Group doesn't exist!", "Organization doesn't exist!":
+		scimErrorResponse(c, http.StatusNotFound, "", err.Error())
+	case "User already exists!":
+		scimErrorResponse(c, http.StatusConflict, "uniqueness", err.Error())
+	case "Not allowed to manage this user!":
+		scimErrorResponse(c, http.StatusForbidden, "", err.Error())
+	case "Invalid filter!":
+		scimErrorResponse(c, http.StatusBadRequest, "invalidFilter", err.Error())
+	case "Invalid path!":
+		scimErrorResponse(c, http.StatusBadRequest, "invalidPath", err.Error())
+	case "No target!":
+		scimErrorResponse(c, http.StatusBadRequest, "noTarget", err.Error())
+	case "Group names are read-only!":
+		scimErrorResponse(c, http.StatusBadRequest, "mutability", err.Error())
+	case "Invalid operation!":
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+	case "Invalid value!", "Invalid email!", "Email domain not allowed for this organization!", "Role doesn't exists!":
+		scimErrorResponse(c, http.StatusBadRequest, "invalidValue", err.Error())
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		scimErrorResponse(c, http.StatusInternalServerError, "", "Something went wrong!")
+	}
+}
+
+func SCIMServiceProviderConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"schemas":        []string{models.SCIMServiceConfigSchema},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": services.SCIMMaxResults()},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "The organization's SCIM token, sent as \"Authorization: Bearer\"",
+		}},
+	})
+}
+
+func SCIMResourceTypes(c *gin.Context) {
+	types := []gin.H{
+		{"schemas": []string{models.SCIMResourceTypeSchema}, "id": "User", "name": "User", "endpoint": "/Users", "schema": models.SCIMUserSchema},
+		{"schemas": []string{models.SCIMResourceTypeSchema}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": models.SCIMGroupSchema},
+	}
+	c.JSON(http.StatusOK, models.SCIMListResponse{
+		Schemas:      []string{models.SCIMListResponseSchema},
+		TotalResults: len(types),
+		StartIndex:   1,
+		ItemsPerPage: len(types),
+		Resources:    []any{types[0], types[1]},
+	})
+}
+
+func SCIMUsers(c *gin.Context) {
+	var requestQuery models.RSCIMList
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidValue", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.SCIMUsers(c.GetString("organizationId"), requestQuery)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func SCIMUser(c *gin.Context) {
+	data, err := services.SCIMUser(c.GetString("organizationId"), c.Param("id"))
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func CreateSCIMUser(c *gin.Context) {
+	var requestBody models.SCIMUser
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.CreateSCIMUser(c.GetString("organizationId"), requestBody)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.Header("Location", data.Meta.Location)
+	c.JSON(http.StatusCreated, data)
+}
+
+func ReplaceSCIMUser(c *gin.Context) {
+	var requestBody models.SCIMUser
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.ReplaceSCIMUser(c.GetString("organizationId"), c.Param("id"), requestBody)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func PatchSCIMUser(c *gin.Context) {
+	var requestBody models.SCIMPatch
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.PatchSCIMUser(c.GetString("organizationId"), c.Param("id"), requestBody)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+// DeprovisionSCIMUser answers DELETE by deactivating the user.
+func DeprovisionSCIMUser(c *gin.Context) {
+	err := services.DeprovisionSCIMUser(c.GetString("organizationId"), c.Param("id"))
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func SCIMGroups(c *gin.Context) {
+	var requestQuery models.RSCIMList
+	if err := c.ShouldBindQuery(&requestQuery); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidValue", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.SCIMGroups(c.GetString("organizationId"), requestQuery)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func SCIMGroup(c *gin.Context) {
+	data, err := services.SCIMGroup(c.GetString("organizationId"), c.Param("id"))
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func ReplaceSCIMGroup(c *gin.Context) {
+	var requestBody models.SCIMGroup
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.ReplaceSCIMGroup(c.GetString("organizationId"), c.Param("id"), requestBody)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func PatchSCIMGroup(c *gin.Context) {
+	var requestBody models.SCIMPatch
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", "Invalid arguments!")
+		return
+	}
+
+	data, err := services.PatchSCIMGroup(c.GetString("organizationId"), c.Param("id"), requestBody)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+// SCIMGroupsReadOnly answers creating and deleting groups. Groups are the
+// roles shared by all organizations, so only their members can change.
+func SCIMGroupsReadOnly(c *gin.Context) {
+	scimErrorResponse(c, http.StatusNotImplemented, "", "Groups are managed in Zendoc!")
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sessionError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "Session doesn't exist!", "User doesn't exist!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	case "Not allowed to manage this user!":
+		c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func Sessions(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	data, err := services.Sessions(sUserId, c.GetString("sessionId"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func RevokeSession(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.RevokeSession(sUserId, c.Param("id"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	if c.Param("id") == c.GetString("sessionId") {
+		clearSessionCookie(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func RevokeOtherSessions(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	revoked, err := services.RevokeOtherSessions(sUserId, c.GetString("sessionId"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": gin.H{"revoked": revoked}})
+}
+
+func UserSessions(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	data, err := services.UserSessions(sUserId, c.Param("id"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
+}
+
+func RevokeUserSession(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.RevokeUserSession(sUserId, c.Param("id"), c.Param("sessionId"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func RevokeUserSessions(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	revoked, err := services.RevokeUserSessions(sUserId, c.Param("id"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": gin.H{"revoked": revoked}})
+}
+
+func UnlockUser(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.UnlockUser(sUserId, c.Param("id"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
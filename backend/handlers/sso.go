@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func OIDCLogin(c *gin.Context) {
+	redirectURL, err := services.BeginOIDCLogin(c.Param("orgId"))
+	if err != nil {
+		switch err.Error() {
+		case "Organization doesn't exist!", "SSO not configured!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		default:
+			log.Printf("SSO Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+func OIDCCallback(c *gin.Context) {
+	var requestParams models.ROIDCCallback
+	if err := c.ShouldBindQuery(&requestParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.FinishOIDCLogin(c.Param("orgId"), requestParams, c.Request.UserAgent(), c.RemoteIP())
+	if err != nil {
+		switch err.Error() {
+		case "Organization doesn't exist!", "SSO not configured!":
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		case "Invalid or expired SSO request!", "SSO login failed!", "Email not verified by identity provider!",
+			"Email domain not allowed for this organization!", "User belongs to another organization!", "User deactivated!":
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		default:
+			log.Printf("SSO Error: %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+		}
+		return
+	}
+	setSessionCookie(c, data)
+	c.Redirect(http.StatusFound, services.FrontendURL())
+}
+
+func samlError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "Organization doesn't exist!", "SSO not configured!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	case "Invalid or expired SSO request!", "SSO login failed!", "SSO logout failed!", "Email not provided by identity provider!",
+		"Email domain not allowed for this organization!", "User belongs to another organization!", "User doesn't exist!", "User deactivated!":
+		c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+	default:
+		log.Printf("SSO Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func SAMLMetadata(c *gin.Context) {
+	data, err := services.SAMLMetadata(c.Param("orgId"))
+	if err != nil {
+		samlError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", data)
+}
+
+func SAMLLogin(c *gin.Context) {
+	redirectURL, err := services.BeginSAMLLogin(c.Param("orgId"))
+	if err != nil {
+		samlError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+func SAMLACS(c *gin.Context) {
+	var requestBody models.RSAMLResponse
+	if err := c.ShouldBind(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments!"})
+		return
+	}
+
+	data, err := services.FinishSAMLLogin(c.Param("orgId"), requestBody, c.Request.UserAgent(), c.RemoteIP())
+	if err != nil {
+		samlError(c, err)
+		return
+	}
+	setSessionCookie(c, data)
+	c.Redirect(http.StatusFound, services.FrontendURL())
+}
+
+func SAMLLogout(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	redirectURL, err := services.BeginSAMLLogout(c.Param("orgId"), sUserId, c.GetString("sessionId"))
+	if err != nil {
+		samlError(c, err)
+		return
+	}
+	clearSessionCookie(c)
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+func SAMLSLO(c *gin.Context) {
+	redirectURL, err := services.HandleSAMLLogout(c.Param("orgId"), c.Request)
+	if err != nil {
+		samlError(c, err)
+		return
+	}
+	clearSessionCookie(c)
+	c.Redirect(http.StatusFound, redirectURL)
+}
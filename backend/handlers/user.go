@@ -35,3 +35,82 @@ func Search(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": data})
 	return
 }
+
+func userAdminError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "User doesn't exist!":
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+	case "Can't change own account!":
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+	case "Not allowed to manage this user!":
+		c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+	default:
+		log.Printf("DB Error: %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+	}
+}
+
+func DeactivateUser(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.DeactivateUser(sUserId, c.Param("id"))
+	if err != nil {
+		userAdminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ReactivateUser(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.ReactivateUser(sUserId, c.Param("id"))
+	if err != nil {
+		userAdminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func DeleteUser(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	err := services.DeleteUser(sUserId, c.Param("id"))
+	if err != nil {
+		userAdminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ExportMe(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	sUserId, ok := userId.(string)
+	if !exists || !ok || sUserId == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+		return
+	}
+
+	data, err := services.ExportUser(sUserId)
+	if err != nil {
+		userAdminError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="zendoc-export.json"`)
+	c.JSON(http.StatusOK, data)
+}
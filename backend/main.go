@@ -4,6 +4,8 @@ import (
 	"backend/routes"
 	"backend/services"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -18,6 +20,28 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	// `backend reencrypt` moves encrypted values to the primary key and exits.
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		if _, err = services.InitDB(); err != nil {
+			log.Fatalf("DB init failed with %v", err)
+		}
+		if err = services.ReencryptAll(); err != nil {
+			log.Fatalf("Re-encryption failed with %v", err)
+		}
+		log.Println("Re-encryption finished")
+		return
+	}
+
+	// Only addresses forwarded by these proxies are trusted as client IPs,
+	// which the login limiter relies on.
+	var trustedProxies []string
+	if proxies := services.GetEnvDefault("TRUSTED_PROXIES", ""); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err = r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	corsConfig := cors.DefaultConfig()
 
 	corsConfig.AllowOrigins = []string{"http://localhost:3000"}
@@ -29,6 +53,22 @@ func main() {
 	if err != nil {
 		log.Fatalf("DB init failed with %v", err)
 	}
+	if err = services.MigrateLegacyTokens(); err != nil {
+		log.Fatalf("Token migration failed with %v", err)
+	}
+	if err = services.MigrateSelfRegistration(); err != nil {
+		log.Fatalf("Self-registration migration failed with %v", err)
+	}
+	if err = services.MigrateLoginEvents(); err != nil {
+		log.Fatalf("Login event migration failed with %v", err)
+	}
+	if err = services.MigrateEmailIndexes(); err != nil {
+		log.Fatalf("Email index migration failed with %v", err)
+	}
+	if err = services.MigratePermissions(); err != nil {
+		log.Fatalf("Permission migration failed with %v", err)
+	}
+	services.StartSessionReaper()
 
 	log.Println("Gin finished starting")
 
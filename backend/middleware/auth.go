@@ -1,10 +1,12 @@
 package middleware
 
 import (
+    "backend/models"
     "backend/services"
-    "context"
-    "database/sql"
+    "log"
     "net/http"
+    "slices"
+    "strings"
 
     "github.com/gin-gonic/gin"
 )
@@ -16,44 +18,103 @@ func CheckSession() gin.HandlerFunc {
             c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "Session token not found"})
             return
         }
-        sessionToken := cookie.Value
-
-        db := services.DB
-        var ctx = context.Background()
-        tx, err := db.BeginTxx(ctx, &sql.TxOptions{
-            Isolation: sql.LevelSerializable,
-            ReadOnly:  false,
-        })
+        claims, err := services.ParseAccessToken(cookie.Value)
         if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+            return
+        }
+        // The session itself is checked at the next refresh; sessions this
+        // instance revoked are refused right away.
+        if services.SessionRevoked(claims.SessionID, claims.IssuedAt.Time) {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
             return
         }
 
-        defer func() {
-            if p := recover(); p != nil {
-                tx.Rollback()
-                panic(p)
-            } else if err != nil {
-                tx.Rollback()
-            }
-        }()
+        c.Set("userId", claims.Subject)
+        c.Set("sessionId", claims.SessionID)
+        if claims.Impersonator == "" {
+            c.Next()
+            return
+        }
+
+        // Everything done while impersonating is recorded with both users.
+        c.Set("impersonatorId", claims.Impersonator)
+        c.Set("impersonatedUserId", claims.Subject)
+        c.Next()
+        services.RecordImpersonatedRequest(claims.Impersonator, claims.Subject, claims.SessionID,
+            c.Request.Method, c.FullPath(), c.Writer.Status(), c.ClientIP())
+    }
+}
+
+// BlockImpersonation refuses sensitive operations, such as changing
+// credentials, in impersonation sessions.
+func BlockImpersonation() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if c.GetString("impersonatorId") != "" {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Not allowed while impersonating!"})
+            return
+        }
+        c.Next()
+    }
+}
+
+// CheckSessionOrToken accepts a browser session like CheckSession or a
+// personal access token holding scope, sent as "Authorization: Bearer".
+func CheckSessionOrToken(scope string) gin.HandlerFunc {
+    checkSession := CheckSession()
+    return func(c *gin.Context) {
+        token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if !found || !services.IsPersonalToken(token) {
+            checkSession(c)
+            return
+        }
 
-        var uIDs []string
-        err = tx.Select(&uIDs, "select user_id from auth.sessions where refresh_token = $1", sessionToken)
+        userID, scopes, err := services.AuthenticatePersonalToken(token, c.ClientIP())
         if err != nil {
+            if err.Error() == "Invalid token!" {
+                c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+                return
+            }
+            log.Printf("DB Error: %v", err.Error())
             c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
             return
         }
-        if len(uIDs) == 0 || len(uIDs) > 1 {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Unauthorized"})
+        if !slices.Contains(scopes, scope) {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Insufficient scope"})
             return
         }
 
-        if err = tx.Commit(); err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+        c.Set("userId", userID)
+        c.Next()
+    }
+}
+
+// CheckSCIMToken authenticates an identity provider by its organization's
+// SCIM token and sets organizationId. Responses use the SCIM media type and
+// error format.
+func CheckSCIMToken() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Header("Content-Type", "application/scim+json")
+        unauthorized := models.SCIMError{Schemas: []string{models.SCIMErrorSchema}, Status: "401", Detail: "Unauthorized"}
+
+        token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if !found {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, unauthorized)
             return
         }
-        c.Set("userId", uIDs[0])
+        orgID, err := services.AuthenticateSCIMToken(token)
+        if err != nil {
+            if err.Error() == "Invalid token!" {
+                c.AbortWithStatusJSON(http.StatusUnauthorized, unauthorized)
+                return
+            }
+            log.Printf("DB Error: %v", err.Error())
+            c.AbortWithStatusJSON(http.StatusInternalServerError,
+                models.SCIMError{Schemas: []string{models.SCIMErrorSchema}, Status: "500", Detail: "Something went wrong!"})
+            return
+        }
+
+        c.Set("organizationId", orgID)
         c.Next()
     }
 }
@@ -1 +1,44 @@
 package middleware
+
+import (
+	"backend/services"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission lets the request through if a role of the user from
+// CheckSession grants permission.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		permissions, err := userPermissions(c)
+		if err != nil {
+			log.Printf("DB Error: %v", err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Something went wrong!"})
+			return
+		}
+		if !slices.Contains(permissions, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// userPermissions loads the user's permissions once per request and keeps
+// them in the context for later checks.
+func userPermissions(c *gin.Context) ([]string, error) {
+	if cached, ok := c.Get("permissions"); ok {
+		if permissions, ok := cached.([]string); ok {
+			return permissions, nil
+		}
+	}
+	permissions, err := services.UserPermissions(c.GetString("userId"))
+	if err != nil {
+		return nil, err
+	}
+	c.Set("permissions", permissions)
+	return permissions, nil
+}
@@ -1,8 +1,163 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
 
 type USesssion struct {
-	RefreshToken string
-	ExpiresAt    time.Time
+	SessionID       string    `json:"sessionId"`
+	AccessToken     string    `json:"-"`
+	AccessExpiresAt time.Time `json:"accessExpiresAt"`
+	RefreshToken    string    `json:"-"`
+	ExpiresAt       time.Time `json:"expiresAt"`
+}
+
+const (
+	ChallengeTypeMFA       = "mfa"
+	ChallengeTypeMFAEnroll = "mfa_enroll"
+)
+
+type ULoginChallenge struct {
+	Challenge string    `json:"challenge"`
+	Type      string    `json:"type"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ULogin holds either a finished session or the challenge the user has to
+// answer before a session is issued.
+type ULogin struct {
+	Session   *USesssion
+	Challenge *ULoginChallenge
+}
+
+type UMFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qrCode"`
+}
+
+const (
+	CeremonyTypeRegistration = "registration"
+	CeremonyTypeLogin        = "login"
+)
+
+type UWebauthnCeremony struct {
+	Ceremony string `json:"ceremony"`
+	Options  any    `json:"options"`
+}
+
+type UActiveSession struct {
+	ID         string    `db:"id" json:"id"`
+	UserAgent  string    `db:"user_agent" json:"userAgent"`
+	IP         string    `db:"ip" json:"ip"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"lastSeenAt"`
+	ExpiresAt  time.Time `db:"expires_at" json:"expiresAt"`
+	Current    bool      `db:"current" json:"current"`
+	// ImpersonatorID is set on sessions a super admin started as this user.
+	ImpersonatorID *string `db:"impersonator_id" json:"impersonatorId,omitempty"`
+}
+
+type UPersonalToken struct {
+	ID         string         `db:"id" json:"id"`
+	Name       string         `db:"name" json:"name"`
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt  time.Time      `db:"expires_at" json:"expiresAt"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"lastUsedAt"`
+	LastUsedIP *string        `db:"last_used_ip" json:"lastUsedIp"`
+	CreatedAt  time.Time      `db:"created_at" json:"createdAt"`
+}
+
+// UCreatedPersonalToken is the only response that contains the token.
+type UCreatedPersonalToken struct {
+	UPersonalToken
+	Token string `json:"token"`
+}
+
+// UCreatedSCIMToken is the only response that contains the SCIM token.
+type UCreatedSCIMToken struct {
+	SCIMToken
+	Token string `json:"token"`
+}
+
+// UDeviceCode starts a device login, as in RFC 8628.
+type UDeviceCode struct {
+	DeviceCode              string `json:"deviceCode"`
+	UserCode                string `json:"userCode"`
+	VerificationURI         string `json:"verificationUri"`
+	VerificationURIComplete string `json:"verificationUriComplete"`
+	ExpiresIn               int    `json:"expiresIn"`
+	Interval                int    `json:"interval"`
+}
+
+// UDeviceRequest is what the user is asked to approve.
+type UDeviceRequest struct {
+	ClientName string         `db:"client_name" json:"clientName"`
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt  time.Time      `db:"expires_at" json:"expiresAt"`
+	CreatedAt  time.Time      `db:"created_at" json:"createdAt"`
+}
+
+type UInvitation struct {
+	ID             string         `db:"id" json:"id"`
+	OrganizationID string         `db:"organization_id" json:"organizationId"`
+	Email          string         `db:"email" json:"email"`
+	Roles          pq.StringArray `db:"roles" json:"roles"`
+	InvitedBy      *string        `db:"invited_by" json:"invitedBy"`
+	ExpiresAt      time.Time      `db:"expires_at" json:"expiresAt"`
+	CreatedAt      time.Time      `db:"created_at" json:"createdAt"`
+}
+
+// UInvitationDetails is shown to the invitee. SSOProvider is set when the
+// organization signs in through SSO instead of a password.
+type UInvitationDetails struct {
+	Email            string    `json:"email"`
+	OrganizationID   string    `json:"organizationId"`
+	OrganizationName string    `json:"organizationName"`
+	SSOProvider      string    `json:"ssoProvider,omitempty"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+// UUser is a user as shown to clients, with the email decrypted.
+type UUser struct {
+	ID             string          `json:"id"`
+	Email          string          `json:"email"`
+	FirstName      string          `json:"firstName"`
+	LastName       string          `json:"lastName"`
+	OrganizationID string          `json:"organizationId,omitempty"`
+	UserType       string          `json:"userType"`
+	MFAEnabled     bool            `json:"mfaEnabled"`
+	LastLogin      *time.Time      `json:"lastLogin,omitempty"`
+	EmailVerified  bool            `json:"emailVerified"`
+	Active         bool            `json:"active"`
+	Preferences    json.RawMessage `json:"preferences"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+type UUserExport struct {
+	ExportedAt     time.Time            `json:"exportedAt"`
+	Profile        UUser                `json:"profile"`
+	Roles          []string             `json:"roles"`
+	Sessions       []UActiveSession     `json:"sessions"`
+	LoginEvents    []LoginEvent         `json:"loginEvents"`
+	PersonalTokens []UPersonalToken     `json:"personalTokens"`
+	Passkeys       []WebauthnCredential `json:"passkeys"`
+	Impersonations []ImpersonationEvent `json:"impersonations"`
+}
+
+type UJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type UJWKS struct {
+	Keys []UJWK `json:"keys"`
 }
@@ -3,52 +3,228 @@ package models
 import (
 	"database/sql"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type User struct {
+	ID                 string         `db:"id" json:"id"`
+	Email              string         `db:"email" json:"email"`
+	EmailIndex         sql.NullString `db:"email_index" json:"-"`
+	EmailDomainIndex   sql.NullString `db:"email_domain_index" json:"-"`
+	Password           string         `db:"password" json:"-"`
+	FirstName          string         `db:"firstname" json:"firstName"`
+	LastName           string         `db:"lastname" json:"lastName"`
+	OrganizationID     string         `db:"organization" json:"organizationId,omitempty"`
+	UserType           string         `db:"type" json:"userType"`
+	MFAEnabled         sql.NullBool   `db:"mfa_enabled" json:"mfaEnabled"`
+	MFASecret          sql.NullString `db:"mfa_secret" json:"-"`
+	MFALastStep        sql.NullInt64  `db:"mfa_last_step" json:"-"`
+	LastLogin          *time.Time     `db:"last_login" json:"lastLogin,omitempty"`
+	EmailVerified      bool           `db:"verified" json:"emailVerified"`
+	VerificationSentAt *time.Time     `db:"verification_sent_at" json:"-"`
+	SelfRegistered     bool           `db:"self_registered" json:"-"`
+	Active             bool           `db:"active" json:"active"`
+	Preferences        []byte         `db:"preferences" json:"-"`
+	PendingEmail       sql.NullString `db:"pending_email" json:"-"`
+	ExternalID         sql.NullString `db:"external_id" json:"-"`
+	CreatedAt          time.Time      `db:"created_at" json:"createdAt"`
+	UpdatedAt          time.Time      `db:"updated_at" json:"updatedAt"`
+}
+
+type Organization struct {
+	ID                   string    `db:"id" json:"id"`
+	Name                 string    `db:"name" json:"name"`
+	Domain               string    `db:"domain" json:"domain"`
+	SSO                  bool      `db:"sso" json:"sso"`
+	SSOProvider          string    `db:"sso_provider" json:"ssoProvider,omitempty"`
+	SSOMetadataURL       string    `db:"sso_metadata_url" json:"ssoMetadataUrl,omitempty"`
+	SSOEntityID          string    `db:"sso_entity_id" json:"ssoEntityId,omitempty"`
+	SSOClientSecret      string    `db:"sso_client_secret" json:"-"`
+	LDAPEnabled          bool      `db:"ldap" json:"ldapEnabled"`
+	LDAPServer           string    `db:"ldap_server" json:"ldapServer,omitempty"`
+	LDAPBindDN           string    `db:"ldap_bind_dn" json:"ldapBindDn,omitempty"`
+	LDAPSearchBase       string    `db:"ldap_search_base" json:"ldapSearchBase,omitempty"`
+	LDAPBindPassword     string    `db:"ldap_bind_password" json:"-"`
+	LDAPUserFilter       string    `db:"ldap_user_filter" json:"ldapUserFilter,omitempty"`
+	LDAPStartTLS         bool      `db:"ldap_start_tls" json:"ldapStartTls"`
+	AllowedDomains       string    `db:"allowed_domains" json:"allowedDomains,omitempty"`
+	MFARequired          bool      `db:"mfa_required" json:"mfaRequired"`
+	RequireVerifiedEmail bool      `db:"require_verified_email" json:"requireVerifiedEmail"`
+	RegistrationMode     string    `db:"registration_mode" json:"registrationMode,omitempty"`
+	CreatedAt            time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt            time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+type PersonalToken struct {
+	ID          string         `db:"id" json:"id"`
+	UserID      string         `db:"user_id" json:"userId"`
+	Name        string         `db:"name" json:"name"`
+	TokenPrefix string         `db:"token_prefix" json:"-"`
+	TokenHash   string         `db:"token_hash" json:"-"`
+	Scopes      pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt   time.Time      `db:"expires_at" json:"expiresAt"`
+	LastUsedAt  *time.Time     `db:"last_used_at" json:"lastUsedAt"`
+	LastUsedIP  *string        `db:"last_used_ip" json:"lastUsedIp"`
+	CreatedAt   time.Time      `db:"created_at" json:"createdAt"`
+}
+
+type SCIMToken struct {
+	ID             string     `db:"id" json:"id"`
+	OrganizationID string     `db:"organization_id" json:"organizationId"`
+	TokenPrefix    string     `db:"token_prefix" json:"-"`
+	TokenHash      string     `db:"token_hash" json:"-"`
+	CreatedBy      *string    `db:"created_by" json:"createdBy"`
+	LastUsedAt     *time.Time `db:"last_used_at" json:"lastUsedAt"`
+	CreatedAt      time.Time  `db:"created_at" json:"createdAt"`
+}
+
+type Session struct {
+	ID             string    `db:"id" json:"id"`
+	UserID         string    `db:"user_id" json:"userId"`
+	TokenPrefix    string    `db:"token_prefix" json:"-"`
+	TokenHash      string    `db:"token_hash" json:"-"`
+	UserAgent      string    `db:"user_agent" json:"userAgent"`
+	IP             string    `db:"ip" json:"ip"`
+	ImpersonatorID *string   `db:"impersonator_id" json:"impersonatorId"`
+	ExpiresAt      time.Time `db:"expires_at" json:"expiresAt"`
+	LastSeenAt     time.Time `db:"last_seen_at" json:"lastSeenAt"`
+	CreatedAt      time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+type RefreshToken struct {
+	TokenHash string    `db:"token_hash" json:"-"`
+	SessionID string    `db:"session_id" json:"sessionId"`
+	RotatedAt time.Time `db:"rotated_at" json:"rotatedAt"`
+}
+
+type SigningKey struct {
+	ID         string    `db:"id" json:"id"`
+	Algorithm  string    `db:"algorithm" json:"algorithm"`
+	PrivateKey string    `db:"private_key" json:"-"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+type PasswordReset struct {
+	ID          string    `db:"id" json:"id"`
+	UserID      string    `db:"user_id" json:"userId"`
+	TokenPrefix string    `db:"token_prefix" json:"-"`
+	TokenHash   string    `db:"token_hash" json:"-"`
+	ExpiresAt   time.Time `db:"expires_at" json:"expiresAt"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+}
+
+type Invitation struct {
 	ID             string         `db:"id" json:"id"`
+	OrganizationID string         `db:"organization_id" json:"organizationId"`
 	Email          string         `db:"email" json:"email"`
-	Password       string         `db:"password" json:"-"`
-	FirstName      string         `db:"firstname" json:"firstName"`
-	LastName       string         `db:"lastname" json:"lastName"`
-	OrganizationID string         `db:"organization" json:"organizationId,omitempty"`
-	UserType       string         `db:"type" json:"userType"`
-	MFAEnabled     sql.NullString `db:"mfa_enabled" json:"mfaEnabled"`
-	MFASecret      sql.NullString `db:"mfa_secret" json:"-"`
-	LastLogin      *time.Time     `db:"last_login" json:"lastLogin,omitempty"`
-	EmailVerified  bool           `db:"verified" json:"emailVerified"`
-	Active         bool           `db:"active" json:"active"`
+	EmailIndex     sql.NullString `db:"email_index" json:"-"`
+	RoleIDs        pq.StringArray `db:"role_ids" json:"roleIds"`
+	InvitedBy      *string        `db:"invited_by" json:"invitedBy"`
+	TokenPrefix    string         `db:"token_prefix" json:"-"`
+	TokenHash      string         `db:"token_hash" json:"-"`
+	ExpiresAt      time.Time      `db:"expires_at" json:"expiresAt"`
+	AcceptedAt     *time.Time     `db:"accepted_at" json:"acceptedAt"`
 	CreatedAt      time.Time      `db:"created_at" json:"createdAt"`
-	UpdatedAt      time.Time      `db:"updated_at" json:"updatedAt"`
 }
 
-type Organization struct {
+type LoginChallenge struct {
+	ID          string    `db:"id" json:"id"`
+	UserID      string    `db:"user_id" json:"userId"`
+	TokenPrefix string    `db:"token_prefix" json:"-"`
+	TokenHash   string    `db:"token_hash" json:"-"`
+	Type        string    `db:"type" json:"type"`
+	Method      string    `db:"method" json:"method"`
+	Attempts    int       `db:"attempts" json:"attempts"`
+	ExpiresAt   time.Time `db:"expires_at" json:"expiresAt"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+}
+
+type LoginEvent struct {
+	ID            string    `db:"id" json:"id"`
+	UserID        *string   `db:"user_id" json:"userId"`
+	Success       bool      `db:"success" json:"success"`
+	Method        string    `db:"method" json:"method"`
+	IP            *string   `db:"ip" json:"ip"`
+	UserAgent     string    `db:"user_agent" json:"userAgent"`
+	FailureReason *string   `db:"failure_reason" json:"failureReason"`
+	NewDevice     bool      `db:"new_device" json:"newDevice"`
+	NewIP         bool      `db:"new_ip" json:"newIp"`
+	CreatedAt     time.Time `db:"created_at" json:"createdAt"`
+}
+
+type DeviceCode struct {
+	ID              string         `db:"id" json:"id"`
+	DeviceCodeHash  string         `db:"device_code_hash" json:"-"`
+	UserCodeHash    string         `db:"user_code_hash" json:"-"`
+	ClientName      string         `db:"client_name" json:"clientName"`
+	Scopes          pq.StringArray `db:"scopes" json:"scopes"`
+	Status          string         `db:"status" json:"status"`
+	UserID          *string        `db:"user_id" json:"userId"`
+	IntervalSeconds int            `db:"interval_seconds" json:"interval"`
+	LastPolledAt    *time.Time     `db:"last_polled_at" json:"lastPolledAt"`
+	ExpiresAt       time.Time      `db:"expires_at" json:"expiresAt"`
+	CreatedAt       time.Time      `db:"created_at" json:"createdAt"`
+}
+
+type ImpersonationEvent struct {
 	ID             string    `db:"id" json:"id"`
-	Name           string    `db:"name" json:"name"`
-	Domain         string    `db:"domain" json:"domain"`
-	SSO            bool      `db:"sso" json:"sso"`
-	SSOProvider    string    `db:"sso_provider" json:"ssoProvider,omitempty"`
-	SSOMetadataURL string    `db:"sso_metadata_url" json:"ssoMetadataUrl,omitempty"`
-	SSOEntityID    string    `db:"sso_entity_id" json:"ssoEntityId,omitempty"`
-	LDAPEnabled    bool      `db:"ldap" json:"ldapEnabled"`
-	LDAPServer     string    `db:"ldap_server" json:"ldapServer,omitempty"`
-	LDAPBindDN     string    `db:"ldap_bind_dn" json:"ldapBindDn,omitempty"`
-	LDAPSearchBase string    `db:"ldap_search_base" json:"ldapSearchBase,omitempty"`
-	AllowedDomains string    `db:"allowed_domains" json:"allowedDomains,omitempty"`
-	MFARequired    bool      `db:"mfa_required" json:"mfaRequired"`
+	SessionID      string    `db:"session_id" json:"sessionId"`
+	ImpersonatorID string    `db:"impersonator_id" json:"impersonatorId"`
+	UserID         string    `db:"user_id" json:"userId"`
+	Action         string    `db:"action" json:"action"`
+	Method         string    `db:"method" json:"method"`
+	Path           string    `db:"path" json:"path"`
+	Status         *int      `db:"status" json:"status"`
+	IP             *string   `db:"ip" json:"ip"`
 	CreatedAt      time.Time `db:"created_at" json:"createdAt"`
-	UpdatedAt      time.Time `db:"updated_at" json:"updatedAt"`
 }
 
-type Session struct {
-	ID           string    `db:"id" json:"id"`
-	UserID       string    `db:"user_id" json:"userId"`
-	RefreshToken string    `db:"refresh_token" json:"-"`
-	UserAgent    string    `db:"user_agent" json:"userAgent"`
-	IP           string    `db:"ip" json:"ip"`
-	ExpiresAt    time.Time `db:"expires_at" json:"expiresAt"`
-	CreatedAt    time.Time `db:"created_at" json:"createdAt"`
-	UpdatedAt    time.Time `db:"updated_at" json:"updatedAt"`
+type WebauthnCredential struct {
+	ID              string     `db:"id" json:"id"`
+	UserID          string     `db:"user_id" json:"-"`
+	CredentialID    []byte     `db:"credential_id" json:"-"`
+	PublicKey       []byte     `db:"public_key" json:"-"`
+	AttestationType string     `db:"attestation_type" json:"-"`
+	AAGUID          []byte     `db:"aaguid" json:"-"`
+	SignCount       int64      `db:"sign_count" json:"-"`
+	CloneWarning    bool       `db:"clone_warning" json:"cloneWarning"`
+	Flags           int16      `db:"flags" json:"-"`
+	BackupEligible  bool       `db:"backup_eligible" json:"backupEligible"`
+	BackupState     bool       `db:"backup_state" json:"backupState"`
+	Transports      string     `db:"transports" json:"transports"`
+	Name            string     `db:"name" json:"name"`
+	LastUsedAt      *time.Time `db:"last_used_at" json:"lastUsedAt"`
+	CreatedAt       time.Time  `db:"created_at" json:"createdAt"`
+	UpdatedAt       time.Time  `db:"updated_at" json:"updatedAt"`
+}
+
+type WebauthnCeremony struct {
+	ID        string         `db:"id" json:"id"`
+	UserID    sql.NullString `db:"user_id" json:"userId"`
+	Type      string         `db:"type" json:"type"`
+	Data      []byte         `db:"data" json:"-"`
+	ExpiresAt time.Time      `db:"expires_at" json:"expiresAt"`
+	CreatedAt time.Time      `db:"created_at" json:"createdAt"`
+}
+
+type SSORequest struct {
+	ID             string    `db:"id" json:"id"`
+	OrganizationID string    `db:"organization" json:"organizationId"`
+	Protocol       string    `db:"protocol" json:"protocol"`
+	State          string    `db:"state" json:"-"`
+	Nonce          string    `db:"nonce" json:"-"`
+	CodeVerifier   string    `db:"code_verifier" json:"-"`
+	ExpiresAt      time.Time `db:"expires_at" json:"expiresAt"`
+	CreatedAt      time.Time `db:"created_at" json:"createdAt"`
+}
+
+type LDAPGroupRole struct {
+	OrganizationID string    `db:"organization" json:"organizationId"`
+	GroupDN        string    `db:"group_dn" json:"groupDn"`
+	RoleID         string    `db:"role_id" json:"roleId"`
+	CreatedAt      time.Time `db:"created_at" json:"createdAt"`
 }
 
 type Role struct {
@@ -1,13 +1,15 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type RUserRegister struct {
-	Email        string `json:"email" binding:"required"`
-	Password     string `json:"password" binding:"required"`
-	Firstname    string `json:"firstname" binding:"required"`
-	Lastname     string `json:"lastname" binding:"required"`
-	Organization string `json:"organization" binding:"required"`
-	Utype        string `json:"type" binding:"required"`
-	Role         string `json:"role" binding:"required"`
+	Email     string `json:"email" binding:"required"`
+	Password  string `json:"password" binding:"required"`
+	Firstname string `json:"firstname" binding:"required"`
+	Lastname  string `json:"lastname" binding:"required"`
 }
 
 type RUserLoginPassword struct {
@@ -15,6 +17,33 @@ type RUserLoginPassword struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type RLoginChallenge struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+type RLoginMFA struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+type RMFACode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type RWebauthnRegisterBegin struct {
+	Name string `json:"name"`
+}
+
+type RWebauthnCeremony struct {
+	Ceremony string `form:"ceremony" binding:"required"`
+}
+
+type ROIDCCallback struct {
+	Code  string `form:"code"`
+	State string `form:"state" binding:"required"`
+	Error string `form:"error"`
+}
+
 type RUserLogout struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
@@ -29,6 +58,11 @@ type RAssignRole struct {
 	RoleID string `json:"role_id" binding:"required"`
 }
 
+type RRolePermission struct {
+	RoleID     string `json:"role_id" binding:"required"`
+	Permission string `json:"permission" binding:"required"`
+}
+
 type RDeleteRole struct {
 	RoleID string `json:"role_id" binding:"required"`
 }
@@ -36,6 +70,8 @@ type RDeleteRole struct {
 type RUserSearch struct {
 	Name           string `form:"name"`
 	OrganizationId string `form:"org_id"`
+	Email          string `form:"email"`
+	Domain         string `form:"domain"`
 }
 
 type RCreateDeviceRole struct {
@@ -74,3 +110,99 @@ type RSearchDevices struct {
 	Limit  string       `form:"limit"`
 	Offset string       `form:"offset"`
 }
+
+type RSAMLResponse struct {
+	SAMLResponse string `form:"SAMLResponse" binding:"required"`
+	RelayState   string `form:"RelayState"`
+}
+
+type REmail struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type RVerifyEmail struct {
+	Token string `form:"token" binding:"required"`
+}
+
+type RResetPassword struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type RChangePassword struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required"`
+}
+
+type RCreatePersonalToken struct {
+	Name      string    `json:"name" binding:"required"`
+	Scopes    []string  `json:"scopes" binding:"required"`
+	ExpiresAt time.Time `json:"expiresAt" binding:"required"`
+}
+
+type RDeviceCode struct {
+	ClientName string   `json:"clientName"`
+	Scopes     []string `json:"scopes"`
+}
+
+type RDeviceToken struct {
+	DeviceCode string `json:"deviceCode" binding:"required"`
+}
+
+type RUserCode struct {
+	UserCode string `json:"userCode" form:"userCode" binding:"required"`
+}
+
+type RSCIMToken struct {
+	Organization string `json:"organization" form:"organization"`
+}
+
+type RSCIMList struct {
+	Filter     string `form:"filter"`
+	StartIndex int    `form:"startIndex"`
+	Count      *int   `form:"count"`
+}
+
+type RLoginEvents struct {
+	UserID  string `form:"userId"`
+	Success *bool  `form:"success"`
+	Limit   int    `form:"limit"`
+	Offset  int    `form:"offset"`
+}
+
+type RImpersonationEvents struct {
+	Limit  int `form:"limit"`
+	Offset int `form:"offset"`
+}
+
+type RCreateInvitation struct {
+	Email        string   `json:"email" binding:"required"`
+	Roles        []string `json:"roles"`
+	Organization string   `json:"organization"`
+}
+
+type RInvitations struct {
+	Organization string `form:"organization"`
+}
+
+type RInvitationToken struct {
+	Token string `form:"token" binding:"required"`
+}
+
+type RAcceptInvitation struct {
+	Token     string `json:"token" binding:"required"`
+	Password  string `json:"password" binding:"required"`
+	Firstname string `json:"firstname" binding:"required"`
+	Lastname  string `json:"lastname" binding:"required"`
+}
+
+type RUpdateMe struct {
+	FirstName   *string         `json:"firstName"`
+	LastName    *string         `json:"lastName"`
+	Preferences json.RawMessage `json:"preferences"`
+}
+
+type RChangeEmail struct {
+	NewEmail        string `json:"newEmail" binding:"required"`
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+}
@@ -0,0 +1,89 @@
+package models
+
+import "time"
+
+const (
+	SCIMUserSchema          = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema         = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMListResponseSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchOpSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema         = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMServiceConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SCIMResourceTypeSchema  = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMReference is a group of a user or a member of a group.
+type SCIMReference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// SCIMUser is a user as defined in RFC 7643. The userName is the email
+// address.
+type SCIMUser struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        SCIMName        `json:"name"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Emails      []SCIMEmail     `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Groups      []SCIMReference `json:"groups,omitempty"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+// SCIMGroup is a role, with the members from one organization.
+type SCIMGroup struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	DisplayName string          `json:"displayName"`
+	Members     []SCIMReference `json:"members"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+type SCIMListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type SCIMPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+type SCIMPatch struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations" binding:"required"`
+}
+
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	SCIMType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
@@ -0,0 +1,29 @@
+package routes
+
+import (
+	"backend/handlers"
+	"backend/middleware"
+	"backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func AdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin", middleware.CheckSession(), middleware.BlockImpersonation())
+	admin.GET("/users/:id/sessions", middleware.RequirePermission(services.PermissionUsersManage), handlers.UserSessions)
+	admin.DELETE("/users/:id/sessions", middleware.RequirePermission(services.PermissionUsersManage), handlers.RevokeUserSessions)
+	admin.DELETE("/users/:id/sessions/:sessionId", middleware.RequirePermission(services.PermissionUsersManage), handlers.RevokeUserSession)
+	admin.POST("/users/:id/unlock", middleware.RequirePermission(services.PermissionUsersManage), handlers.UnlockUser)
+	admin.POST("/users/:id/deactivate", middleware.RequirePermission(services.PermissionUsersManage), handlers.DeactivateUser)
+	admin.POST("/users/:id/reactivate", middleware.RequirePermission(services.PermissionUsersManage), handlers.ReactivateUser)
+	admin.DELETE("/users/:id", middleware.RequirePermission(services.PermissionUsersManage), handlers.DeleteUser)
+	admin.POST("/users/:id/impersonate", middleware.RequirePermission(services.PermissionUsersImpersonate), handlers.StartImpersonation)
+	admin.GET("/login-events", middleware.RequirePermission(services.PermissionAuditRead), handlers.LoginEvents)
+	admin.GET("/invitations", middleware.RequirePermission(services.PermissionInvitationsManage), handlers.Invitations)
+	admin.POST("/invitations", middleware.RequirePermission(services.PermissionInvitationsManage), handlers.CreateInvitation)
+	admin.POST("/invitations/:id/resend", middleware.RequirePermission(services.PermissionInvitationsManage), handlers.ResendInvitation)
+	admin.DELETE("/invitations/:id", middleware.RequirePermission(services.PermissionInvitationsManage), handlers.RevokeInvitation)
+	admin.GET("/scim/token", middleware.RequirePermission(services.PermissionSCIMManage), handlers.SCIMToken)
+	admin.POST("/scim/token", middleware.RequirePermission(services.PermissionSCIMManage), handlers.CreateSCIMToken)
+	admin.DELETE("/scim/token", middleware.RequirePermission(services.PermissionSCIMManage), handlers.RevokeSCIMToken)
+}
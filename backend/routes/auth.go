@@ -9,8 +9,34 @@ import (
 
 func AuthRoutes(r *gin.Engine) {
 	r.POST("/auth/register", handlers.Register)
+	r.GET("/auth/verify-email", handlers.VerifyEmail)
+	r.POST("/auth/verify-email/resend", handlers.ResendVerification)
+	r.GET("/auth/invitation", handlers.Invitation)
+	r.POST("/auth/invitation/accept", handlers.AcceptInvitation)
+	r.POST("/auth/password/forgot", handlers.ForgotPassword)
+	r.POST("/auth/password/reset", handlers.ResetPassword)
+	r.PUT("/auth/password", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.ChangePassword)
 	r.POST("/auth/login/password", handlers.LoginPassword)
+	r.POST("/auth/login/mfa", handlers.LoginMFA)
+	r.POST("/auth/login/mfa/enroll", handlers.LoginMFAEnroll)
+	r.POST("/auth/login/mfa/enroll/confirm", handlers.LoginMFAEnrollConfirm)
+	r.POST("/auth/login/webauthn/begin", handlers.BeginWebauthnLogin)
+	r.POST("/auth/login/webauthn/finish", handlers.FinishWebauthnLogin)
 	r.GET("/auth/logout", handlers.Logout)
-	r.GET("/auth/refresh", middleware.CheckSession(), handlers.Refresh)
+	r.GET("/auth/refresh", handlers.Refresh)
+	r.GET("/.well-known/jwks.json", handlers.JWKS)
 	r.GET("/auth/me", middleware.CheckSession(), handlers.Me)
+	r.PATCH("/auth/me", middleware.CheckSession(), handlers.UpdateMe)
+	r.POST("/auth/me/email", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.ChangeEmail)
+	r.GET("/auth/me/email/confirm", handlers.ConfirmEmailChange)
+	r.POST("/auth/mfa/enroll", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.EnrollMFA)
+	r.POST("/auth/mfa/confirm", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.ConfirmMFA)
+	r.POST("/auth/mfa/disable", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.DisableMFA)
+	r.POST("/auth/webauthn/register/begin", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.BeginWebauthnRegistration)
+	r.POST("/auth/webauthn/register/finish", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.FinishWebauthnRegistration)
+	r.GET("/auth/webauthn/credentials", middleware.CheckSession(), handlers.WebauthnCredentials)
+	r.DELETE("/auth/webauthn/credentials/:id", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.DeleteWebauthnCredential)
+	r.GET("/auth/tokens", middleware.CheckSession(), handlers.PersonalTokens)
+	r.POST("/auth/tokens", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.CreatePersonalToken)
+	r.DELETE("/auth/tokens/:id", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.RevokePersonalToken)
 }
@@ -3,14 +3,15 @@ package routes
 import (
 	"backend/handlers"
 	"backend/middleware"
+	"backend/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 func DeviceRoutes(r *gin.Engine) {
-	r.GET("/device/server", middleware.CheckSession(), handlers.SearchDevices)
-	r.POST("/device/role/create", middleware.CheckSession(), handlers.CreateDeviceRole)
-	r.POST("/device/role/assign", middleware.CheckSession(), handlers.AssignDeviceRole)
-	r.POST("/device/server/create", middleware.CheckSession(), handlers.CreateDeviceServer)
-	r.PUT("/device/server", middleware.CheckSession(), handlers.UpdateDeviceServer)
+	r.GET("/device/server", middleware.CheckSessionOrToken(services.ScopeDevicesRead), middleware.RequirePermission(services.PermissionDevicesRead), handlers.SearchDevices)
+	r.POST("/device/role/create", middleware.CheckSessionOrToken(services.ScopeDevicesWrite), middleware.RequirePermission(services.PermissionDevicesWrite), handlers.CreateDeviceRole)
+	r.POST("/device/role/assign", middleware.CheckSessionOrToken(services.ScopeDevicesWrite), middleware.RequirePermission(services.PermissionDevicesWrite), handlers.AssignDeviceRole)
+	r.POST("/device/server/create", middleware.CheckSessionOrToken(services.ScopeDevicesWrite), middleware.RequirePermission(services.PermissionDevicesWrite), handlers.CreateDeviceServer)
+	r.PUT("/device/server", middleware.CheckSessionOrToken(services.ScopeDevicesWrite), middleware.RequirePermission(services.PermissionDevicesWrite), handlers.UpdateDeviceServer)
 }
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"backend/handlers"
+	"backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func DeviceAuthorizationRoutes(r *gin.Engine) {
+	r.POST("/auth/device/code", handlers.RequestDeviceCode)
+	r.POST("/auth/device/token", handlers.PollDeviceToken)
+	r.GET("/auth/device", middleware.CheckSession(), handlers.DeviceRequest)
+	r.POST("/auth/device/approve", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.ApproveDevice)
+	r.POST("/auth/device/deny", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.DenyDevice)
+}
@@ -3,14 +3,17 @@ package routes
 import (
 	"backend/handlers"
 	"backend/middleware"
+	"backend/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 func RoleRoute(r *gin.Engine) {
-	r.GET("/role", middleware.CheckSession(), handlers.Roles)
-	r.POST("/role/create", middleware.CheckSession(), handlers.Create)
-	r.POST("/role/assign", middleware.CheckSession(), handlers.Assign)
-	r.POST("/role/unassign", middleware.CheckSession(), handlers.Unassign)
-	r.DELETE("/role/delete", middleware.CheckSession(), handlers.Delete)
+	r.GET("/role", middleware.CheckSession(), middleware.RequirePermission(services.PermissionRolesRead), handlers.Roles)
+	r.POST("/role/create", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesWrite), handlers.Create)
+	r.POST("/role/assign", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesAssign), handlers.Assign)
+	r.POST("/role/unassign", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesAssign), handlers.Unassign)
+	r.POST("/role/permission/grant", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesWrite), handlers.GrantPermission)
+	r.POST("/role/permission/revoke", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesWrite), handlers.RevokePermission)
+	r.DELETE("/role/delete", middleware.CheckSession(), middleware.BlockImpersonation(), middleware.RequirePermission(services.PermissionRolesWrite), handlers.Delete)
 }
@@ -8,8 +8,13 @@ import (
 
 func SetupRoutes(r *gin.Engine) {
 	AuthRoutes(r)
+	SSORoutes(r)
+	SessionRoutes(r)
+	DeviceAuthorizationRoutes(r)
 	RoleRoute(r)
 	UserRoute(r)
 	DeviceRoutes(r)
+	AdminRoutes(r)
+	SCIMRoutes(r)
 	r.GET("/hello", handlers.Hello)
 }
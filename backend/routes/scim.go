@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"backend/handlers"
+	"backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SCIMRoutes(r *gin.Engine) {
+	scim := r.Group("/scim/v2", middleware.CheckSCIMToken())
+	scim.GET("/ServiceProviderConfig", handlers.SCIMServiceProviderConfig)
+	scim.GET("/ResourceTypes", handlers.SCIMResourceTypes)
+	scim.GET("/Users", handlers.SCIMUsers)
+	scim.POST("/Users", handlers.CreateSCIMUser)
+	scim.GET("/Users/:id", handlers.SCIMUser)
+	scim.PUT("/Users/:id", handlers.ReplaceSCIMUser)
+	scim.PATCH("/Users/:id", handlers.PatchSCIMUser)
+	scim.DELETE("/Users/:id", handlers.DeprovisionSCIMUser)
+	scim.GET("/Groups", handlers.SCIMGroups)
+	scim.POST("/Groups", handlers.SCIMGroupsReadOnly)
+	scim.GET("/Groups/:id", handlers.SCIMGroup)
+	scim.PUT("/Groups/:id", handlers.ReplaceSCIMGroup)
+	scim.PATCH("/Groups/:id", handlers.PatchSCIMGroup)
+	scim.DELETE("/Groups/:id", handlers.SCIMGroupsReadOnly)
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"backend/handlers"
+	"backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SessionRoutes(r *gin.Engine) {
+	r.GET("/auth/sessions", middleware.CheckSession(), handlers.Sessions)
+	r.DELETE("/auth/sessions", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.RevokeOtherSessions)
+	r.DELETE("/auth/sessions/:id", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.RevokeSession)
+	r.GET("/auth/login-history", middleware.CheckSession(), handlers.LoginHistory)
+	r.GET("/auth/impersonations", middleware.CheckSession(), handlers.Impersonations)
+	r.POST("/auth/impersonation/stop", middleware.CheckSession(), handlers.StopImpersonation)
+}
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"backend/handlers"
+	"backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SSORoutes(r *gin.Engine) {
+	r.GET("/auth/sso/oidc/:orgId/login", handlers.OIDCLogin)
+	r.GET("/auth/sso/oidc/:orgId/callback", handlers.OIDCCallback)
+	r.GET("/auth/sso/saml/:orgId/metadata", handlers.SAMLMetadata)
+	r.GET("/auth/sso/saml/:orgId/login", handlers.SAMLLogin)
+	r.POST("/auth/sso/saml/:orgId/acs", handlers.SAMLACS)
+	r.GET("/auth/sso/saml/:orgId/logout", middleware.CheckSession(), handlers.SAMLLogout)
+	r.GET("/auth/sso/saml/:orgId/slo", handlers.SAMLSLO)
+	r.POST("/auth/sso/saml/:orgId/slo", handlers.SAMLSLO)
+}
@@ -3,10 +3,12 @@ package routes
 import (
 	"backend/handlers"
 	"backend/middleware"
+	"backend/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 func UserRoute(r *gin.Engine) {
-	r.GET("/user/search", middleware.CheckSession(), handlers.Search)
+	r.GET("/user/search", middleware.CheckSession(), middleware.RequirePermission(services.PermissionUsersRead), handlers.Search)
+	r.GET("/auth/me/export", middleware.CheckSession(), middleware.BlockImpersonation(), handlers.ExportMe)
 }
@@ -10,10 +10,11 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
-var insertUsersString = "INSERT INTO auth.users (id, email, password, firstname, lastname, organization, type) VALUES ($1, $2, $3, $4, $5, $6, $7);"
-var insertSessionString = "INSERT INTO auth.sessions (user_id, refresh_token, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5);"
+var insertUsersString = "INSERT INTO auth.users (id, email, email_index, email_domain_index, password, firstname, lastname, organization, type, verification_sent_at, self_registered) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now(), true);"
+var insertSessionString = "INSERT INTO auth.sessions (user_id, token_prefix, token_hash, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;"
 
 func RegisterUser(body models.RUserRegister) error {
 	db := DB
@@ -39,21 +40,33 @@ func RegisterUser(body models.RUserRegister) error {
 		}
 	}()
 
-	encEmail, err := Encrypt(body.Email)
-	hashPassword, err := Hash256(body.Password)
+	org, found, err := organizationForEmail(tx, body.Email)
+	if err != nil {
+		return err
+	}
+	err = checkSelfRegistration(org, found)
+	if err != nil {
+		return err
+	}
 
+	encEmail, err := encryptEmail(body.Email)
+	if err != nil {
+		return err
+	}
+	hashPassword, err := HashPassword(body.Password)
 	if err != nil {
-		err = errors.New("Encryption failed!")
+		err = errors.New("Hashing password failed!")
 		return err
 	}
 
-	err = tx.Select(&ids, "SELECT id FROM auth.users WHERE email = $1", encEmail)
+	err = tx.Select(&ids, "SELECT id FROM auth.users WHERE email_index = $1", encEmail.Index)
 	if len(ids) > 0 {
 		err = errors.New("User already exists!")
 		return err
 	}
 
-	res, err := tx.Exec(insertUsersString, uuid, encEmail, hashPassword, body.Firstname, body.Lastname, body.Organization, body.Utype)
+	// Organization, type and role are never taken from the request.
+	res, err := tx.Exec(insertUsersString, uuid, encEmail.Value, encEmail.Index, encEmail.DomainIndex, hashPassword, body.Firstname, body.Lastname, org.ID, organizationUserType)
 	if err != nil {
 		return err
 	}
@@ -67,7 +80,7 @@ func RegisterUser(body models.RUserRegister) error {
 	}
 
 	var roles []string
-	err = tx.Select(&roles, "select id from auth.roles where name = $1", body.Role)
+	err = tx.Select(&roles, "select id from auth.roles where name = $1", defaultRoleName)
 	if err != nil {
 		return err
 	}
@@ -76,20 +89,56 @@ func RegisterUser(body models.RUserRegister) error {
 		return err
 	}
 
-	res, err = tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) VALUES ($1, $2);", uuid.String(), roles[0])
+	_, err = tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) VALUES ($1, $2);", uuid.String(), roles[0])
+	if err != nil {
+		return err
+	}
 
 	if err = tx.Commit(); err != nil {
 		err = errors.New("Transaction commit failed!")
 		return err
 	}
 
+	// The account exists either way; a lost mail can be sent again.
+	if mailErr := sendVerificationEmail(uuid.String(), body.Email); mailErr != nil {
+		log.Printf("Sending verification mail failed: %v", mailErr)
+	}
+
 	return err
 }
 
-func LoginPasswordUser(body models.RUserLoginPassword, userAgent string, ip string) (models.USesssion, error) {
+func LoginPasswordUser(body models.RUserLoginPassword, userAgent string, ip string) (models.ULogin, error) {
 	db := DB
 	var err error
-	var data models.USesssion
+	var data models.ULogin
+
+	method := loginMethodPassword
+	defer func() {
+		if err != nil {
+			logFailedLogin(userIDByEmail(body.Email), method, userAgent, ip, err.Error())
+		}
+	}()
+
+	err = checkLoginThrottle(body.Email, ip)
+	if err != nil {
+		return data, err
+	}
+
+	// Users of LDAP-enabled organizations authenticate against the directory
+	// instead of a local password hash.
+	ldapOrg, isLDAP, err := ldapOrganizationForEmail(body.Email)
+	if err != nil {
+		return data, err
+	}
+	var directoryUser ldapUser
+	if isLDAP {
+		method = loginMethodLDAP
+		directoryUser, err = ldapAuthenticate(ldapOrg, body.Email, body.Password)
+		if err != nil {
+			recordLoginFailure(body.Email, ip, err)
+			return data, err
+		}
+	}
 
 	var ctx = context.Background()
 	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
@@ -109,59 +158,147 @@ func LoginPasswordUser(body models.RUserLoginPassword, userAgent string, ip stri
 		}
 	}()
 
-	var ids []string
-	encEmail, err := Encrypt(body.Email)
-	hashPassword, err := Hash256(body.Password)
+	var userID string
+	if isLDAP {
+		userID, err = provisionSSOUser(tx, ldapOrg, body.Email, directoryUser.FirstName, directoryUser.LastName)
+		if err != nil {
+			return data, err
+		}
+		err = syncLDAPRoles(tx, ldapOrg.ID, userID, directoryUser.Groups)
+		if err != nil {
+			return data, err
+		}
+	} else {
+		userID, err = verifyLocalPassword(tx, body)
+		if err != nil {
+			recordLoginFailure(body.Email, ip, err)
+			return data, err
+		}
+		err = checkEmailVerified(tx, userID)
+		if err != nil {
+			return data, err
+		}
+	}
 
+	err = checkUserActive(tx, userID)
 	if err != nil {
-		err = errors.New("Encryption failed!")
 		return data, err
 	}
-	err = tx.Select(&ids, "select id from auth.users where email = $1 and password = $2", encEmail, hashPassword)
+
+	challengeType, err := requiredChallenge(tx, userID)
 	if err != nil {
 		return data, err
 	}
-	if len(ids) == 0 || len(ids) > 1 {
-		err = errors.New("User doesn't exist!")
+	if challengeType != "" {
+		var challenge models.ULoginChallenge
+		challenge, err = createLoginChallenge(tx, userID, challengeType, method)
+		if err != nil {
+			return data, err
+		}
+		// The account throttle is reset once the challenge is passed, so
+		// the password can't be used to clear it between guesses.
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		data.Challenge = &challenge
 		return data, err
 	}
 
-	var sessIds []string
-	err = tx.Select(&sessIds, "select id from auth.sessions where user_id = $1", ids[0])
+	session, err := createSession(tx, userID, method, userAgent, ip)
 	if err != nil {
 		return data, err
 	}
-	if len(sessIds) > 0 {
-		_, err := tx.Exec("delete from auth.sessions where user_id = $1", ids[0])
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+	resetLoginThrottle(body.Email)
+
+	data.Session = &session
+
+	return data, err
+}
+
+func verifyLocalPassword(tx *sqlx.Tx, body models.RUserLoginPassword) (string, error) {
+	var users []models.User
+	emailIndex, err := EmailIndex(body.Email)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Select(&users, "select id, password from auth.users where email_index = $1", emailIndex)
+	if err != nil {
+		return "", err
+	}
+	if len(users) == 0 || len(users) > 1 {
+		VerifyDummyPassword(body.Password)
+		return "", errors.New("User doesn't exist!")
+	}
+
+	match, rehash, err := VerifyPassword(body.Password, users[0].Password)
+	if err != nil {
+		return "", err
+	}
+	if !match {
+		return "", errors.New("User doesn't exist!")
+	}
+	if rehash {
+		newHash, err := HashPassword(body.Password)
 		if err != nil {
-			return data, err
+			return "", err
+		}
+		_, err = tx.Exec("update auth.users set password = $1, updated_at = now() where id = $2", newHash, users[0].ID)
+		if err != nil {
+			return "", err
 		}
 	}
+	return users[0].ID, nil
+}
+
+// createSession signs userID in after a successful login with method.
+func createSession(tx *sqlx.Tx, userID string, method string, userAgent string, ip string) (models.USesssion, error) {
+	var data models.USesssion
 
-	expiresAt := time.Now().AddDate(0, 0, 7)
-	refreshToken, err := GenerateKey()
-	res, err := tx.Exec(insertSessionString, ids[0], refreshToken, userAgent, ip, expiresAt)
+	err := checkUserActive(tx, userID)
 	if err != nil {
-		err = errors.New("Creating session failed!")
 		return data, err
 	}
-	rows, err := res.RowsAffected()
-	if rows == 0 {
-		err = errors.New("Creating session succeded but no rows were inserted")
+
+	expiresAt := time.Now().Add(SessionLifetime())
+	refreshToken, prefix, hash, err := GenerateToken()
+	if err != nil {
 		return data, err
 	}
+	var ids []string
+	err = tx.Select(&ids, insertSessionString, userID, prefix, hash, userAgent, ip, expiresAt)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return data, errors.New("Creating session failed!")
+	}
+	if len(ids) == 0 {
+		return data, errors.New("Creating session succeded but no rows were inserted")
+	}
 
-	if err = tx.Commit(); err != nil {
-		err = errors.New("Transaction commit failed!")
+	err = recordLoginSuccess(tx, userID, method, userAgent, ip)
+	if err != nil {
+		return data, err
+	}
+
+	accessToken, accessExpiresAt, err := issueAccessToken(userID, ids[0], "")
+	if err != nil {
 		return data, err
 	}
 
 	data = models.USesssion{
-		RefreshToken: refreshToken,
-		ExpiresAt:    expiresAt,
+		SessionID:       ids[0],
+		AccessToken:     accessToken,
+		AccessExpiresAt: accessExpiresAt,
+		RefreshToken:    refreshToken,
+		ExpiresAt:       expiresAt,
 	}
 
-	return data, err
+	return data, nil
 }
 
 func LogoutSession(body models.RUserLogout) error {
@@ -186,18 +323,19 @@ func LogoutSession(body models.RUserLogout) error {
 		}
 	}()
 
-	res, err := tx.Exec("delete from auth.sessions where refresh_token = $1", body.RefreshToken)
+	session, found, err := sessionByToken(tx, body.RefreshToken)
 	if err != nil {
 		return err
 	}
-	rows, err := res.RowsAffected()
-	if err != nil {
+	if !found {
+		err = errors.New("Session doesn't exist!")
 		return err
 	}
-	if rows == 0 {
-		err = errors.New("Session doesn't exist!")
+	_, err = tx.Exec("delete from auth.sessions where id = $1", session.ID)
+	if err != nil {
 		return err
 	}
+	denySessions(session.ID)
 	if err = tx.Commit(); err != nil {
 		err = errors.New("Transaction commit failed!")
 		return err
@@ -206,7 +344,10 @@ func LogoutSession(body models.RUserLogout) error {
 	return err
 }
 
-func RefreshSession(uID string, userAgent string, ip string) (models.USesssion, error) {
+// RefreshSession rotates the refresh token of a session and issues a new
+// access token. Presenting a refresh token that was already rotated means it
+// leaked, so the whole session is revoked.
+func RefreshSession(refreshToken string, userAgent string, ip string) (models.USesssion, error) {
 	db := DB
 	var err error
 	var data models.USesssion
@@ -229,27 +370,74 @@ func RefreshSession(uID string, userAgent string, ip string) (models.USesssion,
 		}
 	}()
 
-	res, err := tx.Exec("delete from auth.sessions where user_id = $1", uID)
+	session, found, err := sessionByToken(tx, refreshToken)
 	if err != nil {
 		return data, err
 	}
-	rowsAffected, err := res.RowsAffected()
-	if rowsAffected == 0 {
-		err = errors.New("Session deletion failed!")
+	tokenHash, err := HashToken(refreshToken)
+	if err != nil {
 		return data, err
 	}
+	if !found {
+		var rotated []models.RefreshToken
+		err = tx.Select(&rotated, "select * from auth.refresh_tokens where token_hash = $1", tokenHash)
+		if err != nil {
+			return data, err
+		}
+		if len(rotated) == 0 {
+			err = errors.New("Session doesn't exist!")
+			return data, err
+		}
+		_, err = tx.Exec("delete from auth.sessions where id = $1", rotated[0].SessionID)
+		if err != nil {
+			return data, err
+		}
+		denySessions(rotated[0].SessionID)
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		log.Printf("Refresh token reuse detected, revoked session %s", rotated[0].SessionID)
+		err = errors.New("Session doesn't exist!")
+		return data, err
+	}
+	if !session.ExpiresAt.After(time.Now()) || !session.LastSeenAt.After(time.Now().Add(-SessionIdleTimeout())) {
+		err = errors.New("Session doesn't exist!")
+		return data, err
+	}
+	// Access tokens are checked without the database, so deactivations are
+	// enforced here.
+	var impersonatorID string
+	if session.ImpersonatorID != nil {
+		impersonatorID = *session.ImpersonatorID
+	}
+	for _, uID := range []string{session.UserID, impersonatorID} {
+		if uID == "" {
+			continue
+		}
+		if checkUserActive(tx, uID) != nil {
+			err = errors.New("Session doesn't exist!")
+			return data, err
+		}
+	}
 
-	expiresAt := time.Now().AddDate(0, 0, 7)
-	refreshToken, err := GenerateKey()
-	res, err = tx.Exec(insertSessionString, uID, refreshToken, userAgent, ip, expiresAt)
+	_, err = tx.Exec("INSERT INTO auth.refresh_tokens (token_hash, session_id) VALUES ($1, $2);", tokenHash, session.ID)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		err = errors.New("Creating session failed!")
 		return data, err
 	}
-	rowsAffected, err = res.RowsAffected()
-	if rowsAffected == 0 {
-		err = errors.New("Creating session succeded but no rows were affected!")
+
+	newRefreshToken, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	_, err = tx.Exec(`update auth.sessions set token_prefix = $1, token_hash = $2, user_agent = $3, ip = $4, last_seen_at = now(), updated_at = now()
+		where id = $5`, prefix, hash, userAgent, ip, session.ID)
+	if err != nil {
+		return data, err
+	}
+
+	accessToken, accessExpiresAt, err := issueAccessToken(session.UserID, session.ID, impersonatorID)
+	if err != nil {
 		return data, err
 	}
 
@@ -259,17 +447,20 @@ func RefreshSession(uID string, userAgent string, ip string) (models.USesssion,
 	}
 
 	data = models.USesssion{
-		RefreshToken: refreshToken,
-		ExpiresAt:    expiresAt,
+		SessionID:       session.ID,
+		AccessToken:     accessToken,
+		AccessExpiresAt: accessExpiresAt,
+		RefreshToken:    newRefreshToken,
+		ExpiresAt:       session.ExpiresAt,
 	}
 
 	return data, err
 }
 
-func Me(uID string) (models.User, error) {
+func Me(uID string) (models.UUser, error) {
 	db := DB
 	var err error
-	var data models.User
+	var data models.UUser
 
 	var ctx = context.Background()
 	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
@@ -289,21 +480,15 @@ func Me(uID string) (models.User, error) {
 		}
 	}()
 
-	var uInformation []models.User
-
-	err = tx.Select(&uInformation, "select * from auth.users where id = $1", uID)
+	data, err = userProfile(tx, uID)
 	if err != nil {
 		return data, err
 	}
-	if len(uInformation) == 0 || len(uInformation) > 1 {
-		err = errors.New("User doesn't exist!")
-		return data, err
-	}
 
 	if err = tx.Commit(); err != nil {
 		err = errors.New("Transaction commit failed!")
 		return data, err
 	}
 
-	return uInformation[0], err
+	return data, err
 }
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// encryptedEmail is an address ready to be stored: randomly encrypted, with
+// blind indexes for exact and domain lookups.
+type encryptedEmail struct {
+	Value       string
+	Index       string
+	DomainIndex string
+}
+
+// blindIndexKey is BLIND_INDEX_KEY, or derived from the token hash key. It
+// is independent of the AES keys, so rotating those keeps the indexes.
+func blindIndexKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(GetEnvDefault("BLIND_INDEX_KEY", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		return key, nil
+	}
+
+	hashKey, err := tokenHashKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte("blind_index"))
+	return mac.Sum(nil), nil
+}
+
+func blindIndex(kind string, value string) (string, error) {
+	key, err := blindIndexKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kind + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailIndex returns the blind index of email. Addresses differing only in
+// case share it.
+func EmailIndex(email string) (string, error) {
+	return blindIndex("email", normalizeEmail(email))
+}
+
+// DomainIndex returns the blind index of a domain, matching the
+// email_domain_index of addresses in it.
+func DomainIndex(domain string) (string, error) {
+	return blindIndex("domain", strings.ToLower(strings.TrimSpace(domain)))
+}
+
+// encryptEmail encrypts email and computes its blind indexes.
+func encryptEmail(email string) (encryptedEmail, error) {
+	var data encryptedEmail
+	var err error
+	domain := emailDomain(email)
+	if domain == "" {
+		return data, errors.New("Invalid email!")
+	}
+
+	data.Value, err = Encrypt(email)
+	if err != nil {
+		return data, errors.New("Encryption failed!")
+	}
+	data.Index, err = EmailIndex(email)
+	if err != nil {
+		return data, err
+	}
+	data.DomainIndex, err = DomainIndex(domain)
+	return data, err
+}
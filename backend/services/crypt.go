@@ -9,15 +9,84 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
+	"sync"
 )
 
-func Encrypt(plaintext string) (string, error) {
-	key, err := base64.StdEncoding.DecodeString(GetEnv("AES_KEY"))
-	if err != nil {
-		return "", err
+// tokenPrefixLength is the length of the lookup prefix of tokens that predate
+// GenerateToken and therefore have no separator.
+const tokenPrefixLength = 16
+
+// keyring holds the AES keys emails and secrets are encrypted with. Values
+// encrypted with a keyring key carry its ID as "<id>$<base64>"; values
+// without an ID predate the keyring and belong to AES_KEY.
+type keyring struct {
+	primaryID string
+	keys      map[string][]byte
+}
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var loadedKeyring *keyring
+var keyringErr error
+var keyringOnce sync.Once
+
+// getKeyring reads AES_KEYS ("id:base64key,...") and AES_KEY_ID, which names
+// the key new values are encrypted with and defaults to the last one listed.
+// Without AES_KEYS, AES_KEY alone encrypts as before.
+func getKeyring() (*keyring, error) {
+	keyringOnce.Do(func() {
+		ring := &keyring{keys: map[string][]byte{}}
+		if legacy := GetEnvDefault("AES_KEY", ""); legacy != "" {
+			key, err := base64.StdEncoding.DecodeString(legacy)
+			if err != nil {
+				keyringErr = fmt.Errorf("Invalid AES_KEY: %v", err)
+				return
+			}
+			ring.keys[""] = key
+		}
+
+		for _, entry := range strings.Split(GetEnvDefault("AES_KEYS", ""), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			id, encoded, found := strings.Cut(entry, ":")
+			if !found || !keyIDPattern.MatchString(id) {
+				keyringErr = fmt.Errorf("Invalid AES_KEYS entry %q", id)
+				return
+			}
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				keyringErr = fmt.Errorf("Invalid AES_KEYS key %q: %v", id, err)
+				return
+			}
+			ring.keys[id] = key
+			ring.primaryID = id
+		}
+		ring.primaryID = GetEnvDefault("AES_KEY_ID", ring.primaryID)
+
+		if _, ok := ring.keys[ring.primaryID]; !ok {
+			keyringErr = errors.New("No AES key configured for AES_KEY_ID")
+			return
+		}
+		loadedKeyring = ring
+	})
+	return loadedKeyring, keyringErr
+}
+
+// keyIDOf returns the ID of the key value was encrypted with.
+func keyIDOf(value string) string {
+	if id, _, found := strings.Cut(value, "$"); found {
+		return id
 	}
+	return ""
+}
 
+func encryptWith(id string, key []byte, plaintext string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -28,33 +97,48 @@ func Encrypt(plaintext string) (string, error) {
 		return "", err
 	}
 
-	nonceKey := deriveNonceKey(key)
-	h := hmac.New(sha256.New, nonceKey)
-	h.Write([]byte(plaintext))
-	nonceHash := h.Sum(nil)
-
-	nonce := nonceHash[:gcm.NonceSize()]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
 
 	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
 
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	encoded := base64.StdEncoding.EncodeToString(ciphertext)
+	if id == "" {
+		return encoded, nil
+	}
+	return id + "$" + encoded, nil
 }
 
-// Helper function to derive a nonce key from the main key
-func deriveNonceKey(key []byte) []byte {
-	h := sha256.New()
-	h.Write([]byte("email_nonce"))
-	h.Write(key)
-	return h.Sum(nil)
+// Encrypt encrypts plaintext with the primary key under a random nonce, so
+// equal plaintexts don't give equal ciphertexts. Look values up by their
+// blind index instead.
+func Encrypt(plaintext string) (string, error) {
+	ring, err := getKeyring()
+	if err != nil {
+		return "", err
+	}
+	return encryptWith(ring.primaryID, ring.keys[ring.primaryID], plaintext)
 }
 
-// The Decrypt function remains unchanged as it extracts the nonce from the ciphertext
+// Decrypt picks the key by the ID in cipherText and extracts the nonce from
+// the ciphertext.
 func Decrypt(cipherText string) (string, error) {
-	key, err := base64.StdEncoding.DecodeString(GetEnv("AES_KEY"))
+	ring, err := getKeyring()
 	if err != nil {
 		return "", err
 	}
 
+	id := keyIDOf(cipherText)
+	key, ok := ring.keys[id]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", id)
+	}
+	if id != "" {
+		cipherText = cipherText[len(id)+1:]
+	}
+
 	ciphertext, err := base64.StdEncoding.DecodeString(cipherText)
 	if err != nil {
 		return "", err
@@ -91,6 +175,94 @@ func GenerateKey() (string, error) {
 	return base64.StdEncoding.EncodeToString(key), err
 }
 
+// GenerateToken returns a random "<prefix>.<secret>" token together with the
+// prefix, which is stored in the clear to find the token again, and the
+// token's keyed hash, which is stored instead of the token.
+func GenerateToken() (string, string, string, error) {
+	prefix := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", "", "", err
+	}
+
+	encodedPrefix := base64.RawURLEncoding.EncodeToString(prefix)
+	token := encodedPrefix + "." + base64.RawURLEncoding.EncodeToString(secret)
+	hash, err := HashToken(token)
+	return token, encodedPrefix, hash, err
+}
+
+func TokenPrefix(token string) string {
+	if prefix, _, found := strings.Cut(token, "."); found {
+		return prefix
+	}
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+	return token[:tokenPrefixLength]
+}
+
+// HashToken computes the HMAC-SHA256 of token under TOKEN_HASH_KEY, or under
+// a key derived from AES_KEY if that isn't set.
+func HashToken(token string) (string, error) {
+	key, err := tokenHashKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func tokenHashKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(GetEnvDefault("TOKEN_HASH_KEY", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		return key, nil
+	}
+
+	// The derived key has to outlive a key rotation, so AES_KEY stays set
+	// for it unless TOKEN_HASH_KEY is.
+	legacy := GetEnvDefault("AES_KEY", "")
+	if legacy == "" {
+		return nil, errors.New("TOKEN_HASH_KEY or AES_KEY required")
+	}
+	aesKey, err := base64.StdEncoding.DecodeString(legacy)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("token_hash"))
+	h.Write(aesKey)
+	return h.Sum(nil), nil
+}
+
+// signingSecret derives the HMAC key for signed links of one purpose from
+// the token hash key, so a link for one purpose can't be replayed as another.
+func signingSecret(purpose string) ([]byte, error) {
+	key, err := tokenHashKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("signed_link:" + purpose))
+	return mac.Sum(nil), nil
+}
+
+// TokenMatches compares token against a stored hash in constant time.
+func TokenMatches(token string, hash string) bool {
+	computed, err := HashToken(token)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(computed), []byte(hash))
+}
+
 func Hash256(plaintext string) (string, error) {
 	hasher := sha256.New()
 	_, err := hasher.Write([]byte(plaintext))
@@ -69,3 +69,10 @@ func GetEnv(key string) string {
 	log.Fatalf("Environment variable %s not found", key)
 	return ""
 }
+
+func GetEnvDefault(key string, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists && value != "" {
+		return value
+	}
+	return fallback
+}
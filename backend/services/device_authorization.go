@@ -0,0 +1,386 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// userCodeAlphabet leaves out vowels and look-alikes, as RFC 8628 suggests,
+// so user codes are easy to type and never spell words.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+const (
+	deviceCodePending  = "pending"
+	deviceCodeApproved = "approved"
+	deviceCodeDenied   = "denied"
+)
+
+func deviceCodeLifetime() time.Duration {
+	return envDuration("DEVICE_CODE_LIFETIME", 10*time.Minute)
+}
+
+func deviceCodeInterval() time.Duration {
+	return envDuration("DEVICE_CODE_INTERVAL", 5*time.Second)
+}
+
+// deviceTokenLifetime is how long tokens from device logins last, at most
+// PERSONAL_TOKEN_MAX_LIFETIME.
+func deviceTokenLifetime() time.Duration {
+	return min(envDuration("DEVICE_TOKEN_LIFETIME", 30*24*time.Hour), personalTokenMaxLifetime())
+}
+
+// deviceLimit locks a key for a code lifetime once it was counted limit
+// times within one.
+func deviceLimit(key string, limit int) error {
+	err := checkDeviceLimit(key)
+	if err != nil {
+		return err
+	}
+	_, err = GetLimiterStore().Fail(key, deviceCodeLifetime(), func(count int) time.Duration {
+		if count >= limit {
+			return deviceCodeLifetime()
+		}
+		return 0
+	})
+	return err
+}
+
+func checkDeviceLimit(key string) error {
+	entry, err := GetLimiterStore().Get(key)
+	if err != nil {
+		return err
+	}
+	if retryAfter := time.Until(entry.LockedUntil); retryAfter > 0 {
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+func generateUserCode() (string, error) {
+	var b strings.Builder
+	for range userCodeLength {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeUserCode accepts user codes typed in any case, with or without
+// the dash.
+func normalizeUserCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+// RequestDeviceCode starts a device login for a CLI. At most
+// DEVICE_CODE_RATE_LIMIT logins can be started from one IP per code
+// lifetime.
+func RequestDeviceCode(body models.RDeviceCode, ip string) (models.UDeviceCode, error) {
+	db := DB
+	var err error
+	var data models.UDeviceCode
+
+	err = deviceLimit("device:"+ip, int(envUint("DEVICE_CODE_RATE_LIMIT", 10, 16)))
+	if err != nil {
+		return data, err
+	}
+
+	clientName := strings.TrimSpace(body.ClientName)
+	if clientName == "" {
+		clientName = "CLI"
+	}
+	if len(clientName) > 80 {
+		err = errors.New("Invalid client name!")
+		return data, err
+	}
+	scopes := PersonalTokenScopes
+	if len(body.Scopes) > 0 {
+		scopes, err = personalTokenScopes(body.Scopes)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	deviceCode, _, deviceCodeHash, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return data, err
+	}
+	userCodeHash, err := HashToken(userCode)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`INSERT INTO auth.device_codes (device_code_hash, user_code_hash, client_name, scopes, interval_seconds, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`, deviceCodeHash, userCodeHash, clientName, pq.StringArray(scopes),
+		int(deviceCodeInterval().Seconds()), time.Now().Add(deviceCodeLifetime()))
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	formatted := userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+	data = models.UDeviceCode{
+		DeviceCode:              deviceCode,
+		UserCode:                formatted,
+		VerificationURI:         FrontendURL() + "/device",
+		VerificationURIComplete: FrontendURL() + "/device?userCode=" + url.QueryEscape(formatted),
+		ExpiresIn:               int(deviceCodeLifetime().Seconds()),
+		Interval:                int(deviceCodeInterval().Seconds()),
+	}
+	return data, err
+}
+
+// PollDeviceToken answers the CLI's polls. Once the login was approved, the
+// first poll gets a personal access token and the device code is used up.
+func PollDeviceToken(body models.RDeviceToken) (models.UCreatedPersonalToken, error) {
+	db := DB
+	var err error
+	var data models.UCreatedPersonalToken
+
+	hash, err := HashToken(body.DeviceCode)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var codes []models.DeviceCode
+	err = tx.Select(&codes, "select * from auth.device_codes where device_code_hash = $1 for update", hash)
+	if err != nil {
+		return data, err
+	}
+	if len(codes) != 1 {
+		err = errors.New("Invalid device code!")
+		return data, err
+	}
+	code := codes[0]
+
+	// The outcome of these checks is kept, so commit before failing.
+	var result error
+	switch {
+	case !code.ExpiresAt.After(time.Now()):
+		_, err = tx.Exec("delete from auth.device_codes where id = $1", code.ID)
+		result = errors.New("Expired token!")
+	case code.LastPolledAt != nil && time.Since(*code.LastPolledAt) < time.Duration(code.IntervalSeconds)*time.Second:
+		// Clients polling too fast have to wait 5 seconds longer from now on.
+		_, err = tx.Exec("update auth.device_codes set interval_seconds = interval_seconds + 5, last_polled_at = now() where id = $1", code.ID)
+		result = errors.New("Slow down!")
+	case code.Status == deviceCodeDenied:
+		_, err = tx.Exec("delete from auth.device_codes where id = $1", code.ID)
+		result = errors.New("Access denied!")
+	case code.Status != deviceCodeApproved || code.UserID == nil:
+		_, err = tx.Exec("update auth.device_codes set last_polled_at = now() where id = $1", code.ID)
+		result = errors.New("Authorization pending!")
+	}
+	if err != nil {
+		return data, err
+	}
+	if result != nil {
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		err = result
+		return data, err
+	}
+
+	err = checkUserActive(tx, *code.UserID)
+	if err != nil {
+		return data, err
+	}
+	data, err = insertPersonalToken(tx, *code.UserID, "Device login: "+code.ClientName, code.Scopes, time.Now().Add(deviceTokenLifetime()))
+	if err != nil {
+		return data, err
+	}
+	_, err = tx.Exec("delete from auth.device_codes where id = $1", code.ID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// pendingDeviceCode finds the pending login with userCode. Wrong codes count
+// against uID, so user codes can't be guessed from an account either.
+func pendingDeviceCode(tx *sqlx.Tx, uID string, userCode string) (models.DeviceCode, error) {
+	key := "device-user:" + uID
+	err := checkDeviceLimit(key)
+	if err != nil {
+		return models.DeviceCode{}, err
+	}
+	hash, err := HashToken(normalizeUserCode(userCode))
+	if err != nil {
+		return models.DeviceCode{}, err
+	}
+
+	var codes []models.DeviceCode
+	err = tx.Select(&codes, "select * from auth.device_codes where user_code_hash = $1 and status = $2 and expires_at > now() for update",
+		hash, deviceCodePending)
+	if err != nil {
+		return models.DeviceCode{}, err
+	}
+	if len(codes) != 1 {
+		if err = deviceLimit(key, int(envUint("DEVICE_USER_CODE_ATTEMPTS", 5, 16))); err != nil {
+			return models.DeviceCode{}, err
+		}
+		return models.DeviceCode{}, errors.New("Invalid user code!")
+	}
+	return codes[0], nil
+}
+
+// DeviceRequest shows uID what they are about to approve.
+func DeviceRequest(uID string, userCode string) (models.UDeviceRequest, error) {
+	db := DB
+	var err error
+	var data models.UDeviceRequest
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	code, err := pendingDeviceCode(tx, uID, userCode)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data = models.UDeviceRequest{
+		ClientName: code.ClientName,
+		Scopes:     code.Scopes,
+		ExpiresAt:  code.ExpiresAt,
+		CreatedAt:  code.CreatedAt,
+	}
+	return data, err
+}
+
+// DecideDeviceRequest approves or denies the pending login with userCode for
+// uID.
+func DecideDeviceRequest(uID string, userCode string, approve bool) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	code, err := pendingDeviceCode(tx, uID, userCode)
+	if err != nil {
+		return err
+	}
+	status := deviceCodeDenied
+	if approve {
+		status = deviceCodeApproved
+	}
+	_, err = tx.Exec("update auth.device_codes set status = $1, user_id = $2 where id = $3", status, uID, code.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// PruneDeviceCodes deletes device logins that expired without being picked
+// up.
+func PruneDeviceCodes() error {
+	db := DB
+	_, err := db.Exec("delete from auth.device_codes where expires_at <= now()")
+	return err
+}
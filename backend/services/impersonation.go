@@ -0,0 +1,231 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	impersonationStart   = "start"
+	impersonationStop    = "stop"
+	impersonationRequest = "request"
+)
+
+// ImpersonationLifetime is how long an impersonation session lasts. It
+// can't be extended by refreshing.
+func ImpersonationLifetime() time.Duration {
+	return envDuration("IMPERSONATION_LIFETIME", 30*time.Minute)
+}
+
+func recordImpersonationEvent(db sqlx.Execer, event models.ImpersonationEvent) error {
+	_, err := db.Exec(`INSERT INTO auth.impersonation_events (session_id, impersonator_id, user_id, action, method, path, status, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, nullif($8, '')::inet)`,
+		event.SessionID, event.ImpersonatorID, event.UserID, event.Action, event.Method, event.Path, event.Status, event.IP)
+	return err
+}
+
+// StartImpersonation opens a session of targetID for adminID, who needs
+// users:impersonate. Users holding it can't be impersonated themselves, so
+// the session never carries the right to impersonate further.
+func StartImpersonation(adminID string, targetID string, userAgent string, ip string) (models.USesssion, error) {
+	db := DB
+	var err error
+	var data models.USesssion
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersImpersonate)
+	if err != nil {
+		return data, err
+	}
+	if targetID == adminID {
+		err = errors.New("Can't change own account!")
+		return data, err
+	}
+	// Impersonating another impersonator would hand out their permissions.
+	targetImpersonator, err := userHasPermission(tx, targetID, PermissionUsersImpersonate)
+	if err != nil {
+		return data, err
+	}
+	if targetImpersonator {
+		err = errors.New("Impersonation not allowed!")
+		return data, err
+	}
+	err = checkUserActive(tx, targetID)
+	if err != nil {
+		return data, err
+	}
+
+	expiresAt := time.Now().Add(ImpersonationLifetime())
+	refreshToken, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	var ids []string
+	err = tx.Select(&ids, `INSERT INTO auth.sessions (user_id, token_prefix, token_hash, user_agent, ip, impersonator_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id;`, targetID, prefix, hash, userAgent, ip, adminID, expiresAt)
+	if err != nil {
+		return data, err
+	}
+
+	err = recordImpersonationEvent(tx, models.ImpersonationEvent{
+		SessionID:      ids[0],
+		ImpersonatorID: adminID,
+		UserID:         targetID,
+		Action:         impersonationStart,
+		IP:             &ip,
+	})
+	if err != nil {
+		return data, err
+	}
+
+	accessToken, accessExpiresAt, err := issueAccessToken(targetID, ids[0], adminID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data = models.USesssion{
+		SessionID:       ids[0],
+		AccessToken:     accessToken,
+		AccessExpiresAt: accessExpiresAt,
+		RefreshToken:    refreshToken,
+		ExpiresAt:       expiresAt,
+	}
+
+	return data, err
+}
+
+// StopImpersonation ends the impersonation session sessionID.
+func StopImpersonation(impersonatorID string, userID string, sessionID string, ip string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("delete from auth.sessions where id = $1 and user_id = $2 and impersonator_id = $3", sessionID, userID, impersonatorID)
+	if err != nil {
+		return err
+	}
+	denySessions(sessionID)
+	err = recordImpersonationEvent(tx, models.ImpersonationEvent{
+		SessionID:      sessionID,
+		ImpersonatorID: impersonatorID,
+		UserID:         userID,
+		Action:         impersonationStop,
+		IP:             &ip,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// RecordImpersonatedRequest logs a request made in an impersonation session
+// with both identities. Failures are logged, not returned, since the request
+// has already been handled.
+func RecordImpersonatedRequest(impersonatorID string, userID string, sessionID string, method string, path string, status int, ip string) {
+	err := recordImpersonationEvent(DB, models.ImpersonationEvent{
+		SessionID:      sessionID,
+		ImpersonatorID: impersonatorID,
+		UserID:         userID,
+		Action:         impersonationRequest,
+		Method:         method,
+		Path:           path,
+		Status:         &status,
+		IP:             &ip,
+	})
+	if err != nil {
+		log.Printf("Recording impersonated request failed: %v", err)
+	}
+}
+
+// Impersonations lists what was done in uID's account while impersonated,
+// newest first.
+func Impersonations(uID string, query models.RImpersonationEvents) ([]models.ImpersonationEvent, error) {
+	db := DB
+	var err error
+	data := []models.ImpersonationEvent{}
+
+	limit, offset := loginEventsPage(models.RLoginEvents{Limit: query.Limit, Offset: query.Offset})
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Select(&data, "select * from auth.impersonation_events where user_id = $1 order by created_at desc limit $2 offset $3",
+		uID, limit, offset)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
@@ -0,0 +1,516 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const insertInvitedUserString = "INSERT INTO auth.users (id, email, email_index, email_domain_index, password, firstname, lastname, organization, type, verified) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, true);"
+
+func invitationLifetime() time.Duration {
+	return envDuration("INVITATION_LIFETIME", 7*24*time.Hour)
+}
+
+// adminOrganization returns the organization adminID acts on: their own, or
+// requested if they hold organizations:all.
+func adminOrganization(tx *sqlx.Tx, adminID string, requested string) (models.Organization, error) {
+	orgID := requested
+	if requested != "" {
+		allOrganizations, err := userHasPermission(tx, adminID, PermissionOrganizationsAll)
+		if err != nil {
+			return models.Organization{}, err
+		}
+		if !allOrganizations {
+			return models.Organization{}, errors.New("Organization doesn't exist!")
+		}
+	} else {
+		var orgs []string
+		err := tx.Select(&orgs, "select coalesce(organization::text, '') from auth.users where id = $1", adminID)
+		if err != nil {
+			return models.Organization{}, err
+		}
+		if len(orgs) != 1 {
+			return models.Organization{}, errors.New("Organization doesn't exist!")
+		}
+		orgID = orgs[0]
+	}
+	return getOrganization(tx, orgID)
+}
+
+func sendInvitationEmail(email string, org models.Organization, token string) error {
+	link := FrontendURL() + "/invitation?token=" + url.QueryEscape(token)
+	return GetMailer().Send(Mail{
+		To:      email,
+		Subject: "You're invited to " + org.Name,
+		Body: "You have been invited to join " + org.Name + " on Zendoc. Open the link below to set up your account.\n\n" + link +
+			"\n\nThe invitation expires in " + invitationLifetime().String() + ".\n",
+	})
+}
+
+func CreateInvitation(adminID string, body models.RCreateInvitation) (models.UInvitation, error) {
+	db := DB
+	var err error
+	var data models.UInvitation
+
+	encEmail, err := encryptEmail(body.Email)
+	if err != nil {
+		return data, err
+	}
+	token, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := adminOrganization(tx, adminID, body.Organization)
+	if err != nil {
+		return data, err
+	}
+
+	var ids []string
+	err = tx.Select(&ids, "select id from auth.users where email_index = $1", encEmail.Index)
+	if err != nil {
+		return data, err
+	}
+	if len(ids) > 0 {
+		err = errors.New("User already exists!")
+		return data, err
+	}
+
+	roleNames := slices.Compact(slices.Sorted(slices.Values(body.Roles)))
+	if len(roleNames) == 0 {
+		roleNames = []string{defaultRoleName}
+	}
+	// Only admins of every organization hand out super_admin.
+	allOrganizations, err := userHasPermission(tx, adminID, PermissionOrganizationsAll)
+	if err != nil {
+		return data, err
+	}
+	var roleIDs []string
+	err = tx.Select(&roleIDs, "select id from auth.roles where name = any($1) and ($2 or name <> $3)",
+		pq.Array(roleNames), allOrganizations, superAdminRoleName)
+	if err != nil {
+		return data, err
+	}
+	if len(roleIDs) != len(roleNames) {
+		err = errors.New("Role doesn't exists!")
+		return data, err
+	}
+
+	// Inviting the same address again replaces the pending invitation.
+	_, err = tx.Exec("delete from auth.invitations where organization_id = $1 and email_index = $2 and accepted_at is null", org.ID, encEmail.Index)
+	if err != nil {
+		return data, err
+	}
+	err = tx.Get(&data, `INSERT INTO auth.invitations (organization_id, email, email_index, role_ids, invited_by, token_prefix, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4::uuid[], $5, $6, $7, $8)
+		RETURNING id, organization_id, invited_by, expires_at, created_at`,
+		org.ID, encEmail.Value, encEmail.Index, pq.Array(roleIDs), adminID, prefix, hash, time.Now().Add(invitationLifetime()))
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data.Email = body.Email
+	data.Roles = roleNames
+	if mailErr := sendInvitationEmail(body.Email, org, token); mailErr != nil {
+		log.Printf("Sending invitation mail failed: %v", mailErr)
+	}
+	return data, err
+}
+
+// Invitations lists the pending invitations of the admin's organization,
+// including expired ones.
+func Invitations(adminID string, query models.RInvitations) ([]models.UInvitation, error) {
+	db := DB
+	var err error
+	data := []models.UInvitation{}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := adminOrganization(tx, adminID, query.Organization)
+	if err != nil {
+		return data, err
+	}
+
+	err = tx.Select(&data, `select i.id, i.organization_id, i.email, i.invited_by, i.expires_at, i.created_at,
+		array(select r.name from auth.roles r where r.id = any(i.role_ids) order by r.name) as roles
+		from auth.invitations i where i.organization_id = $1 and i.accepted_at is null order by i.created_at`, org.ID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	for i := range data {
+		data[i].Email, err = Decrypt(data[i].Email)
+		if err != nil {
+			return data, err
+		}
+	}
+	return data, err
+}
+
+// ResendInvitation mails a new link for a pending invitation, which replaces
+// the old one and starts a new expiry period.
+func ResendInvitation(adminID string, invitationID string) error {
+	db := DB
+	var err error
+
+	if _, err = uuid.Parse(invitationID); err != nil {
+		err = errors.New("Invitation doesn't exist!")
+		return err
+	}
+	token, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := invitationOrganization(tx, adminID, invitationID)
+	if err != nil {
+		return err
+	}
+
+	var emails []string
+	err = tx.Select(&emails, `update auth.invitations set token_prefix = $1, token_hash = $2, expires_at = $3
+		where id = $4 and accepted_at is null returning email`,
+		prefix, hash, time.Now().Add(invitationLifetime()), invitationID)
+	if err != nil {
+		return err
+	}
+	if len(emails) != 1 {
+		err = errors.New("Invitation doesn't exist!")
+		return err
+	}
+	email, err := Decrypt(emails[0])
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	if mailErr := sendInvitationEmail(email, org, token); mailErr != nil {
+		log.Printf("Sending invitation mail failed: %v", mailErr)
+	}
+	return err
+}
+
+func RevokeInvitation(adminID string, invitationID string) error {
+	db := DB
+	var err error
+
+	if _, err = uuid.Parse(invitationID); err != nil {
+		err = errors.New("Invitation doesn't exist!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = invitationOrganization(tx, adminID, invitationID)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("delete from auth.invitations where id = $1 and accepted_at is null", invitationID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = errors.New("Invitation doesn't exist!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// invitationOrganization returns the organization of invitationID if adminID
+// may manage it.
+func invitationOrganization(tx *sqlx.Tx, adminID string, invitationID string) (models.Organization, error) {
+	var orgIDs []string
+	err := tx.Select(&orgIDs, "select organization_id from auth.invitations where id = $1", invitationID)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	if len(orgIDs) != 1 {
+		return models.Organization{}, errors.New("Invitation doesn't exist!")
+	}
+
+	allOrganizations, err := userHasPermission(tx, adminID, PermissionOrganizationsAll)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	if !allOrganizations {
+		var adminOrgs []string
+		err = tx.Select(&adminOrgs, "select coalesce(organization::text, '') from auth.users where id = $1", adminID)
+		if err != nil {
+			return models.Organization{}, err
+		}
+		if len(adminOrgs) != 1 || adminOrgs[0] != orgIDs[0] {
+			return models.Organization{}, errors.New("Invitation doesn't exist!")
+		}
+	}
+	return getOrganization(tx, orgIDs[0])
+}
+
+// pendingInvitation finds the open invitation token belongs to and locks it.
+func pendingInvitation(tx *sqlx.Tx, token string) (models.Invitation, error) {
+	var invitations []models.Invitation
+	err := tx.Select(&invitations, `select * from auth.invitations where token_prefix = $1
+		and accepted_at is null and expires_at > now() for update`, TokenPrefix(token))
+	if err != nil {
+		return models.Invitation{}, err
+	}
+	for _, invitation := range invitations {
+		if TokenMatches(token, invitation.TokenHash) {
+			return invitation, nil
+		}
+	}
+	return models.Invitation{}, errors.New("Invalid or expired invitation!")
+}
+
+// acceptInvitation gives userID the invited roles and closes the invitation.
+func acceptInvitation(tx *sqlx.Tx, invitation models.Invitation, userID string) error {
+	_, err := tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) SELECT $1, unnest($2::uuid[]);", userID, invitation.RoleIDs)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update auth.invitations set accepted_at = now() where id = $1", invitation.ID)
+	return err
+}
+
+// invitationForEmail returns the open invitation into orgID of the address
+// with emailIndex, so invitees signing in through SSO get their invited
+// roles.
+func invitationForEmail(tx *sqlx.Tx, orgID string, emailIndex string) (models.Invitation, bool, error) {
+	var invitations []models.Invitation
+	err := tx.Select(&invitations, `select * from auth.invitations where organization_id = $1 and email_index = $2
+		and accepted_at is null and expires_at > now() for update`, orgID, emailIndex)
+	if err != nil || len(invitations) == 0 {
+		return models.Invitation{}, false, err
+	}
+	return invitations[0], true, nil
+}
+
+// Invitation describes the invitation behind token so the frontend can
+// prefill the registration or send the invitee to their SSO login.
+func Invitation(token string) (models.UInvitationDetails, error) {
+	db := DB
+	var err error
+	var data models.UInvitationDetails
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	invitation, err := pendingInvitation(tx, token)
+	if err != nil {
+		return data, err
+	}
+	org, err := getOrganization(tx, invitation.OrganizationID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data.Email, err = Decrypt(invitation.Email)
+	if err != nil {
+		return data, err
+	}
+	data.OrganizationID = org.ID
+	data.OrganizationName = org.Name
+	if org.SSO {
+		data.SSOProvider = org.SSOProvider
+	}
+	data.ExpiresAt = invitation.ExpiresAt
+	return data, err
+}
+
+// AcceptInvitation creates the invited user with their roles in one
+// transaction. Following the link verifies the address.
+func AcceptInvitation(body models.RAcceptInvitation) error {
+	db := DB
+	var err error
+
+	err = validatePassword(body.Password)
+	if err != nil {
+		return err
+	}
+	hashPassword, err := HashPassword(body.Password)
+	if err != nil {
+		err = errors.New("Hashing password failed!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	invitation, err := pendingInvitation(tx, body.Token)
+	if err != nil {
+		return err
+	}
+
+	email, err := Decrypt(invitation.Email)
+	if err != nil {
+		return err
+	}
+	encEmail, err := encryptEmail(email)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	err = tx.Select(&ids, "select id from auth.users where email_index = $1", encEmail.Index)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		err = errors.New("User already exists!")
+		return err
+	}
+
+	userID := uuid.New().String()
+	_, err = tx.Exec(insertInvitedUserString, userID, encEmail.Value, encEmail.Index, encEmail.DomainIndex, hashPassword, body.Firstname, body.Lastname, invitation.OrganizationID, organizationUserType)
+	if err != nil {
+		return err
+	}
+	err = acceptInvitation(tx, invitation, userID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
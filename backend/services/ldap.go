@@ -0,0 +1,225 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const defaultLDAPUserFilter = "(|(mail=%s)(userPrincipalName=%s))"
+const ldapTimeout = 10 * time.Second
+
+type ldapUser struct {
+	DN        string
+	FirstName string
+	LastName  string
+	Groups    []string
+}
+
+// ldapOrganizationForEmail returns the LDAP-enabled organization owning the
+// domain of email, if there is one. It refuses to pick a directory when other
+// organizations claim the domain too.
+func ldapOrganizationForEmail(email string) (models.Organization, bool, error) {
+	db := DB
+	var err error
+	var data models.Organization
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, false, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var orgs []models.Organization
+	err = tx.Select(&orgs, "select "+organizationColumns+" from auth.organizations")
+	if err != nil {
+		return data, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, false, err
+	}
+
+	owners := organizationsOwningEmail(orgs, email)
+	for _, org := range owners {
+		if !org.LDAPEnabled {
+			continue
+		}
+		if len(owners) > 1 {
+			err = errAmbiguousDomain(owners, email)
+			return data, false, err
+		}
+		return org, true, err
+	}
+	return data, false, err
+}
+
+func dialLDAP(org models.Organization) (*ldap.Conn, error) {
+	if org.LDAPServer == "" || org.LDAPSearchBase == "" {
+		return nil, errors.New("LDAP not configured!")
+	}
+
+	conn, err := ldap.DialURL(org.LDAPServer, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if org.LDAPStartTLS {
+		server, err := url.Parse(org.LDAPServer)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = conn.StartTLS(&tls.Config{ServerName: server.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindLDAPService binds with the organization's service account, or stays
+// anonymous when none is configured.
+func bindLDAPService(conn *ldap.Conn, org models.Organization) error {
+	if org.LDAPBindDN == "" {
+		return nil
+	}
+	password, err := Decrypt(org.LDAPBindPassword)
+	if err != nil {
+		return errors.New("Decryption failed!")
+	}
+	return conn.Bind(org.LDAPBindDN, password)
+}
+
+// ldapAuthenticate looks the user up with the service account and then binds
+// as them to check the password.
+func ldapAuthenticate(org models.Organization, email string, password string) (ldapUser, error) {
+	var data ldapUser
+
+	// An empty password would turn the bind into an unauthenticated one,
+	// which many directories accept for any DN.
+	if password == "" {
+		return data, errors.New("User doesn't exist!")
+	}
+
+	conn, err := dialLDAP(org)
+	if err != nil {
+		return data, err
+	}
+	defer conn.Close()
+
+	if err = bindLDAPService(conn, org); err != nil {
+		return data, err
+	}
+
+	filter := org.LDAPUserFilter
+	if filter == "" {
+		filter = defaultLDAPUserFilter
+	}
+	filter = strings.ReplaceAll(filter, "%s", ldap.EscapeFilter(email))
+
+	result, err := conn.Search(ldap.NewSearchRequest(org.LDAPSearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		filter, []string{"givenName", "sn", "memberOf"}, nil))
+	if err != nil {
+		return data, err
+	}
+	if len(result.Entries) != 1 {
+		return data, errors.New("User doesn't exist!")
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return data, errors.New("User doesn't exist!")
+	}
+	if err != nil {
+		return data, err
+	}
+
+	data.DN = entry.DN
+	data.FirstName = entry.GetAttributeValue("givenName")
+	data.LastName = entry.GetAttributeValue("sn")
+	data.Groups = entry.GetAttributeValues("memberOf")
+
+	// Directories without the memberOf overlay only record membership on
+	// the group entries.
+	if err = bindLDAPService(conn, org); err != nil {
+		return data, err
+	}
+	escapedDN := ldap.EscapeFilter(entry.DN)
+	groups, err := conn.Search(ldap.NewSearchRequest(org.LDAPSearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		"(|(member="+escapedDN+")(uniqueMember="+escapedDN+"))", []string{"dn"}, nil))
+	if err != nil {
+		return data, err
+	}
+	for _, group := range groups.Entries {
+		data.Groups = append(data.Groups, group.DN)
+	}
+
+	return data, nil
+}
+
+// syncLDAPRoles makes the roles mapped in auth.ldap_group_roles match the
+// user's current group membership. Roles that no group of the organization
+// maps to are left alone.
+func syncLDAPRoles(tx *sqlx.Tx, orgID string, userID string, groups []string) error {
+	var mappings []models.LDAPGroupRole
+	err := tx.Select(&mappings, "select * from auth.ldap_group_roles where organization = $1", orgID)
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	memberOf := map[string]bool{}
+	for _, group := range groups {
+		memberOf[strings.ToLower(group)] = true
+	}
+
+	managed := []string{}
+	granted := []string{}
+	for _, mapping := range mappings {
+		managed = append(managed, mapping.RoleID)
+		if memberOf[strings.ToLower(mapping.GroupDN)] {
+			granted = append(granted, mapping.RoleID)
+		}
+	}
+
+	_, err = tx.Exec("delete from auth.user_roles where user_id = $1 and role_id = any($2::uuid[]) and not role_id = any($3::uuid[])", userID, pq.Array(managed), pq.Array(granted))
+	if err != nil {
+		return err
+	}
+	for _, roleID := range granted {
+		_, err = tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;", userID, roleID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+package services
+
+import (
+	"backend/models"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testLDAPServer is an in-process directory answering simple binds and
+// searches with equality, presence, and, or and not filters, which is all
+// the LDAP login uses.
+type testLDAPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	// entries maps lowercased DNs to their attributes.
+	entries   map[string]map[string][]string
+	passwords map[string]string
+	binds     []string
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	s := &testLDAPServer{
+		listener:  listener,
+		entries:   map[string]map[string][]string{},
+		passwords: map[string]string{},
+	}
+	s.add("cn=readonly,dc=zendoc,dc=test", "readonly", map[string][]string{"cn": {"readonly"}})
+	s.add("uid=alice,ou=people,dc=zendoc,dc=test", "alice", map[string][]string{
+		"uid":       {"alice"},
+		"mail":      {"alice@zendoc.test"},
+		"givenName": {"Alice"},
+		"sn":        {"Liddell"},
+		"memberOf":  {"cn=admins,ou=groups,dc=zendoc,dc=test"},
+	})
+	s.add("uid=bob,ou=people,dc=zendoc,dc=test", "bob", map[string][]string{
+		"uid":       {"bob"},
+		"mail":      {"bob@zendoc.test"},
+		"givenName": {"Bob"},
+		"sn":        {"Builder"},
+	})
+	s.add("cn=admins,ou=groups,dc=zendoc,dc=test", "", map[string][]string{
+		"cn":     {"admins"},
+		"member": {"uid=alice,ou=people,dc=zendoc,dc=test"},
+	})
+	s.add("cn=readers,ou=groups,dc=zendoc,dc=test", "", map[string][]string{
+		"cn":           {"readers"},
+		"uniqueMember": {"uid=bob,ou=people,dc=zendoc,dc=test"},
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *testLDAPServer) add(dn string, password string, attributes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[strings.ToLower(dn)] = attributes
+	if password != "" {
+		s.passwords[strings.ToLower(dn)] = password
+	}
+}
+
+func (s *testLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// bindDNs returns the DNs of all binds so far, successful or not.
+func (s *testLDAPServer) bindDNs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.binds)
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := request.Children[1].Value.(string)
+			code := s.bind(dn, request.Children[2].Data.String())
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			for _, entry := range s.search(request) {
+				conn.Write(entry.withMessageID(messageID).Bytes())
+			}
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform).Bytes())
+		}
+	}
+}
+
+func (s *testLDAPServer) bind(dn string, password string) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.binds = append(s.binds, dn)
+	expected, ok := s.passwords[strings.ToLower(dn)]
+	if !ok || password == "" || password != expected {
+		return ldap.LDAPResultInvalidCredentials
+	}
+	return ldap.LDAPResultSuccess
+}
+
+type testLDAPEntry struct {
+	op *ber.Packet
+}
+
+func (e testLDAPEntry) withMessageID(messageID int64) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	envelope.AppendChild(e.op)
+	return envelope
+}
+
+func (s *testLDAPServer) search(request *ber.Packet) []testLDAPEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base := strings.ToLower(request.Children[0].Value.(string))
+	filter := request.Children[6]
+	var wanted []string
+	for _, attribute := range request.Children[7].Children {
+		wanted = append(wanted, strings.ToLower(attribute.Value.(string)))
+	}
+
+	var dns []string
+	for dn := range s.entries {
+		if (dn == base || strings.HasSuffix(dn, ","+base)) && testLDAPMatches(s.entries[dn], filter) {
+			dns = append(dns, dn)
+		}
+	}
+	slices.Sort(dns)
+
+	var results []testLDAPEntry
+	for _, dn := range dns {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range s.entries[dn] {
+			if !slices.Contains(wanted, strings.ToLower(name)) {
+				continue
+			}
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Name"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		op.AppendChild(attributes)
+		results = append(results, testLDAPEntry{op: op})
+	}
+	return results
+}
+
+func testLDAPMatches(entry map[string][]string, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !testLDAPMatches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if testLDAPMatches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !testLDAPMatches(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		for _, value := range testLDAPAttribute(entry, filter.Children[0].Value.(string)) {
+			if strings.EqualFold(value, filter.Children[1].Value.(string)) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(testLDAPAttribute(entry, filter.Data.String())) > 0
+	default:
+		return false
+	}
+}
+
+// testLDAPAttribute looks attribute names up case-insensitively, like a
+// directory does.
+func testLDAPAttribute(entry map[string][]string, name string) []string {
+	for attribute, values := range entry {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func testLDAPResponse(messageID int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return testLDAPEntry{op: op}.withMessageID(messageID)
+}
+
+func testLDAPOrganization(t *testing.T, s *testLDAPServer) models.Organization {
+	t.Helper()
+
+	bindPassword, err := Encrypt("readonly")
+	if err != nil {
+		t.Fatalf("encrypting bind password: %v", err)
+	}
+	return models.Organization{
+		Domain:           "zendoc.test",
+		LDAPEnabled:      true,
+		LDAPServer:       s.url(),
+		LDAPBindDN:       "cn=readonly,dc=zendoc,dc=test",
+		LDAPBindPassword: bindPassword,
+		LDAPSearchBase:   "dc=zendoc,dc=test",
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newTestLDAPServer(t)
+	org := testLDAPOrganization(t, s)
+
+	user, err := ldapAuthenticate(org, "alice@zendoc.test", "alice")
+	if err != nil {
+		t.Fatalf("ldapAuthenticate: %v", err)
+	}
+	if user.DN != "uid=alice,ou=people,dc=zendoc,dc=test" || user.FirstName != "Alice" || user.LastName != "Liddell" {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	// The admins group shows up once through memberOf and once through its
+	// member attribute.
+	if len(user.Groups) != 2 || user.Groups[0] != "cn=admins,ou=groups,dc=zendoc,dc=test" || user.Groups[1] != user.Groups[0] {
+		t.Fatalf("unexpected groups %v", user.Groups)
+	}
+	binds := s.bindDNs()
+	if len(binds) != 3 || binds[0] != org.LDAPBindDN || binds[1] != user.DN || binds[2] != org.LDAPBindDN {
+		t.Fatalf("unexpected binds %v", binds)
+	}
+
+	user, err = ldapAuthenticate(org, "bob@zendoc.test", "bob")
+	if err != nil {
+		t.Fatalf("ldapAuthenticate: %v", err)
+	}
+	if len(user.Groups) != 1 || user.Groups[0] != "cn=readers,ou=groups,dc=zendoc,dc=test" {
+		t.Fatalf("groups through uniqueMember: got %v", user.Groups)
+	}
+
+	org.LDAPUserFilter = "(&(uid=alice)(mail=%s))"
+	if _, err = ldapAuthenticate(org, "bob@zendoc.test", "bob"); err == nil || err.Error() != "User doesn't exist!" {
+		t.Fatalf("custom filter: got error %v", err)
+	}
+	org.LDAPUserFilter = "(&(uid=bob)(mail=%s))"
+	if _, err = ldapAuthenticate(org, "bob@zendoc.test", "bob"); err != nil {
+		t.Fatalf("custom filter: %v", err)
+	}
+}
+
+func TestLDAPAuthenticateFailures(t *testing.T) {
+	s := newTestLDAPServer(t)
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		change   func(org *models.Organization)
+		err      string
+		binds    int
+	}{
+		{name: "wrong password", email: "alice@zendoc.test", password: "bob", err: "User doesn't exist!", binds: 2},
+		{name: "unknown user", email: "carol@zendoc.test", password: "carol", err: "User doesn't exist!", binds: 1},
+		{name: "empty password", email: "alice@zendoc.test", password: "", err: "User doesn't exist!", binds: 0},
+		{name: "wildcard in email", email: "*@zendoc.test", password: "alice", err: "User doesn't exist!", binds: 1},
+		{
+			name:     "wrong service password",
+			email:    "alice@zendoc.test",
+			password: "alice",
+			change: func(org *models.Organization) {
+				org.LDAPBindPassword, _ = Encrypt("wrong")
+			},
+			binds: 1,
+		},
+		{
+			name:     "unreachable server",
+			email:    "alice@zendoc.test",
+			password: "alice",
+			change: func(org *models.Organization) {
+				org.LDAPServer = "ldap://127.0.0.1:1"
+			},
+			binds: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			org := testLDAPOrganization(t, s)
+			if test.change != nil {
+				test.change(&org)
+			}
+			before := len(s.bindDNs())
+
+			_, err := ldapAuthenticate(org, test.email, test.password)
+			if err == nil {
+				t.Fatal("authenticated")
+			}
+			if test.err != "" && err.Error() != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			// Directory errors mustn't look like wrong credentials.
+			if test.err == "" && err.Error() == "User doesn't exist!" {
+				t.Fatalf("got error %v", err)
+			}
+			if binds := len(s.bindDNs()) - before; binds != test.binds {
+				t.Fatalf("got %d binds, want %d", binds, test.binds)
+			}
+		})
+	}
+}
+
+func TestSyncLDAPRoles(t *testing.T) {
+	requireDB(t)
+
+	domain := testDomain()
+	orgID := createTestOrganization(t, map[string]any{"domain": domain})
+	userID := createTestUser(t, orgID, "sync@"+domain, defaultRoleName, readOnlyRoleName)
+
+	for group, role := range map[string]string{
+		"cn=admins,ou=groups,dc=zendoc,dc=test":  adminRoleName,
+		"cn=readers,ou=groups,dc=zendoc,dc=test": readOnlyRoleName,
+	} {
+		_, err := DB.Exec("INSERT INTO auth.ldap_group_roles (organization, group_dn, role_id) SELECT $1, $2, id FROM auth.roles WHERE name = $3;", orgID, group, role)
+		if err != nil {
+			t.Fatalf("mapping group: %v", err)
+		}
+	}
+
+	syncRoles := func(groups ...string) []string {
+		tx, err := DB.Beginx()
+		if err != nil {
+			t.Fatalf("beginning transaction: %v", err)
+		}
+		if err = syncLDAPRoles(tx, orgID, userID, groups); err != nil {
+			tx.Rollback()
+			t.Fatalf("syncLDAPRoles: %v", err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatalf("committing: %v", err)
+		}
+		return testUserRoles(t, userID)
+	}
+
+	// Group DNs compare case-insensitively and unmapped roles stay.
+	roles := syncRoles("CN=Admins,OU=Groups,DC=zendoc,DC=test", "cn=unmapped,dc=zendoc,dc=test")
+	if !slices.Equal(roles, []string{adminRoleName, defaultRoleName}) {
+		t.Fatalf("after joining admins: %v", roles)
+	}
+	roles = syncRoles("cn=readers,ou=groups,dc=zendoc,dc=test")
+	if !slices.Equal(roles, []string{readOnlyRoleName, defaultRoleName}) {
+		t.Fatalf("after moving to readers: %v", roles)
+	}
+	roles = syncRoles()
+	if !slices.Equal(roles, []string{defaultRoleName}) {
+		t.Fatalf("after leaving all groups: %v", roles)
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	requireDB(t)
+
+	s := newTestLDAPServer(t)
+	domain := testDomain()
+	for _, entry := range s.entries {
+		for i, mail := range entry["mail"] {
+			entry["mail"][i] = strings.Replace(mail, "@zendoc.test", "@"+domain, 1)
+		}
+	}
+	org := testLDAPOrganization(t, s)
+	orgID := createTestOrganization(t, map[string]any{
+		"domain":             domain,
+		"ldap":               true,
+		"ldap_server":        org.LDAPServer,
+		"ldap_bind_dn":       org.LDAPBindDN,
+		"ldap_bind_password": org.LDAPBindPassword,
+		"ldap_search_base":   org.LDAPSearchBase,
+	})
+	_, err := DB.Exec("INSERT INTO auth.ldap_group_roles (organization, group_dn, role_id) SELECT $1, $2, id FROM auth.roles WHERE name = $3;",
+		orgID, "cn=admins,ou=groups,dc=zendoc,dc=test", adminRoleName)
+	if err != nil {
+		t.Fatalf("mapping group: %v", err)
+	}
+
+	login := func(password string) (string, error) {
+		data, err := LoginPasswordUser(models.RUserLoginPassword{Email: "alice@" + domain, Password: password}, "test", "127.0.0.1")
+		if err != nil {
+			return "", err
+		}
+		if data.Session == nil {
+			return "", errors.New("no session issued")
+		}
+		var userIDs []string
+		if err = DB.Select(&userIDs, "select user_id from auth.sessions where id = $1", data.Session.SessionID); err != nil || len(userIDs) != 1 {
+			t.Fatalf("loading session: %v", err)
+		}
+		return userIDs[0], nil
+	}
+
+	if _, err = login("wrong"); err == nil || err.Error() != "User doesn't exist!" {
+		t.Fatalf("wrong password: got error %v", err)
+	}
+
+	userID, err := login("alice")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if roles := testUserRoles(t, userID); !slices.Equal(roles, []string{adminRoleName, defaultRoleName}) {
+		t.Fatalf("provisioned with roles %v", roles)
+	}
+
+	// Leaving the group in the directory takes the role away on the next login.
+	s.mu.Lock()
+	delete(s.entries["uid=alice,ou=people,dc=zendoc,dc=test"], "memberOf")
+	s.entries["cn=admins,ou=groups,dc=zendoc,dc=test"]["member"] = nil
+	s.mu.Unlock()
+
+	again, err := login("alice")
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again != userID {
+		t.Fatalf("second login created user %v", again)
+	}
+	if roles := testUserRoles(t, userID); !slices.Equal(roles, []string{defaultRoleName}) {
+		t.Fatalf("roles after leaving the group: %v", roles)
+	}
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimiterEntry is the failure record of one account or source IP.
+type LimiterEntry struct {
+	Failures    int       `db:"failures"`
+	LastFailure time.Time `db:"last_failure_at"`
+	LockedUntil time.Time `db:"locked_until"`
+}
+
+// LimiterStore keeps failure counters. Backends shared by all instances make
+// the limits hold behind a load balancer.
+type LimiterStore interface {
+	Get(key string) (LimiterEntry, error)
+	// Fail counts a failure for key, starting over if the previous one is
+	// older than window, and locks the key for lockFor(failures).
+	Fail(key string, window time.Duration, lockFor func(failures int) time.Duration) (LimiterEntry, error)
+	Reset(key string) error
+	// Prune forgets keys that are unlocked and failed last before window.
+	Prune(window time.Duration) error
+}
+
+// ThrottledError is returned while an account or IP is locked.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return "Too many attempts!"
+}
+
+type loginPolicy struct {
+	BackoffAfter     int
+	LockoutThreshold int
+}
+
+func accountPolicy() loginPolicy {
+	return loginPolicy{
+		BackoffAfter:     int(envUint("LOGIN_BACKOFF_AFTER", 3, 16)),
+		LockoutThreshold: int(envUint("LOGIN_LOCKOUT_THRESHOLD", 10, 16)),
+	}
+}
+
+func ipPolicy() loginPolicy {
+	return loginPolicy{
+		BackoffAfter:     int(envUint("LOGIN_IP_BACKOFF_AFTER", 20, 16)),
+		LockoutThreshold: int(envUint("LOGIN_IP_LOCKOUT_THRESHOLD", 100, 16)),
+	}
+}
+
+func loginFailureWindow() time.Duration {
+	return envDuration("LOGIN_FAILURE_WINDOW", time.Hour)
+}
+
+// lockFor doubles the delay with every failure past BackoffAfter, starting at
+// LOGIN_BACKOFF_BASE, and locks for LOGIN_LOCKOUT_DURATION from
+// LockoutThreshold on.
+func (p loginPolicy) lockFor(failures int) time.Duration {
+	lockout := envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	if failures >= p.LockoutThreshold {
+		return lockout
+	}
+	if failures < p.BackoffAfter {
+		return 0
+	}
+	delay := envDuration("LOGIN_BACKOFF_BASE", time.Second)
+	for i := p.BackoffAfter; i < failures && delay < lockout; i++ {
+		delay *= 2
+	}
+	return min(delay, lockout)
+}
+
+type MemoryLimiterStore struct {
+	mu      sync.Mutex
+	entries map[string]LimiterEntry
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{entries: map[string]LimiterEntry{}}
+}
+
+func (s *MemoryLimiterStore) Get(key string) (LimiterEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries[key], nil
+}
+
+func (s *MemoryLimiterStore) Fail(key string, window time.Duration, lockFor func(failures int) time.Duration) (LimiterEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry := s.entries[key]
+	if entry.LastFailure.Before(now.Add(-window)) {
+		entry.Failures = 0
+	}
+	entry.Failures++
+	entry.LastFailure = now
+	if until := now.Add(lockFor(entry.Failures)); until.After(entry.LockedUntil) {
+		entry.LockedUntil = until
+	}
+	s.entries[key] = entry
+	return entry, nil
+}
+
+func (s *MemoryLimiterStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryLimiterStore) Prune(window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, entry := range s.entries {
+		if entry.LastFailure.Before(now.Add(-window)) && entry.LockedUntil.Before(now) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// PostgresLimiterStore keeps the counters in auth.login_throttles.
+type PostgresLimiterStore struct{}
+
+func (PostgresLimiterStore) Get(key string) (LimiterEntry, error) {
+	db := DB
+	var entries []LimiterEntry
+	err := db.Select(&entries, "select failures, last_failure_at, locked_until from auth.login_throttles where key = $1", key)
+	if err != nil || len(entries) == 0 {
+		return LimiterEntry{}, err
+	}
+	return entries[0], nil
+}
+
+func (PostgresLimiterStore) Fail(key string, window time.Duration, lockFor func(failures int) time.Duration) (LimiterEntry, error) {
+	db := DB
+	var err error
+	var data LimiterEntry
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// The upsert takes a row lock, so concurrent failures are all counted.
+	err = tx.Get(&data, `INSERT INTO auth.login_throttles (key, failures, last_failure_at) VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN auth.login_throttles.last_failure_at < now() - $2 * interval '1 second' THEN 1 ELSE auth.login_throttles.failures + 1 END,
+			last_failure_at = now()
+		RETURNING failures, last_failure_at, locked_until`, key, int64(window.Seconds()))
+	if err != nil {
+		return data, err
+	}
+
+	if until := time.Now().Add(lockFor(data.Failures)); until.After(data.LockedUntil) {
+		data.LockedUntil = until
+		_, err = tx.Exec("update auth.login_throttles set locked_until = $1 where key = $2", until, key)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func (PostgresLimiterStore) Reset(key string) error {
+	db := DB
+	_, err := db.Exec("delete from auth.login_throttles where key = $1", key)
+	return err
+}
+
+func (PostgresLimiterStore) Prune(window time.Duration) error {
+	db := DB
+	_, err := db.Exec("delete from auth.login_throttles where last_failure_at < now() - $1 * interval '1 second' and locked_until < now()", int64(window.Seconds()))
+	return err
+}
+
+var limiterStore LimiterStore
+var limiterStoreOnce sync.Once
+
+// GetLimiterStore returns the store selected by LIMITER_STORE.
+func GetLimiterStore() LimiterStore {
+	limiterStoreOnce.Do(func() {
+		switch GetEnvDefault("LIMITER_STORE", "postgres") {
+		case "memory":
+			limiterStore = NewMemoryLimiterStore()
+		default:
+			limiterStore = PostgresLimiterStore{}
+		}
+	})
+	return limiterStore
+}
+
+// accountThrottleKey identifies an account by the blind index of the address
+// that was typed, so unknown addresses are throttled like real ones.
+func accountThrottleKey(email string) (string, error) {
+	index, err := EmailIndex(email)
+	return accountIndexThrottleKey(index), err
+}
+
+func accountIndexThrottleKey(emailIndex string) string {
+	return "account:" + emailIndex
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginThrottle fails with a ThrottledError while the account or the
+// source IP is locked.
+func checkLoginThrottle(email string, ip string) error {
+	accountKey, err := accountThrottleKey(email)
+	if err != nil {
+		return err
+	}
+	var retryAfter time.Duration
+	for _, key := range []string{accountKey, ipThrottleKey(ip)} {
+		entry, err := GetLimiterStore().Get(key)
+		if err != nil {
+			return err
+		}
+		retryAfter = max(retryAfter, time.Until(entry.LockedUntil))
+	}
+	if retryAfter > 0 {
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// recordLoginFailure counts err against the account and the source IP if it
+// is a wrong password.
+func recordLoginFailure(email string, ip string, err error) {
+	if err == nil || err.Error() != "User doesn't exist!" {
+		return
+	}
+	accountKey, keyErr := accountThrottleKey(email)
+	if keyErr != nil {
+		log.Printf("Recording login failure failed: %v", keyErr)
+		return
+	}
+	if _, storeErr := GetLimiterStore().Fail(accountKey, loginFailureWindow(), accountPolicy().lockFor); storeErr != nil {
+		log.Printf("Recording login failure failed: %v", storeErr)
+	}
+	if _, storeErr := GetLimiterStore().Fail(ipThrottleKey(ip), loginFailureWindow(), ipPolicy().lockFor); storeErr != nil {
+		log.Printf("Recording login failure failed: %v", storeErr)
+	}
+}
+
+func resetLoginThrottle(email string) {
+	accountKey, err := accountThrottleKey(email)
+	if err == nil {
+		err = GetLimiterStore().Reset(accountKey)
+	}
+	if err != nil {
+		log.Printf("Resetting login throttle failed: %v", err)
+	}
+}
+
+// resetAccountThrottle is resetLoginThrottle for the account with the email
+// index emailIndex.
+func resetAccountThrottle(emailIndex string) {
+	if err := GetLimiterStore().Reset(accountIndexThrottleKey(emailIndex)); err != nil {
+		log.Printf("Resetting login throttle failed: %v", err)
+	}
+}
+
+// UnlockUser lifts the lockout of targetID's account.
+func UnlockUser(adminID string, targetID string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+
+	var emails []string
+	err = tx.Select(&emails, "select email from auth.users where id = $1", targetID)
+	if err != nil {
+		return err
+	}
+	if len(emails) != 1 {
+		err = errors.New("User doesn't exist!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	email, err := Decrypt(emails[0])
+	if err != nil {
+		return err
+	}
+	accountKey, err := accountThrottleKey(email)
+	if err != nil {
+		return err
+	}
+	return GetLimiterStore().Reset(accountKey)
+}
+
+// RetryAfterSeconds formats the wait of a ThrottledError for a Retry-After
+// header.
+func RetryAfterSeconds(err error) string {
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		return ""
+	}
+	return strconv.FormatInt(int64(throttled.RetryAfter.Seconds())+1, 10)
+}
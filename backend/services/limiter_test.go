@@ -0,0 +1,150 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginPolicyLockFor(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF_BASE", "1s")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "15m")
+
+	tests := []struct {
+		name     string
+		policy   loginPolicy
+		failures int
+		want     time.Duration
+	}{
+		{"first failure", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 1, 0},
+		{"below backoff", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 2, 0},
+		{"at backoff", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 3, time.Second},
+		{"doubles", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 4, 2 * time.Second},
+		{"doubles again", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 6, 8 * time.Second},
+		{"below threshold", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 9, 64 * time.Second},
+		{"at threshold", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 10, 15 * time.Minute},
+		{"past threshold", loginPolicy{BackoffAfter: 3, LockoutThreshold: 10}, 50, 15 * time.Minute},
+		{"capped at lockout", loginPolicy{BackoffAfter: 3, LockoutThreshold: 100}, 20, 15 * time.Minute},
+		{"capped without overflow", loginPolicy{BackoffAfter: 1, LockoutThreshold: 1 << 15}, 1000, 15 * time.Minute},
+		{"threshold before backoff", loginPolicy{BackoffAfter: 20, LockoutThreshold: 5}, 5, 15 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := test.policy.lockFor(test.failures); got != test.want {
+			t.Errorf("%v: lockFor(%d) = %v, want %v", test.name, test.failures, got, test.want)
+		}
+	}
+
+	t.Setenv("LOGIN_BACKOFF_BASE", "2s")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "5s")
+	policy := loginPolicy{BackoffAfter: 1, LockoutThreshold: 10}
+	for failures, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 5 * time.Second, 10: 5 * time.Second} {
+		if got := policy.lockFor(failures); got != want {
+			t.Errorf("lockFor(%d) with a 2s base and 5s lockout = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestMemoryLimiterStore(t *testing.T) {
+	store := NewMemoryLimiterStore()
+	policy := loginPolicy{BackoffAfter: 2, LockoutThreshold: 4}
+	t.Setenv("LOGIN_BACKOFF_BASE", "1s")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "1m")
+
+	entry, err := store.Get("account:a")
+	if err != nil || entry != (LimiterEntry{}) {
+		t.Fatalf("Get(unknown key) = %+v, %v, want an empty entry", entry, err)
+	}
+
+	start := time.Now()
+	entry, _ = store.Fail("account:a", time.Hour, policy.lockFor)
+	if entry.Failures != 1 || entry.LastFailure.Before(start) || entry.LockedUntil.After(time.Now()) {
+		t.Errorf("first Fail = %+v, want one failure without a lock", entry)
+	}
+	entry, _ = store.Fail("account:a", time.Hour, policy.lockFor)
+	if entry.Failures != 2 || entry.LockedUntil.Before(start.Add(time.Second)) {
+		t.Errorf("second Fail = %+v, want two failures and a one second lock", entry)
+	}
+	store.Fail("account:a", time.Hour, policy.lockFor)
+	entry, _ = store.Fail("account:a", time.Hour, policy.lockFor)
+	if entry.Failures != 4 || entry.LockedUntil.Before(start.Add(time.Minute)) {
+		t.Errorf("fourth Fail = %+v, want four failures and a lockout", entry)
+	}
+	if got, _ := store.Get("account:a"); got != entry {
+		t.Errorf("Get = %+v, want the entry of the last Fail %+v", got, entry)
+	}
+	if got, _ := store.Get("ip:192.0.2.1"); got != (LimiterEntry{}) {
+		t.Errorf("Get(other key) = %+v, want an empty entry", got)
+	}
+
+	if err := store.Reset("account:a"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if got, _ := store.Get("account:a"); got != (LimiterEntry{}) {
+		t.Errorf("Get after Reset = %+v, want an empty entry", got)
+	}
+	if err := store.Reset("account:a"); err != nil {
+		t.Errorf("Reset(unknown key): %v", err)
+	}
+}
+
+func TestMemoryLimiterStoreWindow(t *testing.T) {
+	store := NewMemoryLimiterStore()
+	policy := loginPolicy{BackoffAfter: 2, LockoutThreshold: 4}
+
+	// A failure older than the window starts the count over, but a lock
+	// that is still running isn't shortened.
+	lockedUntil := time.Now().Add(time.Hour)
+	store.entries["account:a"] = LimiterEntry{Failures: 3, LastFailure: time.Now().Add(-2 * time.Hour), LockedUntil: lockedUntil}
+	entry, _ := store.Fail("account:a", time.Hour, policy.lockFor)
+	if entry.Failures != 1 {
+		t.Errorf("Fail after the window = %d failures, want 1", entry.Failures)
+	}
+	if !entry.LockedUntil.Equal(lockedUntil) {
+		t.Errorf("Fail after the window locked until %v, want the running lock until %v", entry.LockedUntil, lockedUntil)
+	}
+
+	store.entries["account:b"] = LimiterEntry{Failures: 3, LastFailure: time.Now().Add(-30 * time.Minute)}
+	entry, _ = store.Fail("account:b", time.Hour, policy.lockFor)
+	if entry.Failures != 4 {
+		t.Errorf("Fail within the window = %d failures, want 4", entry.Failures)
+	}
+}
+
+func TestMemoryLimiterStorePrune(t *testing.T) {
+	store := NewMemoryLimiterStore()
+	now := time.Now()
+	store.entries = map[string]LimiterEntry{
+		"stale":         {Failures: 2, LastFailure: now.Add(-2 * time.Hour)},
+		"stale expired": {Failures: 9, LastFailure: now.Add(-2 * time.Hour), LockedUntil: now.Add(-time.Hour)},
+		"stale locked":  {Failures: 9, LastFailure: now.Add(-2 * time.Hour), LockedUntil: now.Add(time.Hour)},
+		"recent":        {Failures: 1, LastFailure: now.Add(-time.Minute)},
+		"recent locked": {Failures: 5, LastFailure: now.Add(-time.Minute), LockedUntil: now.Add(time.Minute)},
+	}
+
+	if err := store.Prune(time.Hour); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	for key, kept := range map[string]bool{"stale": false, "stale expired": false, "stale locked": true, "recent": true, "recent locked": true} {
+		if _, ok := store.entries[key]; ok != kept {
+			t.Errorf("after Prune %q kept = %v, want %v", key, ok, kept)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&ThrottledError{RetryAfter: 0}, "1"},
+		{&ThrottledError{RetryAfter: 1500 * time.Millisecond}, "2"},
+		{&ThrottledError{RetryAfter: 15 * time.Minute}, "901"},
+		{errors.New("Too many attempts!"), ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if got := RetryAfterSeconds(test.err); got != test.want {
+			t.Errorf("RetryAfterSeconds(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	loginMethodPassword = "password"
+	loginMethodLDAP     = "ldap"
+	loginMethodPasskey  = "passkey"
+	loginMethodOIDC     = "oidc"
+	loginMethodSAML     = "saml"
+)
+
+const maxLoginEventsLimit = 200
+
+// recordLoginSuccess appends a successful login to auth.login_events and
+// updates users.last_login. The login counts as coming from a new device or
+// IP when no earlier successful login of the user used the same user agent
+// or address.
+func recordLoginSuccess(tx *sqlx.Tx, userID string, method string, userAgent string, ip string) error {
+	_, err := tx.Exec(`INSERT INTO auth.login_events (user_id, success, method, ip, user_agent, new_device, new_ip)
+		VALUES ($1, true, $2, $3, $4,
+			not exists (select 1 from auth.login_events where user_id = $1 and success and user_agent = $4),
+			not exists (select 1 from auth.login_events where user_id = $1 and success and ip = $3::inet))`,
+		userID, method, ip, userAgent)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update auth.users set last_login = now() where id = $1", userID)
+	return err
+}
+
+// logFailedLogin appends a failed login outside of the failed transaction.
+// userID is empty when the account is unknown.
+func logFailedLogin(userID string, method string, userAgent string, ip string, reason string) {
+	db := DB
+	_, err := db.Exec(`INSERT INTO auth.login_events (user_id, success, method, ip, user_agent, failure_reason)
+		VALUES (nullif($1, '')::uuid, false, $2, $3, $4, $5)`, userID, method, ip, userAgent, reason)
+	if err != nil {
+		log.Printf("Recording login event failed: %v", err)
+	}
+}
+
+// userIDByEmail returns the ID of the user with email, or "" if there is none.
+func userIDByEmail(email string) string {
+	db := DB
+	emailIndex, err := EmailIndex(email)
+	if err != nil {
+		return ""
+	}
+	var ids []string
+	if err = db.Select(&ids, "select id from auth.users where email_index = $1", emailIndex); err != nil || len(ids) != 1 {
+		return ""
+	}
+	return ids[0]
+}
+
+func loginEventsPage(query models.RLoginEvents) (int, int) {
+	limit := query.Limit
+	if limit <= 0 || limit > maxLoginEventsLimit {
+		limit = 50
+	}
+	return limit, max(query.Offset, 0)
+}
+
+// LoginHistory lists the logins of uID, newest first.
+func LoginHistory(uID string, query models.RLoginEvents) ([]models.LoginEvent, error) {
+	db := DB
+	var err error
+	data := []models.LoginEvent{}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	limit, offset := loginEventsPage(query)
+	err = tx.Select(&data, `select * from auth.login_events where user_id = $1
+		and ($2::boolean is null or success = $2) order by created_at desc limit $3 offset $4`,
+		uID, query.Success, limit, offset)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// LoginEvents lists logins across the admin's organization, or across all
+// users, including unknown accounts, for holders of organizations:all.
+func LoginEvents(adminID string, query models.RLoginEvents) ([]models.LoginEvent, error) {
+	db := DB
+	var err error
+	data := []models.LoginEvent{}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	allOrganizations, err := userHasPermission(tx, adminID, PermissionOrganizationsAll)
+	if err != nil {
+		return data, err
+	}
+
+	limit, offset := loginEventsPage(query)
+	err = tx.Select(&data, `select e.* from auth.login_events e left join auth.users u on u.id = e.user_id
+		where ($1 or u.organization = (select organization from auth.users where id = $2))
+		and ($3 = '' or e.user_id::text = $3) and ($4::boolean is null or e.success = $4)
+		order by e.created_at desc limit $5 offset $6`,
+		allOrganizations, adminID, query.UserID, query.Success, limit, offset)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional mail such as verification links.
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// SMTPMailer sends through an SMTP server, upgrading to TLS when the server
+// offers STARTTLS.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// FileMailer writes every mail as an .eml file into Dir, or to the log when
+// Dir is empty. It is meant for development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+var mailer Mailer
+var mailerOnce sync.Once
+
+// GetMailer returns the mailer selected by MAIL_DRIVER.
+func GetMailer() Mailer {
+	mailerOnce.Do(func() {
+		from := GetEnvDefault("MAIL_FROM", "Zendoc <no-reply@localhost>")
+		switch GetEnvDefault("MAIL_DRIVER", "log") {
+		case "smtp":
+			mailer = SMTPMailer{
+				Host:     GetEnv("SMTP_HOST"),
+				Port:     GetEnvDefault("SMTP_PORT", "587"),
+				Username: GetEnvDefault("SMTP_USERNAME", ""),
+				Password: GetEnvDefault("SMTP_PASSWORD", ""),
+				From:     from,
+			}
+		case "file":
+			mailer = FileMailer{Dir: GetEnvDefault("MAIL_DIR", "mail"), From: from}
+		default:
+			mailer = FileMailer{From: from}
+		}
+	})
+	return mailer
+}
+
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+func envelopeAddress(address string) string {
+	if start := strings.LastIndex(address, "<"); start >= 0 {
+		if end := strings.LastIndex(address, ">"); end > start {
+			return address[start+1 : end]
+		}
+	}
+	return strings.TrimSpace(address)
+}
+
+func formatMail(from string, mail Mail) []byte {
+	id := make([]byte, 16)
+	rand.Read(id)
+	domain := envelopeAddress(from)
+	domain = domain[strings.LastIndex(domain, "@")+1:]
+
+	var b strings.Builder
+	b.WriteString("From: " + headerValue(from) + "\r\n")
+	b.WriteString("To: " + headerValue(mail.To) + "\r\n")
+	b.WriteString("Subject: " + headerValue(mail.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: <" + hex.EncodeToString(id) + "@" + headerValue(domain) + ">\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(mail.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func (m SMTPMailer) Send(mail Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, envelopeAddress(m.From), []string{envelopeAddress(mail.To)}, formatMail(m.From, mail))
+}
+
+func (m FileMailer) Send(mail Mail) error {
+	message := formatMail(m.From, mail)
+	if m.Dir == "" {
+		log.Printf("Mail to %s:\n%s", mail.To, message)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), message, 0o600)
+}
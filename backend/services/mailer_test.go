@@ -0,0 +1,280 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSMTPMessage is what the stand-in server received for one mail.
+type testSMTPMessage struct {
+	From string
+	To   []string
+	// Lines are the raw DATA lines, line endings included and dot-stuffing
+	// removed.
+	Lines []string
+}
+
+func (m testSMTPMessage) Data() string {
+	return strings.Join(m.Lines, "")
+}
+
+// testSMTPServer speaks just enough SMTP for net/smtp.SendMail. It offers
+// neither STARTTLS nor AUTH, so the mailer sends in plain text.
+type testSMTPServer struct {
+	listener net.Listener
+	messages chan testSMTPMessage
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	server := &testSMTPServer{listener: listener, messages: make(chan testSMTPMessage, 8)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	var message testSMTPMessage
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+		switch {
+		case verb == "EHLO" || verb == "HELO":
+			reply("250 localhost")
+		case strings.HasPrefix(strings.ToUpper(command), "MAIL FROM:"):
+			message.From = strings.Trim(command[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(strings.ToUpper(command), "RCPT TO:"):
+			message.To = append(message.To, strings.Trim(command[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			for {
+				line, err = reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.Lines = append(message.Lines, strings.TrimPrefix(line, "."))
+			}
+			s.messages <- message
+			message = testSMTPMessage{}
+			reply("250 OK")
+		case verb == "RSET" || verb == "NOOP":
+			reply("250 OK")
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (s *testSMTPServer) message(t *testing.T) testSMTPMessage {
+	t.Helper()
+
+	select {
+	case message := <-s.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+		return testSMTPMessage{}
+	}
+}
+
+// useTestSMTPServer points GetMailer at a fresh stand-in server for the
+// duration of the test.
+func useTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	server := newTestSMTPServer(t)
+	host, port, err := net.SplitHostPort(server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("splitting address: %v", err)
+	}
+
+	mailerOnce.Do(func() {})
+	previous := mailer
+	mailer = SMTPMailer{Host: host, Port: port, From: "Zendoc <no-reply@example.test>"}
+	t.Cleanup(func() {
+		mailer = previous
+	})
+	return server
+}
+
+// checkMailEnvelope checks the envelope, the headers every mail carries and
+// that all lines end in CRLF, and returns the body with LF line endings.
+func checkMailEnvelope(t *testing.T, message testSMTPMessage, to string, subject string) string {
+	t.Helper()
+
+	if message.From != "no-reply@example.test" {
+		t.Errorf("MAIL FROM = %q, want no-reply@example.test", message.From)
+	}
+	if len(message.To) != 1 || message.To[0] != to {
+		t.Errorf("RCPT TO = %v, want [%v]", message.To, to)
+	}
+	for _, line := range message.Lines {
+		if !strings.HasSuffix(line, "\r\n") || strings.Contains(strings.TrimSuffix(line, "\r\n"), "\r") {
+			t.Errorf("line %q doesn't end in a single CRLF", line)
+		}
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(message.Data()))
+	if err != nil {
+		t.Fatalf("parsing mail: %v", err)
+	}
+	want := map[string]string{
+		"From":                      "Zendoc <no-reply@example.test>",
+		"To":                        to,
+		"Subject":                   subject,
+		"Mime-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Content-Transfer-Encoding": "8bit",
+	}
+	for header, value := range want {
+		if got := parsed.Header.Get(header); got != value {
+			t.Errorf("%v = %q, want %q", header, got, value)
+		}
+	}
+	if date, err := parsed.Header.Date(); err != nil || time.Since(date) > time.Minute {
+		t.Errorf("Date = %q, want the current time", parsed.Header.Get("Date"))
+	}
+	if !regexp.MustCompile(`^<[0-9a-f]{32}@example\.test>$`).MatchString(parsed.Header.Get("Message-Id")) {
+		t.Errorf("Message-ID = %q, want <hex@example.test>", parsed.Header.Get("Message-Id"))
+	}
+
+	body := new(strings.Builder)
+	if _, err := bufio.NewReader(parsed.Body).WriteTo(body); err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return strings.ReplaceAll(body.String(), "\r\n", "\n")
+}
+
+// mailLink returns the token of the only link to prefix in body.
+func mailLink(t *testing.T, body string, prefix string) string {
+	t.Helper()
+
+	links := regexp.MustCompile(regexp.QuoteMeta(prefix)+`\S+`).FindAllString(body, -1)
+	if len(links) != 1 {
+		t.Fatalf("found %d links to %v in %q, want 1", len(links), prefix, body)
+	}
+	link, err := url.Parse(links[0])
+	if err != nil {
+		t.Fatalf("parsing link: %v", err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestVerificationMail(t *testing.T) {
+	server := useTestSMTPServer(t)
+	t.Setenv("PUBLIC_URL", "https://zendoc.example.test")
+
+	if err := sendVerificationEmail("user-1", "alice@example.test"); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	body := checkMailEnvelope(t, server.message(t), "alice@example.test", "Verify your email address")
+
+	if !strings.HasPrefix(body, "Please confirm your email address by opening the link below.\n\n") {
+		t.Errorf("body = %q", body)
+	}
+	if !strings.Contains(body, "The link expires in 24h0m0s.") {
+		t.Errorf("body doesn't give the lifetime: %q", body)
+	}
+
+	token := mailLink(t, body, "https://zendoc.example.test/auth/verify-email?token=")
+	claims, err := parseEmailToken(emailVerificationPurpose, token)
+	if err != nil {
+		t.Fatalf("parsing token from the link: %v", err)
+	}
+	emailHash, _ := HashToken("alice@example.test")
+	if claims.Subject != "user-1" || claims.EmailHash != emailHash {
+		t.Errorf("token is for %v/%v, want user-1 and the mailed address", claims.Subject, claims.EmailHash)
+	}
+	if _, err := parseEmailToken(emailChangePurpose, token); err == nil {
+		t.Error("verification token also confirms an email change")
+	}
+}
+
+func TestPasswordResetMail(t *testing.T) {
+	server := useTestSMTPServer(t)
+	t.Setenv("FRONTEND_URL", "https://app.example.test")
+
+	token, _, hash, err := GenerateToken()
+	if err != nil {
+		t.Fatalf("generating token: %v", err)
+	}
+	if err := sendPasswordResetEmail("bob@example.test", token); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	body := checkMailEnvelope(t, server.message(t), "bob@example.test", "Reset your password")
+
+	if !strings.HasPrefix(body, "Someone asked to reset the password of your account.") {
+		t.Errorf("body = %q", body)
+	}
+	if !strings.Contains(body, "The link expires in 1h0m0s and works once.") {
+		t.Errorf("body doesn't give the lifetime: %q", body)
+	}
+	if got := mailLink(t, body, "https://app.example.test/reset-password?token="); !TokenMatches(got, hash) {
+		t.Errorf("link token %q doesn't match the stored hash", got)
+	}
+}
+
+func TestMailHeaderInjection(t *testing.T) {
+	server := useTestSMTPServer(t)
+
+	err := GetMailer().Send(Mail{
+		To:      "carol@example.test",
+		Subject: "Hello\r\nBcc: mallory@example.test",
+		Body:    "Hi\n.\nBye\n",
+	})
+	if err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	message := server.message(t)
+	body := checkMailEnvelope(t, message, "carol@example.test", "HelloBcc: mallory@example.test")
+
+	parsed, _ := mail.ReadMessage(strings.NewReader(message.Data()))
+	if parsed.Header.Get("Bcc") != "" {
+		t.Error("subject injected a Bcc header")
+	}
+	if body != "Hi\n.\nBye\n" {
+		t.Errorf("body = %q, want the lone dot to survive", body)
+	}
+}
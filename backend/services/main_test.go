@@ -0,0 +1,110 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var testDBOnce sync.Once
+
+func TestMain(m *testing.M) {
+	// Tests that don't touch the database still encrypt and hash, so give
+	// them a throwaway key unless one is configured.
+	if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEYS") == "" {
+		key := make([]byte, 32)
+		rand.Read(key)
+		os.Setenv("AES_KEY", base64.StdEncoding.EncodeToString(key))
+	}
+	os.Exit(m.Run())
+}
+
+// requireDB connects to the database configured by DB_HOST and friends, the
+// way the backend does, and skips the test if there is none. The database
+// has to be initialized from deploy/db/init.
+func requireDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST not set, skipping database test")
+	}
+	testDBOnce.Do(func() {
+		InitDB()
+	})
+}
+
+// testDomain returns a domain no other test run uses.
+func testDomain() string {
+	return strings.ToLower(uuid.New().String()[:8]) + ".example.test"
+}
+
+// createTestOrganization inserts an organization and removes it together
+// with its users when the test ends.
+func createTestOrganization(t *testing.T, org map[string]any) string {
+	t.Helper()
+
+	id := uuid.New().String()
+	columns := []string{"id", "name"}
+	values := []any{id, "Test " + id[:8]}
+	for column, value := range org {
+		columns = append(columns, column)
+		values = append(values, value)
+	}
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	_, err := DB.Exec("INSERT INTO auth.organizations ("+strings.Join(columns, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+");", values...)
+	if err != nil {
+		t.Fatalf("creating organization: %v", err)
+	}
+
+	t.Cleanup(func() {
+		DB.Exec("delete from auth.users where organization = $1", id)
+		DB.Exec("delete from auth.organizations where id = $1", id)
+	})
+	return id
+}
+
+// createTestUser inserts a verified user of orgID with the given roles.
+func createTestUser(t *testing.T, orgID string, email string, roles ...string) string {
+	t.Helper()
+
+	encEmail, err := encryptEmail(email)
+	if err != nil {
+		t.Fatalf("encrypting email: %v", err)
+	}
+	id := uuid.New().String()
+	_, err = DB.Exec(`INSERT INTO auth.users (id, email, email_index, email_domain_index, password, firstname, lastname, organization, type, verified)
+		VALUES ($1, $2, $3, $4, '', 'Test', 'User', $5, $6, true);`, id, encEmail.Value, encEmail.Index, encEmail.DomainIndex, orgID, organizationUserType)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	for _, role := range roles {
+		_, err = DB.Exec("INSERT INTO auth.user_roles (user_id, role_id) SELECT $1, id FROM auth.roles WHERE name = $2;", id, role)
+		if err != nil {
+			t.Fatalf("granting role %v: %v", role, err)
+		}
+	}
+
+	t.Cleanup(func() {
+		DB.Exec("delete from auth.users where id = $1", id)
+	})
+	return id
+}
+
+func testUserRoles(t *testing.T, userID string) []string {
+	t.Helper()
+
+	var roles []string
+	err := DB.Select(&roles, "select r.name from auth.user_roles ur join auth.roles r on r.id = ur.role_id where ur.user_id = $1 order by r.name", userID)
+	if err != nil {
+		t.Fatalf("loading roles: %v", err)
+	}
+	return roles
+}
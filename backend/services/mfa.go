@@ -0,0 +1,650 @@
+package services
+
+import (
+	"backend/models"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const totpPeriod = 30
+const loginChallengeLifetime = 5 * time.Minute
+const loginChallengeMaxAttempts = 5
+
+const insertLoginChallengeString = "INSERT INTO auth.login_challenges (user_id, token_prefix, token_hash, type, method, expires_at) VALUES ($1, $2, $3, $4, $5, $6);"
+
+// requiredChallenge returns the challenge type the user has to pass before a
+// session can be issued, or an empty string if the password is enough.
+func requiredChallenge(tx *sqlx.Tx, userID string) (string, error) {
+	var flags []struct {
+		MFAEnabled  bool `db:"mfa_enabled"`
+		MFARequired bool `db:"mfa_required"`
+	}
+	err := tx.Select(&flags, `select coalesce(u.mfa_enabled, false) as mfa_enabled, coalesce(o.mfa_required, false) as mfa_required
+		from auth.users u left join auth.organizations o on o.id = u.organization where u.id = $1`, userID)
+	if err != nil {
+		return "", err
+	}
+	if len(flags) != 1 {
+		return "", errors.New("User doesn't exist!")
+	}
+
+	switch {
+	case flags[0].MFAEnabled:
+		return models.ChallengeTypeMFA, nil
+	case flags[0].MFARequired:
+		return models.ChallengeTypeMFAEnroll, nil
+	default:
+		return "", nil
+	}
+}
+
+// createLoginChallenge remembers method, the first factor, so the login
+// event written after the second one names it.
+func createLoginChallenge(tx *sqlx.Tx, userID string, challengeType string, method string) (models.ULoginChallenge, error) {
+	var data models.ULoginChallenge
+
+	token, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	expiresAt := time.Now().Add(loginChallengeLifetime)
+
+	_, err = tx.Exec(insertLoginChallengeString, userID, prefix, hash, challengeType, method, expiresAt)
+	if err != nil {
+		return data, err
+	}
+
+	data = models.ULoginChallenge{
+		Challenge: token,
+		Type:      challengeType,
+		ExpiresAt: expiresAt,
+	}
+	return data, nil
+}
+
+// findLoginChallenge finds a challenge by the prefix of its token and locks
+// it. Like refresh tokens, only the keyed hash of the token is stored.
+func findLoginChallenge(tx *sqlx.Tx, token string, challengeType string) (models.LoginChallenge, error) {
+	var challenges []models.LoginChallenge
+	err := tx.Select(&challenges, "select * from auth.login_challenges where token_prefix = $1 and type = $2 and expires_at > now() for update",
+		TokenPrefix(token), challengeType)
+	if err != nil {
+		return models.LoginChallenge{}, err
+	}
+	for _, challenge := range challenges {
+		if TokenMatches(token, challenge.TokenHash) {
+			return challenge, nil
+		}
+	}
+	return models.LoginChallenge{}, errors.New("Invalid or expired challenge!")
+}
+
+// failLoginChallenge counts a wrong code against the challenge and throws the
+// challenge away once it has used up its attempts. The code also counts
+// against the user, since a new login brings a new challenge.
+func failLoginChallenge(tx *sqlx.Tx, challenge models.LoginChallenge) error {
+	recordMFAFailure(challenge.UserID)
+	if challenge.Attempts+1 >= loginChallengeMaxAttempts {
+		_, err := tx.Exec("delete from auth.login_challenges where id = $1", challenge.ID)
+		return err
+	}
+	_, err := tx.Exec("update auth.login_challenges set attempts = attempts + 1 where id = $1", challenge.ID)
+	return err
+}
+
+// passLoginChallenge throws away the challenge whose second factor passed
+// and returns the email index of its user, whose throttles are reset once
+// the login is committed.
+func passLoginChallenge(tx *sqlx.Tx, challenge models.LoginChallenge) (string, error) {
+	_, err := tx.Exec("delete from auth.login_challenges where id = $1", challenge.ID)
+	if err != nil {
+		return "", err
+	}
+	var emailIndex string
+	err = tx.Get(&emailIndex, "select coalesce(email_index, '') from auth.users where id = $1", challenge.UserID)
+	return emailIndex, err
+}
+
+// resetLoginChallengeThrottles resets the throttles of userID after a
+// passed login challenge.
+func resetLoginChallengeThrottles(userID string, emailIndex string) {
+	resetMFAThrottle(userID)
+	resetAccountThrottle(emailIndex)
+}
+
+// validateTOTP checks code against the time steps around now and returns the
+// matching step. Steps at or before lastStep were already used and are
+// rejected so a code can't be replayed.
+func validateTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	current := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// verifyMFACode checks code against the user's stored secret, enrolled or
+// pending, and remembers the used time step on success.
+func verifyMFACode(tx *sqlx.Tx, userID string, code string) (bool, error) {
+	var users []models.User
+	err := tx.Select(&users, "select id, mfa_secret, mfa_last_step from auth.users where id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+	if len(users) != 1 {
+		return false, errors.New("User doesn't exist!")
+	}
+	if !users[0].MFASecret.Valid || users[0].MFASecret.String == "" {
+		return false, errors.New("MFA not enrolled!")
+	}
+
+	secret, err := Decrypt(users[0].MFASecret.String)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := validateTOTP(secret, code, users[0].MFALastStep.Int64)
+	if !ok {
+		return false, nil
+	}
+
+	_, err = tx.Exec("update auth.users set mfa_last_step = $1 where id = $2", step, userID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mfaEnrollment returns the user's pending TOTP secret, generating and
+// storing one first if there is none. The secret only becomes active once a
+// code for it has been confirmed, so asking again before that shows the same
+// secret instead of invalidating the one already scanned.
+func mfaEnrollment(tx *sqlx.Tx, userID string) (models.UMFAEnrollment, error) {
+	var data models.UMFAEnrollment
+
+	var users []models.User
+	err := tx.Select(&users, "select id, email, mfa_secret from auth.users where id = $1", userID)
+	if err != nil {
+		return data, err
+	}
+	if len(users) != 1 {
+		return data, errors.New("User doesn't exist!")
+	}
+	email, err := Decrypt(users[0].Email)
+	if err != nil {
+		return data, err
+	}
+
+	var secret []byte
+	if users[0].MFASecret.Valid && users[0].MFASecret.String != "" {
+		pending, err := Decrypt(users[0].MFASecret.String)
+		if err != nil {
+			return data, err
+		}
+		secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(pending)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      GetEnvDefault("MFA_ISSUER", "Zendoc"),
+		AccountName: email,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+		Secret:      secret,
+	})
+	if err != nil {
+		return data, err
+	}
+
+	if secret == nil {
+		encSecret, err := Encrypt(key.Secret())
+		if err != nil {
+			return data, errors.New("Encryption failed!")
+		}
+		_, err = tx.Exec("update auth.users set mfa_secret = $1, mfa_enabled = false, mfa_last_step = null, updated_at = now() where id = $2", encSecret, userID)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return data, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return data, err
+	}
+
+	data = models.UMFAEnrollment{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}
+	return data, nil
+}
+
+func mfaThrottleKey(userID string) string {
+	return "mfa:" + userID
+}
+
+// checkMFAThrottle fails with a ThrottledError while the user is locked out
+// of passing a login challenge, or confirming or disabling MFA.
+func checkMFAThrottle(userID string) error {
+	entry, err := GetLimiterStore().Get(mfaThrottleKey(userID))
+	if err != nil {
+		return err
+	}
+	if retryAfter := time.Until(entry.LockedUntil); retryAfter > 0 {
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// recordMFAFailure counts a wrong code of the user. Whether they are signed
+// in or passing login challenges, they get loginChallengeMaxAttempts tries
+// before being locked out for LOGIN_LOCKOUT_DURATION.
+func recordMFAFailure(userID string) {
+	policy := loginPolicy{BackoffAfter: loginChallengeMaxAttempts, LockoutThreshold: loginChallengeMaxAttempts}
+	if _, err := GetLimiterStore().Fail(mfaThrottleKey(userID), loginFailureWindow(), policy.lockFor); err != nil {
+		log.Printf("Recording MFA failure failed: %v", err)
+	}
+}
+
+func resetMFAThrottle(userID string) {
+	if err := GetLimiterStore().Reset(mfaThrottleKey(userID)); err != nil {
+		log.Printf("Resetting MFA throttle failed: %v", err)
+	}
+}
+
+func LoginMFA(body models.RLoginMFA, userAgent string, ip string) (models.USesssion, error) {
+	db := DB
+	var err error
+	var data models.USesssion
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	challenge, err := findLoginChallenge(tx, body.Challenge, models.ChallengeTypeMFA)
+	if err != nil {
+		return data, err
+	}
+	if err = checkMFAThrottle(challenge.UserID); err != nil {
+		return data, err
+	}
+
+	ok, err := verifyMFACode(tx, challenge.UserID, body.Code)
+	if err != nil {
+		return data, err
+	}
+	if !ok {
+		if err = failLoginChallenge(tx, challenge); err != nil {
+			return data, err
+		}
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		err = errors.New("Invalid MFA code!")
+		logFailedLogin(challenge.UserID, challenge.Method, userAgent, ip, err.Error())
+		return data, err
+	}
+
+	emailIndex, err := passLoginChallenge(tx, challenge)
+	if err != nil {
+		return data, err
+	}
+	data, err = createSession(tx, challenge.UserID, challenge.Method, userAgent, ip)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+	resetLoginChallengeThrottles(challenge.UserID, emailIndex)
+
+	return data, err
+}
+
+func LoginMFAEnroll(body models.RLoginChallenge) (models.UMFAEnrollment, error) {
+	db := DB
+	var err error
+	var data models.UMFAEnrollment
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	challenge, err := findLoginChallenge(tx, body.Challenge, models.ChallengeTypeMFAEnroll)
+	if err != nil {
+		return data, err
+	}
+
+	data, err = mfaEnrollment(tx, challenge.UserID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func LoginMFAEnrollConfirm(body models.RLoginMFA, userAgent string, ip string) (models.USesssion, error) {
+	db := DB
+	var err error
+	var data models.USesssion
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	challenge, err := findLoginChallenge(tx, body.Challenge, models.ChallengeTypeMFAEnroll)
+	if err != nil {
+		return data, err
+	}
+	if err = checkMFAThrottle(challenge.UserID); err != nil {
+		return data, err
+	}
+
+	ok, err := verifyMFACode(tx, challenge.UserID, body.Code)
+	if err != nil {
+		return data, err
+	}
+	if !ok {
+		if err = failLoginChallenge(tx, challenge); err != nil {
+			return data, err
+		}
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		err = errors.New("Invalid MFA code!")
+		logFailedLogin(challenge.UserID, challenge.Method, userAgent, ip, err.Error())
+		return data, err
+	}
+
+	_, err = tx.Exec("update auth.users set mfa_enabled = true, updated_at = now() where id = $1", challenge.UserID)
+	if err != nil {
+		return data, err
+	}
+	emailIndex, err := passLoginChallenge(tx, challenge)
+	if err != nil {
+		return data, err
+	}
+	data, err = createSession(tx, challenge.UserID, challenge.Method, userAgent, ip)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+	resetLoginChallengeThrottles(challenge.UserID, emailIndex)
+
+	return data, err
+}
+
+func EnrollMFA(uID string) (models.UMFAEnrollment, error) {
+	db := DB
+	var err error
+	var data models.UMFAEnrollment
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var enabled []bool
+	err = tx.Select(&enabled, "select coalesce(mfa_enabled, false) from auth.users where id = $1", uID)
+	if err != nil {
+		return data, err
+	}
+	if len(enabled) != 1 {
+		err = errors.New("User doesn't exist!")
+		return data, err
+	}
+	if enabled[0] {
+		err = errors.New("MFA already enabled!")
+		return data, err
+	}
+
+	data, err = mfaEnrollment(tx, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func ConfirmMFA(uID string, body models.RMFACode) error {
+	db := DB
+	var err error
+
+	if err = checkMFAThrottle(uID); err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var enabled []bool
+	err = tx.Select(&enabled, "select coalesce(mfa_enabled, false) from auth.users where id = $1", uID)
+	if err != nil {
+		return err
+	}
+	if len(enabled) != 1 {
+		err = errors.New("User doesn't exist!")
+		return err
+	}
+	if enabled[0] {
+		err = errors.New("MFA already enabled!")
+		return err
+	}
+
+	ok, err := verifyMFACode(tx, uID, body.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		recordMFAFailure(uID)
+		err = errors.New("Invalid MFA code!")
+		return err
+	}
+
+	_, err = tx.Exec("update auth.users set mfa_enabled = true, updated_at = now() where id = $1", uID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+	resetMFAThrottle(uID)
+
+	return err
+}
+
+func DisableMFA(uID string, body models.RMFACode) error {
+	db := DB
+	var err error
+
+	if err = checkMFAThrottle(uID); err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var flags []struct {
+		MFAEnabled  bool `db:"mfa_enabled"`
+		MFARequired bool `db:"mfa_required"`
+	}
+	err = tx.Select(&flags, `select coalesce(u.mfa_enabled, false) as mfa_enabled, coalesce(o.mfa_required, false) as mfa_required
+		from auth.users u left join auth.organizations o on o.id = u.organization where u.id = $1`, uID)
+	if err != nil {
+		return err
+	}
+	if len(flags) != 1 {
+		err = errors.New("User doesn't exist!")
+		return err
+	}
+	if !flags[0].MFAEnabled {
+		err = errors.New("MFA not enabled!")
+		return err
+	}
+	if flags[0].MFARequired {
+		err = errors.New("MFA is required by your organization!")
+		return err
+	}
+
+	ok, err := verifyMFACode(tx, uID, body.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		recordMFAFailure(uID)
+		err = errors.New("Invalid MFA code!")
+		return err
+	}
+
+	_, err = tx.Exec("update auth.users set mfa_enabled = false, mfa_secret = null, mfa_last_step = null, updated_at = now() where id = $1", uID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+	resetMFAThrottle(uID)
+
+	return err
+}
@@ -0,0 +1,530 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type legacyToken struct {
+	Key   string `db:"key"`
+	Token string `db:"token"`
+}
+
+func hasColumn(tx *sqlx.Tx, table string, column string) (bool, error) {
+	var count int
+	err := tx.Get(&count, "select count(*) from information_schema.columns where table_schema = 'auth' and table_name = $1 and column_name = $2", table, column)
+	return count > 0, err
+}
+
+// MigrateLegacyTokens replaces plaintext tokens left by older versions with
+// their prefix and keyed hash, so existing sessions survive the upgrade. It
+// does nothing on databases created from the current schema.
+func MigrateLegacyTokens() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	legacySessions, err := hasColumn(tx, "sessions", "refresh_token")
+	if err != nil {
+		return err
+	}
+	if legacySessions {
+		_, err = tx.Exec("ALTER TABLE auth.sessions ADD COLUMN IF NOT EXISTS token_prefix VARCHAR(32), ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64);")
+		if err != nil {
+			return err
+		}
+		var tokens []legacyToken
+		err = tx.Select(&tokens, "select id as key, refresh_token as token from auth.sessions where token_hash is null")
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			var hash string
+			hash, err = HashToken(token.Token)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("update auth.sessions set token_prefix = $1, token_hash = $2 where id = $3", TokenPrefix(token.Token), hash, token.Key)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`ALTER TABLE auth.sessions ALTER COLUMN token_prefix SET NOT NULL, ALTER COLUMN token_hash SET NOT NULL,
+			DROP COLUMN refresh_token;`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_sessions_token_prefix ON auth.sessions(token_prefix);")
+		if err != nil {
+			return err
+		}
+		log.Printf("Hashed %d legacy session tokens", len(tokens))
+	}
+
+	legacyRotated, err := hasColumn(tx, "refresh_tokens", "token")
+	if err != nil {
+		return err
+	}
+	if legacyRotated {
+		_, err = tx.Exec("ALTER TABLE auth.refresh_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64);")
+		if err != nil {
+			return err
+		}
+		var tokens []legacyToken
+		err = tx.Select(&tokens, "select token as key, token from auth.refresh_tokens")
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			var hash string
+			hash, err = HashToken(token.Token)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("update auth.refresh_tokens set token_hash = $1 where token = $2", hash, token.Key)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("ALTER TABLE auth.refresh_tokens DROP COLUMN token, ADD PRIMARY KEY (token_hash);")
+		if err != nil {
+			return err
+		}
+		log.Printf("Hashed %d legacy rotated refresh tokens", len(tokens))
+	}
+
+	// Login challenges live for minutes, so plaintext ones are dropped rather
+	// than converted; users in the middle of a login start over.
+	legacyChallenges, err := hasColumn(tx, "login_challenges", "token")
+	if err != nil {
+		return err
+	}
+	if legacyChallenges {
+		var res sql.Result
+		res, err = tx.Exec("delete from auth.login_challenges")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE auth.login_challenges DROP COLUMN token,
+			ADD COLUMN token_prefix VARCHAR(32) NOT NULL, ADD COLUMN token_hash VARCHAR(64) NOT NULL;`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_login_challenges_token_prefix ON auth.login_challenges(token_prefix);")
+		if err != nil {
+			return err
+		}
+		var dropped int64
+		dropped, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		log.Printf("Dropped %d plaintext login challenges", dropped)
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// MigrateSelfRegistration adds users.self_registered to databases from
+// before it existed. Registering stamped verification_sent_at in the
+// transaction that created the user, so it equals created_at for them,
+// unless they asked for another link since.
+func MigrateSelfRegistration() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	marked, err := hasColumn(tx, "users", "self_registered")
+	if err != nil {
+		return err
+	}
+	if !marked {
+		_, err = tx.Exec("ALTER TABLE auth.users ADD COLUMN self_registered BOOLEAN NOT NULL DEFAULT FALSE;")
+		if err != nil {
+			return err
+		}
+		var res sql.Result
+		res, err = tx.Exec("update auth.users set self_registered = true where verification_sent_at = created_at")
+		if err != nil {
+			return err
+		}
+		var count int64
+		count, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		log.Printf("Marked %d users as self-registered", count)
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// MigrateLoginEvents keeps the login history of deleted users on databases
+// from before it outlived them, by unlinking instead of deleting the events.
+func MigrateLoginEvents() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var cascading int
+	err = tx.Get(&cascading, `select count(*) from information_schema.referential_constraints
+		where constraint_schema = 'auth' and constraint_name = 'fk_login_event_user' and delete_rule = 'CASCADE'`)
+	if err != nil {
+		return err
+	}
+	if cascading > 0 {
+		_, err = tx.Exec(`CREATE OR REPLACE FUNCTION auth.login_events_append_only() RETURNS trigger AS $$
+			BEGIN
+			  IF NEW.user_id IS NULL AND to_jsonb(NEW) - 'user_id' = to_jsonb(OLD) - 'user_id' THEN
+			    RETURN NEW;
+			  END IF;
+			  RAISE EXCEPTION 'auth.login_events is append-only';
+			END;
+			$$ LANGUAGE plpgsql;`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE auth.login_events DROP CONSTRAINT fk_login_event_user,
+			ADD CONSTRAINT fk_login_event_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE SET NULL;`)
+		if err != nil {
+			return err
+		}
+		log.Println("Login events now outlive their users")
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// MigrateEmailIndexes adds the blind index columns to databases from before
+// they existed and fills them for rows without one, re-encrypting the
+// deterministic ciphertexts of older versions on the way. Users whose address
+// only differs in case from one already indexed couldn't log in, so the
+// migration fails listing them until an admin merges or renames them.
+func MigrateEmailIndexes() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	indexedUsers, err := hasColumn(tx, "users", "email_index")
+	if err != nil {
+		return err
+	}
+	if !indexedUsers {
+		_, err = tx.Exec(`ALTER TABLE auth.users ADD COLUMN email_index VARCHAR(64) UNIQUE, ADD COLUMN email_domain_index VARCHAR(64),
+			DROP CONSTRAINT IF EXISTS users_email_key;`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DROP INDEX IF EXISTS auth.idx_users_email;
+			CREATE INDEX IF NOT EXISTS idx_users_email_domain_index ON auth.users(email_domain_index);`)
+		if err != nil {
+			return err
+		}
+	}
+	indexedInvitations, err := hasColumn(tx, "invitations", "email_index")
+	if err != nil {
+		return err
+	}
+	if !indexedInvitations {
+		_, err = tx.Exec(`ALTER TABLE auth.invitations ADD COLUMN email_index VARCHAR(64);
+			DROP INDEX IF EXISTS auth.idx_invitations_organization;
+			CREATE INDEX idx_invitations_organization ON auth.invitations(organization_id, email_index);`)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	var duplicates []string
+	for _, table := range []string{"auth.users", "auth.invitations"} {
+		last := ""
+		for {
+			var count int
+			var batchDuplicates []string
+			count, last, batchDuplicates, err = indexEmailBatch(table, last)
+			if err != nil {
+				return fmt.Errorf("%s: %v", table, err)
+			}
+			duplicates = append(duplicates, batchDuplicates...)
+			if count == 0 {
+				break
+			}
+			log.Printf("Indexed %d emails in %s", count-len(batchDuplicates), table)
+		}
+	}
+	if len(duplicates) > 0 {
+		err = fmt.Errorf("users share an email up to case, merge or rename them: %s", strings.Join(duplicates, ", "))
+	}
+	return err
+}
+
+// indexEmailBatch indexes the next batch of rows of table without an index
+// whose id sorts after last, and returns their count, the last id and, as
+// "<id> (same as <id>)", the users it couldn't index because another user
+// has the address.
+func indexEmailBatch(table string, last string) (int, string, []string, error) {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return 0, last, nil, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var duplicates []string
+	var rows []struct {
+		ID    string `db:"id"`
+		Email string `db:"email"`
+	}
+	err = tx.Select(&rows, fmt.Sprintf(`select id, email from %s
+		where email_index is null and id::text > $1 order by id::text limit $2 for update`, table), last, reencryptBatchSize())
+	if err != nil {
+		return 0, last, nil, err
+	}
+
+	for _, row := range rows {
+		last = row.ID
+		var email string
+		email, err = Decrypt(row.Email)
+		if err != nil {
+			return 0, last, nil, err
+		}
+		var encEmail encryptedEmail
+		encEmail, err = encryptEmail(email)
+		if err != nil {
+			return 0, last, nil, err
+		}
+
+		if table == "auth.users" {
+			var ids []string
+			err = tx.Select(&ids, "select id from auth.users where email_index = $1", encEmail.Index)
+			if err != nil {
+				return 0, last, nil, err
+			}
+			if len(ids) > 0 {
+				duplicates = append(duplicates, row.ID+" (same as "+ids[0]+")")
+				continue
+			}
+			_, err = tx.Exec("update auth.users set email = $1, email_index = $2, email_domain_index = $3 where id = $4",
+				encEmail.Value, encEmail.Index, encEmail.DomainIndex, row.ID)
+		} else {
+			_, err = tx.Exec("update auth.invitations set email = $1, email_index = $2 where id = $3",
+				encEmail.Value, encEmail.Index, row.ID)
+		}
+		if err != nil {
+			return 0, last, nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return 0, last, nil, err
+	}
+
+	return len(rows), last, duplicates, err
+}
+
+// MigratePermissions makes auth.permissions match permissionDescriptions, so
+// permissions added to the code reach databases seeded before. Permissions it
+// hasn't stored before are granted to the built-in roles by
+// defaultRolePermissions; grants changed through the API are left alone.
+func MigratePermissions() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var created bool
+	err = tx.Get(&created, "select to_regclass('auth.role_permissions') is not null")
+	if err != nil {
+		return err
+	}
+	if !created {
+		err = errors.New("auth.permissions and auth.role_permissions are missing, create them from deploy/db/init/01-schema.sql")
+		return err
+	}
+
+	names := make([]string, 0, len(permissionDescriptions))
+	for name := range permissionDescriptions {
+		names = append(names, name)
+	}
+	res, err := tx.Exec("delete from auth.permissions where name <> all($1)", pq.StringArray(names))
+	if err != nil {
+		return err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d permissions that no longer exist", removed)
+	}
+
+	var added []string
+	for name, description := range permissionDescriptions {
+		var inserted []string
+		err = tx.Select(&inserted, `INSERT INTO auth.permissions (name, description) VALUES ($1, $2)
+			ON CONFLICT (name) DO NOTHING RETURNING name;`, name, description)
+		if err != nil {
+			return err
+		}
+		if len(inserted) == 0 {
+			_, err = tx.Exec("update auth.permissions set description = $1 where name = $2", description, name)
+			if err != nil {
+				return err
+			}
+		}
+		added = append(added, inserted...)
+	}
+	if len(added) > 0 {
+		err = grantDefaultPermissions(tx, added)
+		if err != nil {
+			return err
+		}
+		log.Printf("Added permissions %s", strings.Join(added, ", "))
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// grantDefaultPermissions grants those of permissions the built-in roles get
+// by default to the roles that exist.
+func grantDefaultPermissions(tx *sqlx.Tx, permissions []string) error {
+	for role, defaults := range defaultRolePermissions {
+		_, err := tx.Exec(`INSERT INTO auth.role_permissions (role_id, permission_id)
+			SELECT r.id, p.id FROM auth.roles r JOIN auth.permissions p ON p.name = any($2) AND p.name = any($3) WHERE r.name = $1
+			ON CONFLICT DO NOTHING;`, role, pq.StringArray(defaults), pq.StringArray(permissions))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
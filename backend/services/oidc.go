@@ -0,0 +1,266 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const SSOProviderOIDC = "oidc"
+
+const insertSSORequestString = "INSERT INTO auth.sso_requests (organization, protocol, state, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4, $5, $6);"
+
+var oidcProviders = map[string]*oidc.Provider{}
+var oidcProvidersMu sync.Mutex
+
+// oidcHTTPClient talks to identity providers, like samlHTTPClient. Its
+// timeout also bounds fetching their signing keys later on.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcContext bounds the discovery, code exchange and ID token verification
+// of one login.
+func oidcContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(oidc.ClientContext(context.Background(), oidcHTTPClient), 20*time.Second)
+}
+
+// oidcIssuer accepts either the issuer itself or its discovery document URL
+// in sso_metadata_url.
+func oidcIssuer(org models.Organization) string {
+	return strings.TrimSuffix(strings.TrimSuffix(org.SSOMetadataURL, "/.well-known/openid-configuration"), "/")
+}
+
+// oidcProvider discovers issuer once. Discovery runs outside the lock, so an
+// unreachable issuer doesn't hold up the logins of other organizations;
+// concurrent first logins may discover it twice.
+func oidcProvider(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	oidcProvidersMu.Lock()
+	provider, ok := oidcProviders[issuer]
+	oidcProvidersMu.Unlock()
+	if ok {
+		return provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvidersMu.Lock()
+	oidcProviders[issuer] = provider
+	oidcProvidersMu.Unlock()
+	return provider, nil
+}
+
+func oidcConfig(ctx context.Context, org models.Organization) (*oidc.Provider, *oauth2.Config, error) {
+	if !org.SSO || org.SSOProvider != SSOProviderOIDC || org.SSOMetadataURL == "" || org.SSOEntityID == "" {
+		return nil, nil, errors.New("SSO not configured!")
+	}
+
+	provider, err := oidcProvider(ctx, oidcIssuer(org))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientSecret := ""
+	if org.SSOClientSecret != "" {
+		clientSecret, err = Decrypt(org.SSOClientSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	config := &oauth2.Config{
+		ClientID:     org.SSOEntityID,
+		ClientSecret: clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  GetEnvDefault("PUBLIC_URL", "http://localhost:3000") + "/auth/sso/oidc/" + org.ID + "/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	return provider, config, nil
+}
+
+// BeginOIDCLogin returns the URL of the organization's identity provider the
+// browser has to be sent to.
+func BeginOIDCLogin(orgID string) (string, error) {
+	db := DB
+	var err error
+
+	org, err := loadSSOOrganization(orgID)
+	if err != nil {
+		return "", err
+	}
+
+	oidcCtx, cancel := oidcContext()
+	defer cancel()
+	_, config, err := oidcConfig(oidcCtx, org)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(insertSSORequestString, org.ID, SSOProviderOIDC, state, nonce, verifier, time.Now().Add(ssoRequestLifetime))
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return "", err
+	}
+
+	return config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), err
+}
+
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// verifyOIDCCallback redeems code with the PKCE verifier of request and
+// returns the claims of the ID token once its signature, audience and the
+// nonce of request check out.
+func verifyOIDCCallback(ctx context.Context, provider *oidc.Provider, config *oauth2.Config, request models.SSORequest, code string) (oidcClaims, error) {
+	var claims oidcClaims
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(request.CodeVerifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		return claims, errors.New("SSO login failed!")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, errors.New("SSO login failed!")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Printf("OIDC ID token verification failed: %v", err)
+		return claims, errors.New("SSO login failed!")
+	}
+	if idToken.Nonce != request.Nonce {
+		return claims, errors.New("SSO login failed!")
+	}
+
+	if err = idToken.Claims(&claims); err != nil {
+		return claims, err
+	}
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return claims, errors.New("Email not verified by identity provider!")
+	}
+	return claims, nil
+}
+
+// FinishOIDCLogin redeems the authorization code, validates the ID token and
+// signs the user in, provisioning them into the organization if needed.
+func FinishOIDCLogin(orgID string, body models.ROIDCCallback, userAgent string, ip string) (models.USesssion, error) {
+	db := DB
+	var err error
+	var data models.USesssion
+
+	defer func() {
+		if err != nil {
+			logFailedLogin("", loginMethodOIDC, userAgent, ip, err.Error())
+		}
+	}()
+
+	if body.Error != "" {
+		log.Printf("OIDC provider returned error: %s", body.Error)
+		err = errors.New("SSO login failed!")
+		return data, err
+	}
+
+	request, err := takeSSORequest(orgID, SSOProviderOIDC, body.State)
+	if err != nil {
+		return data, err
+	}
+
+	org, err := loadSSOOrganization(orgID)
+	if err != nil {
+		return data, err
+	}
+
+	oidcCtx, cancel := oidcContext()
+	defer cancel()
+	provider, config, err := oidcConfig(oidcCtx, org)
+	if err != nil {
+		return data, err
+	}
+
+	claims, err := verifyOIDCCallback(oidcCtx, provider, config, request, body.Code)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	userID, err := provisionSSOUser(tx, org, claims.Email, claims.GivenName, claims.FamilyName)
+	if err != nil {
+		return data, err
+	}
+
+	data, err = createSession(tx, userID, loginMethodOIDC, userAgent, ip)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
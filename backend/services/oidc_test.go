@@ -0,0 +1,386 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const testOIDCClientID = "zendoc-test"
+const testOIDCCode = "test-code"
+
+// testOIDCProvider is an identity provider serving discovery, JWKS and token
+// endpoints. Its token endpoint answers testOIDCCode with an ID token for
+// the claims set on it.
+type testOIDCProvider struct {
+	server *httptest.Server
+	// key is published in the JWKS, signKey signs the ID tokens. Setting
+	// signKey to another key makes the provider hand out forged tokens.
+	key     *rsa.PrivateKey
+	signKey *rsa.PrivateKey
+	// challenge is the PKCE code challenge the token request has to match.
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	p := &testOIDCProvider{key: key, signKey: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]any{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil ||
+			r.PostForm.Get("grant_type") != "authorization_code" ||
+			r.PostForm.Get("code") != testOIDCCode ||
+			oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier")) != p.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   p.server.URL,
+			"sub":   "user-1",
+			"aud":   testOIDCClientID,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": p.nonce,
+		}
+		for name, value := range p.claims {
+			claims[name] = value
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(p.signKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testOIDCProvider) organization(domain string) models.Organization {
+	return models.Organization{
+		SSO:            true,
+		SSOProvider:    SSOProviderOIDC,
+		SSOMetadataURL: p.server.URL + "/.well-known/openid-configuration",
+		SSOEntityID:    testOIDCClientID,
+		Domain:         domain,
+	}
+}
+
+// authorize plays the browser's visit to the authorization endpoint and
+// returns the state the provider redirects back with.
+func (p *testOIDCProvider) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parsing authorization URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != testOIDCClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %v", authURL)
+	}
+	p.challenge = query.Get("code_challenge")
+	p.nonce = query.Get("nonce")
+	return query.Get("state")
+}
+
+func TestVerifyOIDCCallback(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(p *testOIDCProvider, request *models.SSORequest)
+		err    string
+	}{
+		{name: "valid"},
+		{
+			name:   "nonce of another request",
+			change: func(p *testOIDCProvider, request *models.SSORequest) { request.Nonce = "other" },
+			err:    "SSO login failed!",
+		},
+		{
+			name:   "missing nonce",
+			change: func(p *testOIDCProvider, request *models.SSORequest) { p.nonce = "" },
+			err:    "SSO login failed!",
+		},
+		{
+			name: "wrong code verifier",
+			change: func(p *testOIDCProvider, request *models.SSORequest) {
+				request.CodeVerifier = oauth2.GenerateVerifier()
+			},
+			err: "SSO login failed!",
+		},
+		{
+			name:   "signed with unknown key",
+			change: func(p *testOIDCProvider, request *models.SSORequest) { p.signKey = otherKey },
+			err:    "SSO login failed!",
+		},
+		{
+			name:   "issued for another client",
+			change: func(p *testOIDCProvider, request *models.SSORequest) { p.claims["aud"] = "other-client" },
+			err:    "SSO login failed!",
+		},
+		{
+			name: "expired",
+			change: func(p *testOIDCProvider, request *models.SSORequest) {
+				p.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			},
+			err: "SSO login failed!",
+		},
+		{
+			name:   "unverified email",
+			change: func(p *testOIDCProvider, request *models.SSORequest) { p.claims["email_verified"] = false },
+			err:    "Email not verified by identity provider!",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestOIDCProvider(t)
+			ctx := context.Background()
+			provider, config, err := oidcConfig(ctx, p.organization("example.test"))
+			if err != nil {
+				t.Fatalf("oidcConfig: %v", err)
+			}
+
+			request := models.SSORequest{Nonce: "nonce", CodeVerifier: oauth2.GenerateVerifier()}
+			p.nonce = request.Nonce
+			p.challenge = oauth2.S256ChallengeFromVerifier(request.CodeVerifier)
+			p.claims = jwt.MapClaims{"email": "alice@example.test", "email_verified": true, "given_name": "Alice"}
+			if test.change != nil {
+				test.change(p, &request)
+			}
+
+			claims, err := verifyOIDCCallback(ctx, provider, config, request, testOIDCCode)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyOIDCCallback: %v", err)
+			}
+			if claims.Email != "alice@example.test" || claims.GivenName != "Alice" {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderUnreachableIssuer(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(release) })
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := oidcProvider(ctx, hanging.URL)
+		done <- err
+	}()
+
+	// The hanging discovery mustn't hold up other issuers.
+	p := newTestOIDCProvider(t)
+	start := time.Now()
+	if _, err := oidcProvider(context.Background(), p.server.URL); err != nil {
+		t.Fatalf("discovering a reachable issuer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("discovering a reachable issuer took %v", elapsed)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("discovering a hanging issuer succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovering a hanging issuer ignored the deadline")
+	}
+}
+
+func TestOIDCLoginState(t *testing.T) {
+	requireDB(t)
+
+	p := newTestOIDCProvider(t)
+	domain := testDomain()
+	org := p.organization(domain)
+	orgID := createTestOrganization(t, map[string]any{
+		"domain":           domain,
+		"sso":              true,
+		"sso_provider":     org.SSOProvider,
+		"sso_metadata_url": org.SSOMetadataURL,
+		"sso_entity_id":    org.SSOEntityID,
+	})
+	p.claims = jwt.MapClaims{"email": "state@" + domain, "email_verified": true}
+
+	authURL, err := BeginOIDCLogin(orgID)
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin: %v", err)
+	}
+	state := p.authorize(t, authURL)
+
+	_, err = FinishOIDCLogin(orgID, models.ROIDCCallback{Code: testOIDCCode, State: "unknown"}, "test", "127.0.0.1")
+	if err == nil || err.Error() != "Invalid or expired SSO request!" {
+		t.Fatalf("unknown state: got error %v", err)
+	}
+
+	_, err = FinishOIDCLogin(orgID, models.ROIDCCallback{Code: testOIDCCode, State: state}, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("FinishOIDCLogin: %v", err)
+	}
+
+	_, err = FinishOIDCLogin(orgID, models.ROIDCCallback{Code: testOIDCCode, State: state}, "test", "127.0.0.1")
+	if err == nil || err.Error() != "Invalid or expired SSO request!" {
+		t.Fatalf("replayed state: got error %v", err)
+	}
+}
+
+func TestOIDCAccountLinking(t *testing.T) {
+	requireDB(t)
+
+	p := newTestOIDCProvider(t)
+	domain := testDomain()
+	org := p.organization(domain)
+	orgID := createTestOrganization(t, map[string]any{
+		"domain":           domain,
+		"sso":              true,
+		"sso_provider":     org.SSOProvider,
+		"sso_metadata_url": org.SSOMetadataURL,
+		"sso_entity_id":    org.SSOEntityID,
+	})
+	otherDomain := testDomain()
+	otherOrgID := createTestOrganization(t, map[string]any{"domain": otherDomain, "allowed_domains": domain})
+
+	existingID := createTestUser(t, orgID, "existing@"+domain, adminRoleName)
+	createTestUser(t, otherOrgID, "taken@"+domain)
+
+	login := func(email string) (string, error) {
+		authURL, err := BeginOIDCLogin(orgID)
+		if err != nil {
+			t.Fatalf("BeginOIDCLogin: %v", err)
+		}
+		state := p.authorize(t, authURL)
+		p.claims = jwt.MapClaims{"email": email, "email_verified": true, "given_name": "Linked", "family_name": "Name"}
+		session, err := FinishOIDCLogin(orgID, models.ROIDCCallback{Code: testOIDCCode, State: state}, "test", "127.0.0.1")
+		if err != nil {
+			return "", err
+		}
+		var userIDs []string
+		if err = DB.Select(&userIDs, "select user_id from auth.sessions where id = $1", session.SessionID); err != nil || len(userIDs) != 1 {
+			t.Fatalf("loading session: %v", err)
+		}
+		return userIDs[0], nil
+	}
+
+	t.Run("existing user of the organization", func(t *testing.T) {
+		userID, err := login("Existing@" + domain)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if userID != existingID {
+			t.Fatalf("signed in as %v, want the existing user %v", userID, existingID)
+		}
+		var users []models.User
+		if err = DB.Select(&users, "select id, firstname, lastname from auth.users where id = $1", userID); err != nil || len(users) != 1 {
+			t.Fatalf("loading user: %v", err)
+		}
+		if users[0].FirstName != "Linked" || users[0].LastName != "Name" {
+			t.Fatalf("names weren't synced: %+v", users[0])
+		}
+		if roles := testUserRoles(t, userID); len(roles) != 1 || roles[0] != adminRoleName {
+			t.Fatalf("roles changed to %v", roles)
+		}
+	})
+
+	t.Run("user of another organization", func(t *testing.T) {
+		_, err := login("taken@" + domain)
+		if err == nil || err.Error() != "User belongs to another organization!" {
+			t.Fatalf("got error %v", err)
+		}
+	})
+
+	t.Run("new user", func(t *testing.T) {
+		userID, err := login("new@" + domain)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if userID == existingID {
+			t.Fatal("new address was linked to the existing user")
+		}
+		if roles := testUserRoles(t, userID); len(roles) != 1 || roles[0] != defaultRoleName {
+			t.Fatalf("provisioned with roles %v", roles)
+		}
+	})
+
+	t.Run("address outside the organization", func(t *testing.T) {
+		_, err := login("someone@" + otherDomain)
+		if err == nil || err.Error() != "Email domain not allowed for this organization!" {
+			t.Fatalf("got error %v", err)
+		}
+	})
+}
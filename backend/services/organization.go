@@ -0,0 +1,132 @@
+package services
+
+import (
+	"backend/models"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// organizationColumns selects an organization with its nullable text columns
+// folded to empty strings so they scan into models.Organization.
+const organizationColumns = `id, name, coalesce(domain, '') as domain, coalesce(sso, false) as sso,
+	coalesce(sso_provider, '') as sso_provider, coalesce(sso_metadata_url, '') as sso_metadata_url,
+	coalesce(sso_entity_id, '') as sso_entity_id, coalesce(sso_client_secret, '') as sso_client_secret,
+	coalesce(ldap, false) as ldap, coalesce(ldap_server, '') as ldap_server, coalesce(ldap_bind_dn, '') as ldap_bind_dn,
+	coalesce(ldap_search_base, '') as ldap_search_base, coalesce(ldap_bind_password, '') as ldap_bind_password,
+	coalesce(ldap_user_filter, '') as ldap_user_filter, coalesce(ldap_start_tls, false) as ldap_start_tls, coalesce(allowed_domains, '') as allowed_domains,
+	coalesce(mfa_required, false) as mfa_required, coalesce(require_verified_email, false) as require_verified_email,
+	coalesce(registration_mode, '') as registration_mode,
+	created_at, updated_at`
+
+func getOrganization(tx *sqlx.Tx, orgID string) (models.Organization, error) {
+	var orgs []models.Organization
+	if _, err := uuid.Parse(orgID); err != nil {
+		return models.Organization{}, errors.New("Organization doesn't exist!")
+	}
+	err := tx.Select(&orgs, "select "+organizationColumns+" from auth.organizations where id = $1", orgID)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	if len(orgs) != 1 {
+		return models.Organization{}, errors.New("Organization doesn't exist!")
+	}
+	return orgs[0], nil
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
+
+// organizationDomains returns the organization's primary domain followed by
+// its comma-separated allowed_domains.
+func organizationDomains(org models.Organization) []string {
+	var domains []string
+	if org.Domain != "" {
+		domains = append(domains, strings.ToLower(org.Domain))
+	}
+	for _, domain := range strings.Split(org.AllowedDomains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func organizationOwnsEmail(org models.Organization, email string) bool {
+	domain := emailDomain(email)
+	if domain == "" {
+		return false
+	}
+	for _, allowed := range organizationDomains(org) {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// organizationsOwningEmail returns the organizations among orgs whose domain
+// or allowed_domains contain email's domain.
+func organizationsOwningEmail(orgs []models.Organization, email string) []models.Organization {
+	var owners []models.Organization
+	for _, org := range orgs {
+		if organizationOwnsEmail(org, email) {
+			owners = append(owners, org)
+		}
+	}
+	return owners
+}
+
+// errAmbiguousDomain refuses an address whose domain several organizations
+// claim, since there is no telling which of them the user belongs to.
+func errAmbiguousDomain(owners []models.Organization, email string) error {
+	ids := make([]string, len(owners))
+	for i, org := range owners {
+		ids[i] = org.ID
+	}
+	log.Printf("Organizations %s all claim the domain %s", strings.Join(ids, ", "), emailDomain(email))
+	return errors.New("Email domain claimed by several organizations!")
+}
+
+// organizationForEmail returns the organization whose domain or
+// allowed_domains contain email's domain.
+func organizationForEmail(tx *sqlx.Tx, email string) (models.Organization, bool, error) {
+	var orgs []models.Organization
+	err := tx.Select(&orgs, "select "+organizationColumns+" from auth.organizations")
+	if err != nil {
+		return models.Organization{}, false, err
+	}
+	owners := organizationsOwningEmail(orgs, email)
+	switch len(owners) {
+	case 0:
+		return models.Organization{}, false, nil
+	case 1:
+		return owners[0], true, nil
+	default:
+		return models.Organization{}, false, errAmbiguousDomain(owners, email)
+	}
+}
+
+// checkOrganizationEmail refuses addresses that wouldn't register into orgID:
+// its users may only take addresses their organization owns, and users
+// without one only addresses no organization claims.
+func checkOrganizationEmail(tx *sqlx.Tx, orgID string, email string) error {
+	org, _, err := organizationForEmail(tx, email)
+	if err != nil {
+		return err
+	}
+	// An address no organization claims has an empty org.ID.
+	if org.ID != orgID {
+		return errors.New("Email domain not allowed for this organization!")
+	}
+	return nil
+}
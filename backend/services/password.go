@@ -0,0 +1,167 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hashes are stored as PHC strings, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. Hashes written before the
+// switch to Argon2id are bare hex-encoded SHA-256 digests and are upgraded on
+// the next successful login.
+
+const argon2idPrefix = "$argon2id$"
+
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var dummyPasswordHash string
+var dummyPasswordOnce sync.Once
+
+func currentArgon2Params() argon2Params {
+	return argon2Params{
+		Memory:  uint32(envUint("ARGON2_MEMORY", 64*1024, 32)),
+		Time:    uint32(envUint("ARGON2_TIME", 3, 32)),
+		Threads: uint8(envUint("ARGON2_THREADS", 2, 8)),
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func envUint(key string, fallback uint64, bits int) uint64 {
+	value, err := strconv.ParseUint(GetEnvDefault(key, ""), 10, bits)
+	if err != nil || value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func HashPassword(plaintext string) (string, error) {
+	params := currentArgon2Params()
+
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(plaintext), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		params.Memory,
+		params.Time,
+		params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// VerifyPassword reports whether plaintext matches the stored hash and
+// whether the stored hash should be replaced by a fresh HashPassword result,
+// either because it uses a legacy format or outdated cost parameters.
+func VerifyPassword(plaintext string, encoded string) (bool, bool, error) {
+	switch {
+	case encoded == "":
+		// Accounts provisioned through SSO or LDAP have no local password.
+		return false, false, nil
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return verifyArgon2id(plaintext, encoded)
+	case isLegacySHA256(encoded):
+		hashed, err := Hash256(plaintext)
+		if err != nil {
+			return false, false, err
+		}
+		match := subtle.ConstantTimeCompare([]byte(hashed), []byte(encoded)) == 1
+		return match, match, nil
+	default:
+		return false, false, errors.New("Unknown password hash format!")
+	}
+}
+
+func verifyArgon2id(plaintext string, encoded string) (bool, bool, error) {
+	params, salt, hash, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	computed := argon2.IDKey([]byte(plaintext), salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(computed, hash) != 1 {
+		return false, false, nil
+	}
+
+	current := currentArgon2Params()
+	rehash := params.Memory != current.Memory ||
+		params.Time != current.Time ||
+		params.Threads != current.Threads ||
+		uint32(len(salt)) != current.SaltLen ||
+		uint32(len(hash)) != current.KeyLen
+
+	return true, rehash, nil
+}
+
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	var version int
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("Invalid password hash!")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errors.New("Invalid password hash!")
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errors.New("Unsupported argon2 version!")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errors.New("Invalid password hash!")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.New("Invalid password hash!")
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errors.New("Invalid password hash!")
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(hash))
+
+	return params, salt, hash, nil
+}
+
+// VerifyDummyPassword burns the same amount of work as VerifyPassword so a
+// login for an unknown user takes as long as one with a wrong password.
+func VerifyDummyPassword(plaintext string) {
+	dummyPasswordOnce.Do(func() {
+		dummyPasswordHash, _ = HashPassword("zendoc-dummy-password")
+	})
+	VerifyPassword(plaintext, dummyPasswordHash)
+}
+
+func isLegacySHA256(encoded string) bool {
+	if len(encoded) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
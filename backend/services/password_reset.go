@@ -0,0 +1,250 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+const minPasswordLength = 8
+
+func passwordResetLifetime() time.Duration {
+	return envDuration("PASSWORD_RESET_LIFETIME", time.Hour)
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("Password too short!")
+	}
+	return nil
+}
+
+func sendPasswordResetEmail(email string, token string) error {
+	link := FrontendURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return GetMailer().Send(Mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. Open the link below to choose a new one.\n\n" + link +
+			"\n\nThe link expires in " + passwordResetLifetime().String() + " and works once. If you didn't ask for this, you can ignore this mail.\n",
+	})
+}
+
+// ForgotPassword mails a reset link if email belongs to a user with a local
+// password. Unknown addresses, directory and SSO users, and repeated requests
+// within a minute are silently ignored so the response gives nothing away.
+func ForgotPassword(body models.REmail) error {
+	db := DB
+	var err error
+
+	emailIndex, err := EmailIndex(body.Email)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var ids []string
+	err = tx.Select(&ids, `select id from auth.users u where email_index = $1 and password <> '' and coalesce(active, true)
+		and not exists (select 1 from auth.password_resets r where r.user_id = u.id and r.created_at > now() - interval '1 minute')`, emailIndex)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		err = tx.Commit()
+		return err
+	}
+
+	token, prefix, hash, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO auth.password_resets (user_id, token_prefix, token_hash, expires_at) VALUES ($1, $2, $3, $4);",
+		ids[0], prefix, hash, time.Now().Add(passwordResetLifetime()))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	// Sending in the background keeps the response time the same as for
+	// unknown addresses.
+	go func() {
+		mailErr := sendPasswordResetEmail(body.Email, token)
+		if mailErr != nil {
+			log.Printf("Sending password reset mail failed: %v", mailErr)
+		}
+	}()
+
+	return err
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// signs the user out everywhere.
+func ResetPassword(body models.RResetPassword) error {
+	db := DB
+	var err error
+
+	err = validatePassword(body.Password)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var resets []models.PasswordReset
+	err = tx.Select(&resets, "select * from auth.password_resets where token_prefix = $1 for update", TokenPrefix(body.Token))
+	if err != nil {
+		return err
+	}
+	var reset *models.PasswordReset
+	for i := range resets {
+		if TokenMatches(body.Token, resets[i].TokenHash) {
+			reset = &resets[i]
+		}
+	}
+	if reset == nil || !reset.ExpiresAt.After(time.Now()) {
+		err = errors.New("Invalid or expired token!")
+		return err
+	}
+
+	hash, err := HashPassword(body.Password)
+	if err != nil {
+		return err
+	}
+	// Following the link proves control of the address as well.
+	_, err = tx.Exec("update auth.users set password = $1, verified = true, updated_at = now() where id = $2", hash, reset.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from auth.password_resets where user_id = $1", reset.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = revokeSessions(tx, reset.UserID, "")
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// ChangePassword replaces the password of a signed-in user after checking
+// the current one and ends all sessions but currentSessionID.
+func ChangePassword(uID string, currentSessionID string, body models.RChangePassword) error {
+	db := DB
+	var err error
+
+	err = validatePassword(body.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var passwords []string
+	err = tx.Select(&passwords, "select password from auth.users where id = $1 for update", uID)
+	if err != nil {
+		return err
+	}
+	if len(passwords) != 1 {
+		err = errors.New("User doesn't exist!")
+		return err
+	}
+	if passwords[0] == "" {
+		err = errors.New("Password managed by identity provider!")
+		return err
+	}
+	match, _, err := VerifyPassword(body.CurrentPassword, passwords[0])
+	if err != nil {
+		return err
+	}
+	if !match {
+		err = errors.New("Invalid password!")
+		return err
+	}
+
+	hash, err := HashPassword(body.NewPassword)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update auth.users set password = $1, updated_at = now() where id = $2", hash, uID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from auth.password_resets where user_id = $1", uID)
+	if err != nil {
+		return err
+	}
+	_, err = revokeSessions(tx, uID, currentSessionID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
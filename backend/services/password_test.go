@@ -0,0 +1,139 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+// cheapArgon2 keeps the hashing in these tests fast.
+func cheapArgon2(t *testing.T) {
+	t.Helper()
+	t.Setenv("ARGON2_MEMORY", "1024")
+	t.Setenv("ARGON2_TIME", "1")
+	t.Setenv("ARGON2_THREADS", "1")
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	cheapArgon2(t)
+
+	encoded, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("HashPassword = %q, want an argon2id PHC string with the configured parameters", encoded)
+	}
+
+	other, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if other == encoded {
+		t.Error("hashing the same password twice gave the same hash, want a fresh salt")
+	}
+
+	match, rehash, err := VerifyPassword("correct horse battery staple", encoded)
+	if err != nil || !match || rehash {
+		t.Errorf("VerifyPassword(right password) = %v, %v, %v, want a match without rehash", match, rehash, err)
+	}
+	match, rehash, err = VerifyPassword("Correct horse battery staple", encoded)
+	if err != nil || match || rehash {
+		t.Errorf("VerifyPassword(wrong password) = %v, %v, %v, want no match", match, rehash, err)
+	}
+	match, rehash, err = VerifyPassword("", encoded)
+	if err != nil || match || rehash {
+		t.Errorf("VerifyPassword(empty password) = %v, %v, %v, want no match", match, rehash, err)
+	}
+}
+
+func TestVerifyPasswordWithoutHash(t *testing.T) {
+	match, rehash, err := VerifyPassword("anything", "")
+	if err != nil || match || rehash {
+		t.Errorf("VerifyPassword without a local password = %v, %v, %v, want no match", match, rehash, err)
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	tests := []struct {
+		encoded string
+		err     string
+	}{
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA", "Invalid password hash!"},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA$extra", "Invalid password hash!"},
+		{"$argon2id$19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", "Invalid password hash!"},
+		{"$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", "Unsupported argon2 version!"},
+		{"$argon2id$v=19$m=1024;t=1;p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", "Invalid password hash!"},
+		{"$argon2id$v=19$m=1024,t=1,p=1$not base64!$aGFzaA", "Invalid password hash!"},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$not base64!", "Invalid password hash!"},
+		{"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", "Unknown password hash format!"},
+		{"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542", "Unknown password hash format!"},
+		{"zz884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "Unknown password hash format!"},
+	}
+	for _, test := range tests {
+		match, rehash, err := VerifyPassword("password", test.encoded)
+		if err == nil || err.Error() != test.err || match || rehash {
+			t.Errorf("VerifyPassword(%q) = %v, %v, %v, want %v", test.encoded, match, rehash, err, test.err)
+		}
+	}
+}
+
+func TestVerifyPasswordNeedsRehash(t *testing.T) {
+	cheapArgon2(t)
+
+	encoded, err := HashPassword("password")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+
+	for _, key := range []string{"ARGON2_MEMORY", "ARGON2_TIME", "ARGON2_THREADS"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, "2")
+			match, rehash, err := VerifyPassword("password", encoded)
+			if err != nil || !match || !rehash {
+				t.Errorf("VerifyPassword after changing %v = %v, %v, %v, want a match that needs rehash", key, match, rehash, err)
+			}
+			match, rehash, err = VerifyPassword("wrong", encoded)
+			if err != nil || match || rehash {
+				t.Errorf("VerifyPassword(wrong password) after changing %v = %v, %v, %v, want no match", key, match, rehash, err)
+			}
+		})
+	}
+
+	// Unparsable settings fall back to the defaults rather than to zero.
+	t.Setenv("ARGON2_MEMORY", "lots")
+	if got := currentArgon2Params().Memory; got != 64*1024 {
+		t.Errorf("ARGON2_MEMORY=lots gives %d KiB, want the default 65536", got)
+	}
+}
+
+func TestVerifyPasswordLegacySHA256(t *testing.T) {
+	cheapArgon2(t)
+
+	legacy, err := Hash256("password")
+	if err != nil {
+		t.Fatalf("Hash256: %v", err)
+	}
+
+	match, rehash, err := VerifyPassword("password", legacy)
+	if err != nil || !match || !rehash {
+		t.Fatalf("VerifyPassword(legacy hash) = %v, %v, %v, want a match that needs rehash", match, rehash, err)
+	}
+	match, rehash, err = VerifyPassword("wrong", legacy)
+	if err != nil || match || rehash {
+		t.Errorf("VerifyPassword(wrong password, legacy hash) = %v, %v, %v, want no match", match, rehash, err)
+	}
+	match, _, err = VerifyPassword("password", strings.ToUpper(legacy))
+	if err != nil || match {
+		t.Errorf("VerifyPassword(upper-case legacy hash) = %v, %v, want no match", match, err)
+	}
+
+	// Login stores a fresh hash in place of the legacy one.
+	upgraded, err := HashPassword("password")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	match, rehash, err = VerifyPassword("password", upgraded)
+	if err != nil || !match || rehash {
+		t.Errorf("VerifyPassword(upgraded hash) = %v, %v, %v, want a match without rehash", match, rehash, err)
+	}
+}
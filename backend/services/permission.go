@@ -0,0 +1,235 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Permissions are granted to roles and checked by RequirePermission. The
+// device permissions are named like the personal token scopes, which are
+// checked on top. A user's own account needs no permission.
+const (
+	PermissionDevicesRead       = ScopeDevicesRead
+	PermissionDevicesWrite      = ScopeDevicesWrite
+	PermissionRolesRead         = "roles:read"
+	PermissionRolesWrite        = "roles:write"
+	PermissionRolesAssign       = "roles:assign"
+	PermissionUsersRead         = "users:read"
+	PermissionUsersManage       = "users:manage"
+	PermissionUsersImpersonate  = "users:impersonate"
+	PermissionAuditRead         = "audit:read"
+	PermissionInvitationsManage = "invitations:manage"
+	PermissionSCIMManage        = "scim:manage"
+	PermissionOrganizationsAll  = "organizations:all"
+)
+
+// permissionDescriptions are the permissions stored in auth.permissions.
+var permissionDescriptions = map[string]string{
+	PermissionDevicesRead:       "Search servers",
+	PermissionDevicesWrite:      "Create and change servers and device roles",
+	PermissionRolesRead:         "List roles",
+	PermissionRolesWrite:        "Create and delete roles and change their permissions",
+	PermissionRolesAssign:       "Assign roles to users",
+	PermissionUsersRead:         "Search users",
+	PermissionUsersManage:       "Manage sessions, lockouts and status of users",
+	PermissionUsersImpersonate:  "Impersonate users",
+	PermissionAuditRead:         "Read login events",
+	PermissionInvitationsManage: "Invite users",
+	PermissionSCIMManage:        "Manage the organization's SCIM token",
+	PermissionOrganizationsAll:  "Extend the other permissions to every organization and to its admins",
+}
+
+// defaultRolePermissions are granted to the built-in roles. Roles are shared
+// by all organizations, so creating them and assigning them directly is left
+// to super admins.
+var defaultRolePermissions = map[string][]string{
+	superAdminRoleName: {
+		PermissionDevicesRead, PermissionDevicesWrite, PermissionRolesRead, PermissionRolesWrite, PermissionRolesAssign,
+		PermissionUsersRead, PermissionUsersManage, PermissionUsersImpersonate, PermissionAuditRead,
+		PermissionInvitationsManage, PermissionSCIMManage, PermissionOrganizationsAll,
+	},
+	adminRoleName: {
+		PermissionDevicesRead, PermissionDevicesWrite, PermissionRolesRead, PermissionUsersRead, PermissionUsersManage,
+		PermissionAuditRead, PermissionInvitationsManage, PermissionSCIMManage,
+	},
+	defaultRoleName:  {PermissionDevicesRead, PermissionDevicesWrite},
+	readOnlyRoleName: {PermissionDevicesRead},
+}
+
+// userHasPermission reports whether a role of uID grants one of permissions.
+func userHasPermission(tx *sqlx.Tx, uID string, permissions ...string) (bool, error) {
+	var count int
+	err := tx.Get(&count, `select count(*) from auth.user_roles ur
+		join auth.role_permissions rp on rp.role_id = ur.role_id
+		join auth.permissions p on p.id = rp.permission_id
+		where ur.user_id = $1 and p.name = any($2)`, uID, pq.Array(permissions))
+	return count > 0, err
+}
+
+// UserPermissions returns the permissions granted by uID's roles.
+func UserPermissions(uID string) ([]string, error) {
+	db := DB
+	var err error
+	data := []string{}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Select(&data, `select distinct p.name from auth.user_roles ur
+		join auth.role_permissions rp on rp.role_id = ur.role_id
+		join auth.permissions p on p.id = rp.permission_id
+		where ur.user_id = $1`, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// rolePermission finds the role and permission of body.
+func rolePermission(tx *sqlx.Tx, body models.RRolePermission) (string, string, error) {
+	if _, err := uuid.Parse(body.RoleID); err != nil {
+		return "", "", errors.New("Role doesn't exist!")
+	}
+	var roleIDs []string
+	err := tx.Select(&roleIDs, "select id from auth.roles where id = $1", body.RoleID)
+	if err != nil {
+		return "", "", err
+	}
+	if len(roleIDs) == 0 {
+		return "", "", errors.New("Role doesn't exist!")
+	}
+	var permissionIDs []string
+	err = tx.Select(&permissionIDs, "select id from auth.permissions where name = $1", body.Permission)
+	if err != nil {
+		return "", "", err
+	}
+	if len(permissionIDs) == 0 {
+		return "", "", errors.New("Permission doesn't exist!")
+	}
+	return roleIDs[0], permissionIDs[0], nil
+}
+
+// GrantPermission grants a permission to a role, and so to every user
+// holding it.
+func GrantPermission(body models.RRolePermission) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	roleID, permissionID, err := rolePermission(tx, body)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO auth.role_permissions (role_id, permission_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;", roleID, permissionID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		err = errors.New("Role already has this permission!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// RevokePermission takes a permission away from a role.
+func RevokePermission(body models.RRolePermission) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	roleID, permissionID, err := rolePermission(tx, body)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM auth.role_permissions WHERE role_id = $1 and permission_id = $2;", roleID, permissionID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		err = errors.New("Role doesn't have this permission!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPermissionSeedData checks that deploy/db/init grants what
+// MigratePermissions grants to permissions it adds later.
+func TestPermissionSeedData(t *testing.T) {
+	seed, err := os.ReadFile("../../deploy/db/init/02-seed-data.sql")
+	if err != nil {
+		t.Fatalf("reading seed data: %v", err)
+	}
+
+	roleIDs := map[string]string{}
+	for _, match := range regexp.MustCompile(`\('([0-9a-f-]{36})', '(\w+)', '[^']*'\)[,;]`).FindAllStringSubmatch(string(seed), -1) {
+		roleIDs[match[1]] = match[2]
+	}
+	permissionIDs := map[string]string{}
+	for _, match := range regexp.MustCompile(`\('([0-9a-f-]{36})', '(\w+:\w+)', '((?:[^']|'')*)'\)[,;]`).FindAllStringSubmatch(string(seed), -1) {
+		permissionIDs[match[1]] = match[2]
+		if want, ok := permissionDescriptions[match[2]]; !ok {
+			t.Errorf("seed data has unknown permission %v", match[2])
+		} else if got := strings.ReplaceAll(match[3], "''", "'"); got != want {
+			t.Errorf("%v is described as %q, want %q", match[2], got, want)
+		}
+	}
+	if len(permissionIDs) != len(permissionDescriptions) {
+		t.Errorf("seed data has %d permissions, want %d", len(permissionIDs), len(permissionDescriptions))
+	}
+
+	grants := map[string][]string{}
+	for _, match := range regexp.MustCompile(`\('([0-9a-f-]{36})', '([0-9a-f-]{36})'\)[,;]`).FindAllStringSubmatch(string(seed), -1) {
+		role, permission := roleIDs[match[1]], permissionIDs[match[2]]
+		if role != "" && permission != "" {
+			grants[role] = append(grants[role], permission)
+		}
+	}
+	for role, defaults := range defaultRolePermissions {
+		got, want := slices.Sorted(slices.Values(grants[role])), slices.Sorted(slices.Values(defaults))
+		if !slices.Equal(got, want) {
+			t.Errorf("seed data grants %v %v, want %v", role, got, want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// personalTokenPrefix marks personal access tokens so they can't be mistaken
+// for access JWTs and are easy to spot in leaked logs or repositories.
+const personalTokenPrefix = "zdp_"
+
+const (
+	ScopeDevicesRead  = "devices:read"
+	ScopeDevicesWrite = "devices:write"
+)
+
+var PersonalTokenScopes = []string{ScopeDevicesRead, ScopeDevicesWrite}
+
+func personalTokenMaxLifetime() time.Duration {
+	return envDuration("PERSONAL_TOKEN_MAX_LIFETIME", 365*24*time.Hour)
+}
+
+// IsPersonalToken tells personal access tokens apart from access JWTs.
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, personalTokenPrefix)
+}
+
+func PersonalTokens(uID string) ([]models.UPersonalToken, error) {
+	db := DB
+	var err error
+	data := []models.UPersonalToken{}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Select(&data, `select id, name, scopes, expires_at, last_used_at, last_used_ip, created_at
+		from auth.personal_tokens where user_id = $1 order by created_at`, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// CreatePersonalToken issues a token for uID with the requested name, scopes
+// and expiry.
+func CreatePersonalToken(uID string, body models.RCreatePersonalToken) (models.UCreatedPersonalToken, error) {
+	db := DB
+	var err error
+	var data models.UCreatedPersonalToken
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 100 {
+		err = errors.New("Invalid token name!")
+		return data, err
+	}
+	scopes, err := personalTokenScopes(body.Scopes)
+	if err != nil {
+		return data, err
+	}
+	if !body.ExpiresAt.After(time.Now()) || body.ExpiresAt.After(time.Now().Add(personalTokenMaxLifetime())) {
+		err = errors.New("Invalid expiry!")
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = insertPersonalToken(tx, uID, name, scopes, body.ExpiresAt)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// personalTokenScopes checks requested scopes and returns them sorted
+// without duplicates.
+func personalTokenScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, errors.New("Invalid scope!")
+	}
+	for _, scope := range requested {
+		if !slices.Contains(PersonalTokenScopes, scope) {
+			return nil, errors.New("Invalid scope!")
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(requested))), nil
+}
+
+// insertPersonalToken issues a token for uID. The token itself is only
+// returned here; the database keeps its prefix and keyed hash.
+func insertPersonalToken(tx *sqlx.Tx, uID string, name string, scopes []string, expiresAt time.Time) (models.UCreatedPersonalToken, error) {
+	var data models.UCreatedPersonalToken
+	secret, _, _, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	token := personalTokenPrefix + secret
+	hash, err := HashToken(token)
+	if err != nil {
+		return data, err
+	}
+
+	err = tx.Get(&data.UPersonalToken, `INSERT INTO auth.personal_tokens (user_id, name, token_prefix, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, name, scopes, expires_at, last_used_at, last_used_ip, created_at`,
+		uID, name, TokenPrefix(token), hash, pq.StringArray(scopes), expiresAt)
+	if err != nil {
+		return data, err
+	}
+
+	data.Token = token
+	return data, nil
+}
+
+func RevokePersonalToken(uID string, tokenID string) error {
+	db := DB
+	var err error
+
+	if _, err = uuid.Parse(tokenID); err != nil {
+		err = errors.New("Token doesn't exist!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.Exec("delete from auth.personal_tokens where id = $1 and user_id = $2", tokenID, uID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = errors.New("Token doesn't exist!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// AuthenticatePersonalToken returns the owner and scopes of a valid token and
+// records ip as its last use.
+func AuthenticatePersonalToken(token string, ip string) (string, []string, error) {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var tokens []models.PersonalToken
+	err = tx.Select(&tokens, `select t.* from auth.personal_tokens t join auth.users u on u.id = t.user_id
+		where t.token_prefix = $1 and t.expires_at > now() and coalesce(u.active, true)`, TokenPrefix(token))
+	if err != nil {
+		return "", nil, err
+	}
+	var match *models.PersonalToken
+	for i := range tokens {
+		if TokenMatches(token, tokens[i].TokenHash) {
+			match = &tokens[i]
+		}
+	}
+	if match == nil {
+		err = errors.New("Invalid token!")
+		return "", nil, err
+	}
+
+	_, err = tx.Exec("update auth.personal_tokens set last_used_at = now(), last_used_ip = $1 where id = $2", ip, match.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return "", nil, err
+	}
+
+	return match.UserID, match.Scopes, err
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+const maxNameLength = 100
+const maxPreferencesSize = 16 * 1024
+
+// UpdateMe changes the names and preferences of uID. Fields left out of the
+// request keep their value; preferences are replaced as a whole.
+func UpdateMe(uID string, body models.RUpdateMe) (models.UUser, error) {
+	db := DB
+	var err error
+	var data models.UUser
+
+	var firstName, lastName *string
+	if body.FirstName != nil {
+		name := strings.TrimSpace(*body.FirstName)
+		if name == "" || len(name) > maxNameLength {
+			err = errors.New("Invalid name!")
+			return data, err
+		}
+		firstName = &name
+	}
+	if body.LastName != nil {
+		name := strings.TrimSpace(*body.LastName)
+		if name == "" || len(name) > maxNameLength {
+			err = errors.New("Invalid name!")
+			return data, err
+		}
+		lastName = &name
+	}
+	var preferences *string
+	if body.Preferences != nil {
+		var object map[string]any
+		if len(body.Preferences) > maxPreferencesSize || json.Unmarshal(body.Preferences, &object) != nil || object == nil {
+			err = errors.New("Invalid preferences!")
+			return data, err
+		}
+		encoded := string(body.Preferences)
+		preferences = &encoded
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`update auth.users set firstname = coalesce($1, firstname), lastname = coalesce($2, lastname),
+		preferences = coalesce($3::jsonb, preferences), updated_at = now() where id = $4`, firstName, lastName, preferences, uID)
+	if err != nil {
+		return data, err
+	}
+	data, err = userProfile(tx, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// RequestEmailChange stores newEmail as pending and mails a confirmation link
+// to it. The address only changes once the link is opened.
+func RequestEmailChange(uID string, body models.RChangeEmail) error {
+	db := DB
+	var err error
+
+	encEmail, err := encryptEmail(body.NewEmail)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var users []models.User
+	err = tx.Select(&users, "select id, email, password, coalesce(organization::text, '') as organization from auth.users where id = $1 for update", uID)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 {
+		err = errors.New("User doesn't exist!")
+		return err
+	}
+	// Directory and SSO users get their address from the identity provider.
+	if users[0].Password == "" {
+		err = errors.New("Email managed by identity provider!")
+		return err
+	}
+	match, _, err := VerifyPassword(body.CurrentPassword, users[0].Password)
+	if err != nil {
+		return err
+	}
+	if !match {
+		err = errors.New("Invalid password!")
+		return err
+	}
+	err = checkOrganizationEmail(tx, users[0].OrganizationID, body.NewEmail)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	err = tx.Select(&ids, "select id from auth.users where email_index = $1", encEmail.Index)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		err = errors.New("User already exists!")
+		return err
+	}
+
+	_, err = tx.Exec("update auth.users set pending_email = $1, updated_at = now() where id = $2", encEmail.Value, uID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	token, err := newEmailToken(emailChangePurpose, uID, body.NewEmail)
+	if err != nil {
+		return err
+	}
+	link := GetEnvDefault("PUBLIC_URL", "http://localhost:3000") + "/auth/me/email/confirm?token=" + url.QueryEscape(token)
+	err = GetMailer().Send(Mail{
+		To:      body.NewEmail,
+		Subject: "Confirm your new email address",
+		Body: "Please confirm that this is your new email address by opening the link below.\n\n" + link +
+			"\n\nThe link expires in " + emailVerificationLifetime().String() + ". Until then your account keeps its current address.\n",
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tell the current address too, in case someone else asked for the change.
+	if oldEmail, decErr := Decrypt(users[0].Email); decErr == nil {
+		mailErr := GetMailer().Send(Mail{
+			To:      oldEmail,
+			Subject: "Your email address is being changed",
+			Body:    "Someone asked to change the email address of your account to " + body.NewEmail + ". If this wasn't you, change your password.\n",
+		})
+		if mailErr != nil {
+			log.Printf("Sending email change notice failed: %v", mailErr)
+		}
+	}
+	return err
+}
+
+// ConfirmEmailChange makes the pending address the user's email.
+func ConfirmEmailChange(token string) error {
+	db := DB
+	var err error
+
+	claims, err := parseEmailToken(emailChangePurpose, token)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var pending []string
+	err = tx.Select(&pending, "select coalesce(pending_email, '') from auth.users where id = $1 for update", claims.Subject)
+	if err != nil {
+		return err
+	}
+	if len(pending) != 1 || pending[0] == "" {
+		err = errors.New("Invalid or expired token!")
+		return err
+	}
+	newEmail, err := Decrypt(pending[0])
+	if err != nil {
+		return err
+	}
+	if !TokenMatches(newEmail, claims.EmailHash) {
+		err = errors.New("Invalid or expired token!")
+		return err
+	}
+	encEmail, err := encryptEmail(newEmail)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	err = tx.Select(&ids, "select id from auth.users where email_index = $1", encEmail.Index)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		err = errors.New("User already exists!")
+		return err
+	}
+
+	_, err = tx.Exec(`update auth.users set email = $1, email_index = $2, email_domain_index = $3, pending_email = null, verified = true, updated_at = now()
+		where id = $4`, encEmail.Value, encEmail.Index, encEmail.DomainIndex, claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
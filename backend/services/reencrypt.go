@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// encryptedColumn is a column holding values from Encrypt, keyed by ID.
+type encryptedColumn struct {
+	Table  string
+	Column string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{Table: "auth.users", Column: "email"},
+	{Table: "auth.users", Column: "pending_email"},
+	{Table: "auth.users", Column: "mfa_secret"},
+	{Table: "auth.invitations", Column: "email"},
+	{Table: "auth.organizations", Column: "sso_client_secret"},
+	{Table: "auth.organizations", Column: "ldap_bind_password"},
+	{Table: "auth.signing_keys", Column: "private_key"},
+}
+
+func reencryptBatchSize() int {
+	return int(envUint("REENCRYPT_BATCH_SIZE", 500, 16))
+}
+
+// staleCondition matches values of column not encrypted with the primary key.
+func (k *keyring) staleCondition(column string) string {
+	if k.primaryID == "" {
+		return fmt.Sprintf("coalesce(%s, '') <> '' and strpos(%s, '$') > 0", column, column)
+	}
+	return fmt.Sprintf("coalesce(%s, '') <> '' and not starts_with(%s, '%s$')", column, column, k.primaryID)
+}
+
+// ReencryptAll re-encrypts every encrypted column with the primary key while
+// the server keeps running. Each batch commits on its own and only values
+// under other keys are picked up, so an interrupted run just starts again.
+func ReencryptAll() error {
+	ring, err := getKeyring()
+	if err != nil {
+		return err
+	}
+	for _, col := range encryptedColumns {
+		if err = reencryptColumn(ring, col); err != nil {
+			return fmt.Errorf("%s.%s: %v", col.Table, col.Column, err)
+		}
+	}
+	return nil
+}
+
+func reencryptColumn(ring *keyring, col encryptedColumn) error {
+	db := DB
+	stale := ring.staleCondition(col.Column)
+
+	var total int
+	err := db.Get(&total, fmt.Sprintf("select count(*) from %s where %s", col.Table, stale))
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-encrypting %s.%s: %d values to go", col.Table, col.Column, total)
+
+	done := 0
+	for {
+		count, err := reencryptBatch(ring, col, stale)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+		done += count
+		log.Printf("Re-encrypting %s.%s: %d of %d done", col.Table, col.Column, done, max(total, done))
+	}
+
+	var left int
+	err = db.Get(&left, fmt.Sprintf("select count(*) from %s where %s", col.Table, stale))
+	if err != nil {
+		return err
+	}
+	if left > 0 {
+		log.Printf("Re-encrypting %s.%s: %d values were in use, run again to finish", col.Table, col.Column, left)
+	}
+	return nil
+}
+
+// reencryptBatch re-encrypts up to REENCRYPT_BATCH_SIZE values in one
+// transaction and returns how many it did.
+func reencryptBatch(ring *keyring, col encryptedColumn, stale string) (int, error) {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Rows locked by running requests are left for the next batch.
+	var rows []struct {
+		ID    string `db:"id"`
+		Value string `db:"value"`
+	}
+	err = tx.Select(&rows, fmt.Sprintf("select id, %s as value from %s where %s limit $1 for update skip locked",
+		col.Column, col.Table, stale), reencryptBatchSize())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		var plaintext string
+		plaintext, err = Decrypt(row.Value)
+		if err != nil {
+			return 0, err
+		}
+		var value string
+		value, err = encryptWith(ring.primaryID, ring.keys[ring.primaryID], plaintext)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(fmt.Sprintf("update %s set %s = $1 where id = $2", col.Table, col.Column), value, row.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return 0, err
+	}
+
+	return len(rows), err
+}
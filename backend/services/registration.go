@@ -0,0 +1,60 @@
+package services
+
+import (
+	"backend/models"
+	"errors"
+)
+
+const (
+	RegistrationClosed = "closed"
+	RegistrationInvite = "invite"
+	RegistrationDomain = "domain"
+)
+
+// registrationStrictness orders the modes from most to least open.
+var registrationStrictness = map[string]int{
+	RegistrationDomain: 0,
+	RegistrationInvite: 1,
+	RegistrationClosed: 2,
+}
+
+func deploymentRegistrationMode() string {
+	mode := GetEnvDefault("REGISTRATION_MODE", RegistrationDomain)
+	if _, ok := registrationStrictness[mode]; !ok {
+		return RegistrationClosed
+	}
+	return mode
+}
+
+// registrationMode is the stricter of the deployment's REGISTRATION_MODE and
+// the organization's registration_mode. Unknown values count as closed.
+func registrationMode(org models.Organization) string {
+	mode := deploymentRegistrationMode()
+	if org.RegistrationMode == "" {
+		return mode
+	}
+	orgStrictness, ok := registrationStrictness[org.RegistrationMode]
+	if !ok {
+		return RegistrationClosed
+	}
+	if orgStrictness > registrationStrictness[mode] {
+		return org.RegistrationMode
+	}
+	return mode
+}
+
+// checkSelfRegistration refuses sign-ups that the organization owning the
+// address doesn't accept from anyone with a matching domain.
+func checkSelfRegistration(org models.Organization, found bool) error {
+	if !found {
+		return errors.New("Registration closed!")
+	}
+	switch registrationMode(org) {
+	case RegistrationDomain:
+		return nil
+	case RegistrationInvite:
+		return errors.New("Registration by invitation only!")
+	default:
+		return errors.New("Registration closed!")
+	}
+}
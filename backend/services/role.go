@@ -10,8 +10,13 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
+const adminRoleName = "admin"
+const superAdminRoleName = "super_admin"
+const readOnlyRoleName = "read_only"
+
 const modelInsertString = "INSERT INTO auth.roles (id, name, description) VALUES ($1, $2, $3);"
 
 const upsertUserRoleQuery = `INSERT INTO auth.user_roles (user_id, role_id, created_at, updated_at) VALUES ($1, $2, $3, $3);`
@@ -244,3 +249,50 @@ func UnassignRole(body models.RAssignRole) error {
 	}
 	return err
 }
+
+// canManageUser reports whether adminID may act on targetID with permission:
+// holders of organizations:all on everyone, others on the users of their own
+// organization who can't manage users themselves.
+func canManageUser(tx *sqlx.Tx, adminID string, targetID string, permission string) error {
+	if _, err := uuid.Parse(targetID); err != nil {
+		return errors.New("User doesn't exist!")
+	}
+
+	allowed, err := userHasPermission(tx, adminID, permission)
+	if err != nil {
+		return err
+	}
+	allOrganizations, err := userHasPermission(tx, adminID, PermissionOrganizationsAll)
+	if err != nil {
+		return err
+	}
+
+	var orgs []string
+	err = tx.Select(&orgs, "select coalesce(organization::text, '') from auth.users where id = $1", targetID)
+	if err != nil {
+		return err
+	}
+	if !allowed || len(orgs) != 1 {
+		return errors.New("User doesn't exist!")
+	}
+	if allOrganizations {
+		return nil
+	}
+
+	var adminOrgs []string
+	err = tx.Select(&adminOrgs, "select coalesce(organization::text, '') from auth.users where id = $1", adminID)
+	if err != nil {
+		return err
+	}
+	if len(adminOrgs) != 1 || adminOrgs[0] == "" || adminOrgs[0] != orgs[0] {
+		return errors.New("User doesn't exist!")
+	}
+	privileged, err := userHasPermission(tx, targetID, PermissionUsersManage, PermissionOrganizationsAll)
+	if err != nil {
+		return err
+	}
+	if privileged {
+		return errors.New("Not allowed to manage this user!")
+	}
+	return nil
+}
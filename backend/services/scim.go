@@ -0,0 +1,1257 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// scimTokenPrefix marks SCIM tokens, like personalTokenPrefix does for
+// personal access tokens.
+const scimTokenPrefix = "zds_"
+
+const insertSCIMUserString = "INSERT INTO auth.users (id, email, email_index, email_domain_index, password, firstname, lastname, organization, type, verified, external_id) VALUES ($1, $2, $3, $4, '', $5, $6, $7, $8, true, nullif($9, ''));"
+
+const scimUserColumns = `id, email, coalesce(firstname, '') as firstname, coalesce(lastname, '') as lastname, external_id,
+	coalesce(active, true) as active, created_at, updated_at`
+
+// scimMembership is a role of a user, named after the role when listing a
+// user's groups and after the user when listing a group's members.
+type scimMembership struct {
+	UserID string `db:"user_id"`
+	RoleID string `db:"role_id"`
+	Name   string `db:"name"`
+}
+
+// SCIMMaxResults is the most resources one SCIM list returns.
+func SCIMMaxResults() int {
+	return int(envUint("SCIM_MAX_RESULTS", 100, 16))
+}
+
+func scimLocation(resourceType string, id string) string {
+	return GetEnvDefault("PUBLIC_URL", "http://localhost:3000") + "/scim/v2/" + resourceType + "/" + id
+}
+
+// scimPageBounds returns the offset and limit of the page asked for by
+// startIndex and count, which start at 1 and default to SCIM_MAX_RESULTS as
+// RFC 7644 defines.
+func scimPageBounds(query models.RSCIMList) (int, int) {
+	limit := SCIMMaxResults()
+	if query.Count != nil {
+		limit = min(max(*query.Count, 0), limit)
+	}
+	return max(query.StartIndex, 1) - 1, limit
+}
+
+// scimList answers a list request with page, a page of total resources.
+func scimList[T any](page []T, total int, query models.RSCIMList) models.SCIMListResponse {
+	data := models.SCIMListResponse{
+		Schemas:      []string{models.SCIMListResponseSchema},
+		TotalResults: total,
+		StartIndex:   max(query.StartIndex, 1),
+		Resources:    []any{},
+	}
+	for _, resource := range page {
+		data.Resources = append(data.Resources, resource)
+	}
+	data.ItemsPerPage = len(data.Resources)
+	return data
+}
+
+// scimPage returns the page of resources asked for by the query.
+func scimPage[T any](resources []T, query models.RSCIMList) models.SCIMListResponse {
+	offset, limit := scimPageBounds(query)
+	start := min(offset, len(resources))
+	return scimList(resources[start:min(start+limit, len(resources))], len(resources), query)
+}
+
+// scimSQLFilter turns filter into a condition for scimUsers or scimGroups,
+// numbering its arguments from next, if it only combines eq comparisons
+// with and and column has an SQL expression for every attribute. Other
+// filters are evaluated on the loaded resources.
+func scimSQLFilter(filter scimFilter, column func(attr string, value string) (string, any, bool, error), next int) (string, []any, bool, error) {
+	switch f := filter.(type) {
+	case nil:
+		return "", nil, true, nil
+	case scimComparison:
+		value, ok := f.value.(string)
+		if f.op != "eq" || f.sub != "" || !ok {
+			return "", nil, false, nil
+		}
+		expression, arg, ok, err := column(f.attr, value)
+		if err != nil || !ok {
+			return "", nil, false, err
+		}
+		return " and " + fmt.Sprintf(expression, next), []any{arg}, true, nil
+	case scimLogical:
+		if !f.and {
+			return "", nil, false, nil
+		}
+		left, leftArgs, ok, err := scimSQLFilter(f.left, column, next)
+		if err != nil || !ok {
+			return "", nil, false, err
+		}
+		right, rightArgs, ok, err := scimSQLFilter(f.right, column, next+len(leftArgs))
+		if err != nil || !ok {
+			return "", nil, false, err
+		}
+		return left + right, append(leftArgs, rightArgs...), true, nil
+	}
+	return "", nil, false, nil
+}
+
+// scimUserColumn answers the lookups identity providers make before
+// creating a user. userName goes through the email index, since emails are
+// encrypted.
+func scimUserColumn(attr string, value string) (string, any, bool, error) {
+	switch strings.ToLower(attr) {
+	case "username":
+		index, err := EmailIndex(value)
+		return "email_index = $%d", index, err == nil, err
+	case "externalid":
+		return "external_id = $%d", value, true, nil
+	case "id":
+		_, err := uuid.Parse(value)
+		return "id = $%d::uuid", value, err == nil, nil
+	}
+	return "", nil, false, nil
+}
+
+func scimGroupColumn(attr string, value string) (string, any, bool, error) {
+	switch strings.ToLower(attr) {
+	case "displayname":
+		return "lower(name) = lower($%d)", value, true, nil
+	case "id":
+		_, err := uuid.Parse(value)
+		return "id = $%d::uuid", value, err == nil, nil
+	}
+	return "", nil, false, nil
+}
+
+// scimPrivilegedPermissions are managed in Zendoc only. SCIM neither shows
+// nor changes users holding one of them, and roles granting one aren't
+// groups, so a SCIM token can't hand them out or take over their holders.
+var scimPrivilegedPermissions = []string{PermissionUsersManage, PermissionOrganizationsAll, PermissionUsersImpersonate, PermissionRolesAssign}
+
+// scimUnprivilegedUser is a condition on the user with the ID in column that
+// holds if none of their roles grants a permission of argument param.
+func scimUnprivilegedUser(column string, param int) string {
+	return fmt.Sprintf(` and not exists (select 1 from auth.user_roles sur join auth.role_permissions srp on srp.role_id = sur.role_id
+		join auth.permissions sp on sp.id = srp.permission_id where sur.user_id = %s and sp.name = any($%d))`, column, param)
+}
+
+// scimUnprivilegedRole is the same condition on the role with the ID in
+// column.
+func scimUnprivilegedRole(column string, param int) string {
+	return fmt.Sprintf(` and not exists (select 1 from auth.role_permissions srp join auth.permissions sp on sp.id = srp.permission_id
+		where srp.role_id = %s and sp.name = any($%d))`, column, param)
+}
+
+// checkSCIMManage refuses changes to uID that the creator of orgID's SCIM
+// token couldn't make as an admin. The token acts on their behalf, so it
+// stops changing users once they lose users:manage or are deleted.
+func checkSCIMManage(tx *sqlx.Tx, orgID string, uID string) error {
+	var creators []sql.NullString
+	err := tx.Select(&creators, "select created_by from auth.scim_tokens where organization_id = $1", orgID)
+	if err != nil {
+		return err
+	}
+	if len(creators) != 1 || !creators[0].Valid {
+		return errors.New("Not allowed to manage this user!")
+	}
+	err = canManageUser(tx, creators[0].String, uID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+	privileged, err := userHasPermission(tx, uID, scimPrivilegedPermissions...)
+	if err != nil {
+		return err
+	}
+	if privileged {
+		return errors.New("Not allowed to manage this user!")
+	}
+	return nil
+}
+
+func filterSCIM[T any](resources []T, filter scimFilter) ([]T, error) {
+	if filter == nil {
+		return resources, nil
+	}
+	matches := []T{}
+	for _, resource := range resources {
+		decoded, err := scimResource(resource)
+		if err != nil {
+			return nil, err
+		}
+		if filter.match(decoded) {
+			matches = append(matches, resource)
+		}
+	}
+	return matches, nil
+}
+
+// patchSCIM applies operations to current and decodes the result into
+// patched.
+func patchSCIM(current any, operations []models.SCIMPatchOperation, patched any) error {
+	resource, err := scimResource(current)
+	if err != nil {
+		return err
+	}
+	for _, operation := range operations {
+		err = applySCIMOperation(resource, operation)
+		if err != nil {
+			return err
+		}
+	}
+	// Some identity providers send booleans as "True" and "False".
+	key := scimKey(resource, "active")
+	if active, ok := resource[key].(string); ok {
+		resource[key], err = strconv.ParseBool(active)
+		if err != nil {
+			return errors.New("Invalid value!")
+		}
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, patched); err != nil {
+		return errors.New("Invalid value!")
+	}
+	return nil
+}
+
+func SCIMToken(adminID string, body models.RSCIMToken) (models.SCIMToken, error) {
+	db := DB
+	var err error
+	var data models.SCIMToken
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := adminOrganization(tx, adminID, body.Organization)
+	if err != nil {
+		return data, err
+	}
+	var tokens []models.SCIMToken
+	err = tx.Select(&tokens, "select * from auth.scim_tokens where organization_id = $1", org.ID)
+	if err != nil {
+		return data, err
+	}
+	if len(tokens) != 1 {
+		err = errors.New("SCIM token doesn't exist!")
+		return data, err
+	}
+	data = tokens[0]
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// CreateSCIMToken issues the SCIM token of the admin's organization,
+// replacing the previous one.
+func CreateSCIMToken(adminID string, body models.RSCIMToken) (models.UCreatedSCIMToken, error) {
+	db := DB
+	var err error
+	var data models.UCreatedSCIMToken
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := adminOrganization(tx, adminID, body.Organization)
+	if err != nil {
+		return data, err
+	}
+	secret, _, _, err := GenerateToken()
+	if err != nil {
+		return data, err
+	}
+	token := scimTokenPrefix + secret
+	hash, err := HashToken(token)
+	if err != nil {
+		return data, err
+	}
+
+	_, err = tx.Exec("delete from auth.scim_tokens where organization_id = $1", org.ID)
+	if err != nil {
+		return data, err
+	}
+	err = tx.Get(&data.SCIMToken, `INSERT INTO auth.scim_tokens (organization_id, token_prefix, token_hash, created_by)
+		VALUES ($1, $2, $3, $4) RETURNING *`, org.ID, TokenPrefix(token), hash, adminID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data.Token = token
+	return data, err
+}
+
+func RevokeSCIMToken(adminID string, body models.RSCIMToken) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := adminOrganization(tx, adminID, body.Organization)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("delete from auth.scim_tokens where organization_id = $1", org.ID)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		err = errors.New("SCIM token doesn't exist!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// AuthenticateSCIMToken returns the organization token belongs to.
+func AuthenticateSCIMToken(token string) (string, error) {
+	db := DB
+	var err error
+
+	if !strings.HasPrefix(token, scimTokenPrefix) {
+		return "", errors.New("Invalid token!")
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var tokens []models.SCIMToken
+	err = tx.Select(&tokens, "select * from auth.scim_tokens where token_prefix = $1", TokenPrefix(token))
+	if err != nil {
+		return "", err
+	}
+	var match *models.SCIMToken
+	for i := range tokens {
+		if TokenMatches(token, tokens[i].TokenHash) {
+			match = &tokens[i]
+		}
+	}
+	if match == nil {
+		err = errors.New("Invalid token!")
+		return "", err
+	}
+
+	_, err = tx.Exec("update auth.scim_tokens set last_used_at = now() where id = $1", match.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return "", err
+	}
+
+	return match.OrganizationID, err
+}
+
+// scimUsers loads the users of orgID matching condition, in which the
+// organization is $1, scimPrivilegedPermissions $2 and args follow, skipping offset of them
+// and returning at most limit, or all if limit is below 0.
+func scimUsers(tx *sqlx.Tx, orgID string, condition string, offset int, limit int, args ...any) ([]models.SCIMUser, error) {
+	query := "select " + scimUserColumns + " from auth.users where organization = $1" + scimUnprivilegedUser("auth.users.id", 2) +
+		condition + " order by created_at, id"
+	if limit >= 0 {
+		query += fmt.Sprintf(" limit %d offset %d", limit, offset)
+	}
+	var users []models.User
+	err := tx.Select(&users, query, append([]any{orgID, pq.Array(scimPrivilegedPermissions)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	var memberships []scimMembership
+	err = tx.Select(&memberships, `select ur.user_id, r.id as role_id, r.name from auth.user_roles ur join auth.roles r on r.id = ur.role_id
+		where ur.user_id = any($1::uuid[])`+scimUnprivilegedRole("r.id", 2)+` order by r.name`, pq.Array(ids), pq.Array(scimPrivilegedPermissions))
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]models.SCIMReference{}
+	for _, membership := range memberships {
+		groups[membership.UserID] = append(groups[membership.UserID], models.SCIMReference{
+			Value:   membership.RoleID,
+			Ref:     scimLocation("Groups", membership.RoleID),
+			Display: membership.Name,
+		})
+	}
+
+	data := []models.SCIMUser{}
+	for _, user := range users {
+		email, err := Decrypt(user.Email)
+		if err != nil {
+			return nil, err
+		}
+		active := user.Active
+		name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+		data = append(data, models.SCIMUser{
+			Schemas:     []string{models.SCIMUserSchema},
+			ID:          user.ID,
+			ExternalID:  user.ExternalID.String,
+			UserName:    email,
+			Name:        models.SCIMName{Formatted: name, GivenName: user.FirstName, FamilyName: user.LastName},
+			DisplayName: name,
+			Emails:      []models.SCIMEmail{{Value: email, Type: "work", Primary: true}},
+			Active:      &active,
+			Groups:      groups[user.ID],
+			Meta: &models.SCIMMeta{
+				ResourceType: "User",
+				Created:      user.CreatedAt.UTC(),
+				LastModified: user.UpdatedAt.UTC(),
+				Location:     scimLocation("Users", user.ID),
+			},
+		})
+	}
+	return data, nil
+}
+
+func scimUser(tx *sqlx.Tx, orgID string, uID string) (models.SCIMUser, error) {
+	if _, err := uuid.Parse(uID); err != nil {
+		return models.SCIMUser{}, errors.New("User doesn't exist!")
+	}
+	users, err := scimUsers(tx, orgID, " and id = $3", 0, 1, uID)
+	if err != nil {
+		return models.SCIMUser{}, err
+	}
+	if len(users) != 1 {
+		return models.SCIMUser{}, errors.New("User doesn't exist!")
+	}
+	return users[0], nil
+}
+
+// scimEmail encrypts the userName of uID, which has to be an unused address
+// in one of org's domains.
+func scimEmail(tx *sqlx.Tx, org models.Organization, uID string, userName string) (encryptedEmail, error) {
+	encEmail, err := encryptEmail(userName)
+	if err != nil {
+		return encryptedEmail{}, err
+	}
+	if !organizationOwnsEmail(org, userName) {
+		return encryptedEmail{}, errors.New("Email domain not allowed for this organization!")
+	}
+	var ids []string
+	err = tx.Select(&ids, "select id from auth.users where email_index = $1 and id <> $2", encEmail.Index, uID)
+	if err != nil {
+		return encryptedEmail{}, err
+	}
+	if len(ids) > 0 {
+		return encryptedEmail{}, errors.New("User already exists!")
+	}
+	return encEmail, nil
+}
+
+// checkSCIMUser validates the attributes of user that are stored.
+func checkSCIMUser(tx *sqlx.Tx, orgID string, uID string, user models.SCIMUser) error {
+	if len(user.Name.GivenName) > 100 || len(user.Name.FamilyName) > 100 || len(user.ExternalID) > 255 {
+		return errors.New("Invalid value!")
+	}
+	if user.ExternalID == "" {
+		return nil
+	}
+	var ids []string
+	err := tx.Select(&ids, "select id from auth.users where organization = $1 and external_id = $2 and id <> $3", orgID, user.ExternalID, uID)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return errors.New("User already exists!")
+	}
+	return nil
+}
+
+// saveSCIMUser stores the changes from current to updated. Setting active to
+// false deactivates the user like an admin would. A new userName has to be
+// verified again, by the next SSO login or a verification link, and ends
+// the user's sessions and tokens.
+func saveSCIMUser(tx *sqlx.Tx, orgID string, current models.SCIMUser, updated models.SCIMUser) error {
+	err := checkSCIMManage(tx, orgID, current.ID)
+	if err != nil {
+		return err
+	}
+	err = checkSCIMUser(tx, orgID, current.ID, updated)
+	if err != nil {
+		return err
+	}
+	if updated.UserName != current.UserName {
+		org, err := getOrganization(tx, orgID)
+		if err != nil {
+			return err
+		}
+		encEmail, err := scimEmail(tx, org, current.ID, updated.UserName)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`update auth.users set email = $1, email_index = $2, email_domain_index = $3, pending_email = null, verified = false
+			where id = $4`, encEmail.Value, encEmail.Index, encEmail.DomainIndex, current.ID)
+		if err != nil {
+			return err
+		}
+		err = revokeCredentials(tx, current.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("update auth.users set firstname = $1, lastname = $2, external_id = nullif($3, ''), updated_at = now() where id = $4",
+		updated.Name.GivenName, updated.Name.FamilyName, updated.ExternalID, current.ID)
+	if err != nil {
+		return err
+	}
+
+	if updated.Active == nil || *updated.Active == *current.Active {
+		return nil
+	}
+	if *updated.Active {
+		_, err = tx.Exec("update auth.users set active = true where id = $1", current.ID)
+		return err
+	}
+	return deactivateUser(tx, current.ID)
+}
+
+// SCIMUsers lists the users of orgID that match the query's filter. Filters
+// the database can answer are paged there; others are evaluated on all users.
+func SCIMUsers(orgID string, query models.RSCIMList) (models.SCIMListResponse, error) {
+	db := DB
+	var err error
+	var data models.SCIMListResponse
+
+	var filter scimFilter
+	if query.Filter != "" {
+		filter, err = parseSCIMFilter(query.Filter)
+		if err != nil {
+			return data, err
+		}
+	}
+	condition, args, inSQL, err := scimSQLFilter(filter, scimUserColumn, 3)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var users []models.SCIMUser
+	if inSQL {
+		var total int
+		err = tx.Get(&total, "select count(*) from auth.users where organization = $1"+scimUnprivilegedUser("auth.users.id", 2)+condition,
+			append([]any{orgID, pq.Array(scimPrivilegedPermissions)}, args...)...)
+		if err != nil {
+			return data, err
+		}
+		offset, limit := scimPageBounds(query)
+		users, err = scimUsers(tx, orgID, condition, offset, limit, args...)
+		if err != nil {
+			return data, err
+		}
+		data = scimList(users, total, query)
+	} else {
+		users, err = scimUsers(tx, orgID, "", 0, -1)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	if !inSQL {
+		users, err = filterSCIM(users, filter)
+		if err != nil {
+			return data, err
+		}
+		data = scimPage(users, query)
+	}
+	return data, err
+}
+
+func SCIMUser(orgID string, uID string) (models.SCIMUser, error) {
+	db := DB
+	var err error
+	var data models.SCIMUser
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = scimUser(tx, orgID, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// CreateSCIMUser provisions a user into orgID. Like users from SSO, they
+// have no password and get the roles of their invitation or the default
+// role.
+func CreateSCIMUser(orgID string, body models.SCIMUser) (models.SCIMUser, error) {
+	db := DB
+	var err error
+	var data models.SCIMUser
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	org, err := getOrganization(tx, orgID)
+	if err != nil {
+		return data, err
+	}
+	userID := uuid.New().String()
+	encEmail, err := scimEmail(tx, org, userID, body.UserName)
+	if err != nil {
+		return data, err
+	}
+	err = checkSCIMUser(tx, org.ID, userID, body)
+	if err != nil {
+		return data, err
+	}
+
+	_, err = tx.Exec(insertSCIMUserString, userID, encEmail.Value, encEmail.Index, encEmail.DomainIndex,
+		body.Name.GivenName, body.Name.FamilyName, org.ID, organizationUserType, body.ExternalID)
+	if err != nil {
+		return data, err
+	}
+	err = checkSCIMManage(tx, org.ID, userID)
+	if err != nil {
+		return data, err
+	}
+	err = grantInitialRoles(tx, org.ID, encEmail.Index, userID)
+	if err != nil {
+		return data, err
+	}
+	if body.Active != nil && !*body.Active {
+		err = deactivateUser(tx, userID)
+		if err != nil {
+			return data, err
+		}
+	}
+	data, err = scimUser(tx, org.ID, userID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// ReplaceSCIMUser stores body as the new state of uID. A missing active
+// leaves the user's status alone.
+func ReplaceSCIMUser(orgID string, uID string, body models.SCIMUser) (models.SCIMUser, error) {
+	db := DB
+	var err error
+	var data models.SCIMUser
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	current, err := scimUser(tx, orgID, uID)
+	if err != nil {
+		return data, err
+	}
+	err = saveSCIMUser(tx, orgID, current, body)
+	if err != nil {
+		return data, err
+	}
+	data, err = scimUser(tx, orgID, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func PatchSCIMUser(orgID string, uID string, body models.SCIMPatch) (models.SCIMUser, error) {
+	db := DB
+	var err error
+	var data models.SCIMUser
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	current, err := scimUser(tx, orgID, uID)
+	if err != nil {
+		return data, err
+	}
+	var updated models.SCIMUser
+	err = patchSCIM(current, body.Operations, &updated)
+	if err != nil {
+		return data, err
+	}
+	err = saveSCIMUser(tx, orgID, current, updated)
+	if err != nil {
+		return data, err
+	}
+	data, err = scimUser(tx, orgID, uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// DeprovisionSCIMUser deactivates uID. Users are never deleted over SCIM,
+// so what they documented stays attributed to them.
+func DeprovisionSCIMUser(orgID string, uID string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = scimUser(tx, orgID, uID)
+	if err != nil {
+		return err
+	}
+	err = checkSCIMManage(tx, orgID, uID)
+	if err != nil {
+		return err
+	}
+	err = deactivateUser(tx, uID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// scimGroups loads the roles matching condition, in which
+// scimPrivilegedPermissions are $1 and args follow, with their members from
+// orgID, skipping offset of them and returning at most limit, or all if
+// limit is below 0.
+func scimGroups(tx *sqlx.Tx, orgID string, condition string, offset int, limit int, args ...any) ([]models.SCIMGroup, error) {
+	query := "select id, name, coalesce(description, '') as description, created_at, updated_at from auth.roles where true" +
+		scimUnprivilegedRole("auth.roles.id", 1) +
+		condition + " order by name"
+	if limit >= 0 {
+		query += fmt.Sprintf(" limit %d offset %d", limit, offset)
+	}
+	var roles []models.Role
+	err := tx.Select(&roles, query, append([]any{pq.Array(scimPrivilegedPermissions)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(roles))
+	for i, role := range roles {
+		ids[i] = role.ID
+	}
+	var memberships []scimMembership
+	err = tx.Select(&memberships, `select u.id as user_id, ur.role_id, trim(coalesce(u.firstname, '') || ' ' || coalesce(u.lastname, '')) as name
+		from auth.user_roles ur join auth.users u on u.id = ur.user_id
+		where u.organization = $1 and ur.role_id = any($2::uuid[])`+scimUnprivilegedUser("u.id", 3)+` order by u.created_at, u.id`,
+		orgID, pq.Array(ids), pq.Array(scimPrivilegedPermissions))
+	if err != nil {
+		return nil, err
+	}
+	members := map[string][]models.SCIMReference{}
+	for _, membership := range memberships {
+		members[membership.RoleID] = append(members[membership.RoleID], models.SCIMReference{
+			Value:   membership.UserID,
+			Ref:     scimLocation("Users", membership.UserID),
+			Display: membership.Name,
+		})
+	}
+
+	data := []models.SCIMGroup{}
+	for _, role := range roles {
+		data = append(data, models.SCIMGroup{
+			Schemas:     []string{models.SCIMGroupSchema},
+			ID:          role.ID,
+			DisplayName: role.Name,
+			Members:     append([]models.SCIMReference{}, members[role.ID]...),
+			Meta: &models.SCIMMeta{
+				ResourceType: "Group",
+				Created:      role.CreatedAt.UTC(),
+				LastModified: role.UpdatedAt.UTC(),
+				Location:     scimLocation("Groups", role.ID),
+			},
+		})
+	}
+	return data, nil
+}
+
+func scimGroup(tx *sqlx.Tx, orgID string, roleID string) (models.SCIMGroup, error) {
+	if _, err := uuid.Parse(roleID); err != nil {
+		return models.SCIMGroup{}, errors.New("Group doesn't exist!")
+	}
+	groups, err := scimGroups(tx, orgID, " and id = $2", 0, 1, roleID)
+	if err != nil {
+		return models.SCIMGroup{}, err
+	}
+	if len(groups) != 1 {
+		return models.SCIMGroup{}, errors.New("Group doesn't exist!")
+	}
+	return groups[0], nil
+}
+
+// saveSCIMGroup makes the members of orgID in current those of updated.
+// Roles are shared by all organizations, so their names can't change.
+func saveSCIMGroup(tx *sqlx.Tx, orgID string, current models.SCIMGroup, updated models.SCIMGroup) error {
+	if updated.DisplayName != current.DisplayName {
+		return errors.New("Group names are read-only!")
+	}
+
+	// Identity providers may list a member twice, and uuid.Parse accepts
+	// several spellings of the same ID.
+	ids := []string{}
+	seen := map[uuid.UUID]bool{}
+	for _, member := range updated.Members {
+		id, err := uuid.Parse(member.Value)
+		if err != nil {
+			return errors.New("Invalid value!")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id.String())
+		}
+	}
+	var found []string
+	err := tx.Select(&found, "select id from auth.users where organization = $1 and id = any($2::uuid[])"+scimUnprivilegedUser("auth.users.id", 3),
+		orgID, pq.Array(ids), pq.Array(scimPrivilegedPermissions))
+	if err != nil {
+		return err
+	}
+	if len(found) != len(ids) {
+		return errors.New("Invalid value!")
+	}
+
+	// Joining or leaving the group changes the member's roles, which the
+	// token's creator has to be allowed to do.
+	changed := map[string]bool{}
+	for _, id := range ids {
+		changed[id] = true
+	}
+	for _, member := range current.Members {
+		if changed[member.Value] {
+			delete(changed, member.Value)
+		} else {
+			changed[member.Value] = true
+		}
+	}
+	for id := range changed {
+		err = checkSCIMManage(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`delete from auth.user_roles ur using auth.users u where u.id = ur.user_id and u.organization = $1
+		and ur.role_id = $2 and not (ur.user_id = any($3::uuid[]))`+scimUnprivilegedUser("u.id", 4), orgID, current.ID, pq.Array(ids), pq.Array(scimPrivilegedPermissions))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) SELECT unnest($1::uuid[]), $2 ON CONFLICT DO NOTHING;", pq.Array(ids), current.ID)
+	return err
+}
+
+// SCIMGroups lists the roles that match the query's filter, paged like
+// SCIMUsers.
+func SCIMGroups(orgID string, query models.RSCIMList) (models.SCIMListResponse, error) {
+	db := DB
+	var err error
+	var data models.SCIMListResponse
+
+	var filter scimFilter
+	if query.Filter != "" {
+		filter, err = parseSCIMFilter(query.Filter)
+		if err != nil {
+			return data, err
+		}
+	}
+	condition, args, inSQL, err := scimSQLFilter(filter, scimGroupColumn, 2)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var groups []models.SCIMGroup
+	if inSQL {
+		var total int
+		err = tx.Get(&total, "select count(*) from auth.roles where true"+scimUnprivilegedRole("auth.roles.id", 1)+condition,
+			append([]any{pq.Array(scimPrivilegedPermissions)}, args...)...)
+		if err != nil {
+			return data, err
+		}
+		offset, limit := scimPageBounds(query)
+		groups, err = scimGroups(tx, orgID, condition, offset, limit, args...)
+		if err != nil {
+			return data, err
+		}
+		data = scimList(groups, total, query)
+	} else {
+		groups, err = scimGroups(tx, orgID, "", 0, -1)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	if !inSQL {
+		groups, err = filterSCIM(groups, filter)
+		if err != nil {
+			return data, err
+		}
+		data = scimPage(groups, query)
+	}
+	return data, err
+}
+
+func SCIMGroup(orgID string, roleID string) (models.SCIMGroup, error) {
+	db := DB
+	var err error
+	var data models.SCIMGroup
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = scimGroup(tx, orgID, roleID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func ReplaceSCIMGroup(orgID string, roleID string, body models.SCIMGroup) (models.SCIMGroup, error) {
+	db := DB
+	var err error
+	var data models.SCIMGroup
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	current, err := scimGroup(tx, orgID, roleID)
+	if err != nil {
+		return data, err
+	}
+	err = saveSCIMGroup(tx, orgID, current, body)
+	if err != nil {
+		return data, err
+	}
+	data, err = scimGroup(tx, orgID, roleID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func PatchSCIMGroup(orgID string, roleID string, body models.SCIMPatch) (models.SCIMGroup, error) {
+	db := DB
+	var err error
+	var data models.SCIMGroup
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	current, err := scimGroup(tx, orgID, roleID)
+	if err != nil {
+		return data, err
+	}
+	var updated models.SCIMGroup
+	err = patchSCIM(current, body.Operations, &updated)
+	if err != nil {
+		return data, err
+	}
+	err = saveSCIMGroup(tx, orgID, current, updated)
+	if err != nil {
+		return data, err
+	}
+	data, err = scimGroup(tx, orgID, roleID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
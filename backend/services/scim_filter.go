@@ -0,0 +1,571 @@
+package services
+
+import (
+	"backend/models"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SCIM filters (RFC 7644, section 3.4.2.2) and PATCH paths (section 3.5.2)
+// are evaluated on resources decoded into maps, the way they are sent.
+
+// scimCaseExact are the attributes compared case-sensitively; all other
+// strings are compared ignoring case.
+var scimCaseExact = []string{"id", "externalid"}
+
+type scimFilter interface {
+	match(resource map[string]any) bool
+}
+
+type scimLogical struct {
+	and         bool
+	left, right scimFilter
+}
+
+func (f scimLogical) match(resource map[string]any) bool {
+	if f.and {
+		return f.left.match(resource) && f.right.match(resource)
+	}
+	return f.left.match(resource) || f.right.match(resource)
+}
+
+type scimNot struct {
+	filter scimFilter
+}
+
+func (f scimNot) match(resource map[string]any) bool {
+	return !f.filter.match(resource)
+}
+
+// scimValueFilter matches if an element of a multi-valued attribute matches,
+// as in emails[type eq "work"].
+type scimValueFilter struct {
+	attr   string
+	filter scimFilter
+}
+
+func (f scimValueFilter) match(resource map[string]any) bool {
+	elements, _ := resource[scimKey(resource, f.attr)].([]any)
+	for _, element := range elements {
+		if object, ok := element.(map[string]any); ok && f.filter.match(object) {
+			return true
+		}
+	}
+	return false
+}
+
+type scimComparison struct {
+	attr, sub string
+	op        string
+	value     any
+}
+
+func (f scimComparison) match(resource map[string]any) bool {
+	values := scimAttributeValues(resource, f.attr, f.sub)
+	switch {
+	case f.op == "pr":
+		return len(values) > 0
+	case f.op == "ne":
+		return !scimComparison{attr: f.attr, sub: f.sub, op: "eq", value: f.value}.match(resource)
+	case f.value == nil:
+		return f.op == "eq" && len(values) == 0
+	}
+	caseExact := f.sub == "" && scimIsCaseExact(f.attr)
+	for _, value := range values {
+		if scimCompare(f.op, value, f.value, caseExact) {
+			return true
+		}
+	}
+	return false
+}
+
+func scimIsCaseExact(attr string) bool {
+	for _, name := range scimCaseExact {
+		if strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimKey returns the key of resource that matches name ignoring case, or
+// name if there is none, since SCIM attribute names are case-insensitive.
+func scimKey(resource map[string]any, name string) string {
+	if _, ok := resource[name]; ok {
+		return name
+	}
+	for key := range resource {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// scimAttributeValues returns the values of attr, or of its sub-attribute
+// sub. Elements of multi-valued attributes count by their "value" if no
+// sub-attribute is given.
+func scimAttributeValues(resource map[string]any, attr string, sub string) []any {
+	value := resource[scimKey(resource, attr)]
+	elements, ok := value.([]any)
+	if !ok {
+		elements = []any{value}
+	}
+	var values []any
+	for _, element := range elements {
+		if object, ok := element.(map[string]any); ok {
+			name := sub
+			if name == "" {
+				name = "value"
+			}
+			element = object[scimKey(object, name)]
+		} else if sub != "" {
+			continue
+		}
+		if element == nil || element == "" {
+			continue
+		}
+		values = append(values, element)
+	}
+	return values
+}
+
+func scimCompare(op string, actual any, expected any, caseExact bool) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			a, e = strings.ToLower(a), strings.ToLower(e)
+		}
+		switch op {
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		}
+		return scimOrdered(op, a, e)
+	case float64:
+		e, ok := expected.(float64)
+		return ok && scimOrdered(op, a, e)
+	case bool:
+		e, ok := expected.(bool)
+		return ok && op == "eq" && a == e
+	}
+	return false
+}
+
+func scimOrdered[T cmp.Ordered](op string, a T, e T) bool {
+	switch op {
+	case "eq":
+		return a == e
+	case "gt":
+		return a > e
+	case "ge":
+		return a >= e
+	case "lt":
+		return a < e
+	case "le":
+		return a <= e
+	}
+	return false
+}
+
+// scimAttrPath splits an attribute path into the attribute and its
+// sub-attribute, dropping a schema URN in front.
+func scimAttrPath(path string) (string, string) {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		path = path[strings.LastIndex(path, ":")+1:]
+	}
+	attr, sub, _ := strings.Cut(path, ".")
+	return attr, sub
+}
+
+func scimTokens(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, errors.New("Invalid filter!")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" \t()[]\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *scimFilterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *scimFilterParser) expect(token string) error {
+	if p.next() != token {
+		return errors.New("Invalid filter!")
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or() (scimFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = scimLogical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) and() (scimFilter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = scimLogical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) group() (scimFilter, error) {
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	return filter, p.expect(")")
+}
+
+func (p *scimFilterParser) unary() (scimFilter, error) {
+	token := p.next()
+	switch {
+	case strings.EqualFold(token, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		filter, err := p.group()
+		return scimNot{filter: filter}, err
+	case token == "(":
+		return p.group()
+	case token == "" || strings.ContainsAny(token[:1], "()[]\""):
+		return nil, errors.New("Invalid filter!")
+	}
+
+	attr, sub := scimAttrPath(token)
+	if p.peek() == "[" {
+		p.next()
+		filter, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return scimValueFilter{attr: attr, filter: filter}, p.expect("]")
+	}
+
+	op := strings.ToLower(p.next())
+	switch op {
+	case "pr":
+		return scimComparison{attr: attr, sub: sub, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, errors.New("Invalid filter!")
+	}
+	value, err := scimFilterValue(p.next())
+	if err != nil {
+		return nil, err
+	}
+	return scimComparison{attr: attr, sub: sub, op: op, value: value}, nil
+}
+
+func scimFilterValue(token string) (any, error) {
+	switch strings.ToLower(token) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if strings.HasPrefix(token, "\"") {
+		var value string
+		if err := json.Unmarshal([]byte(token), &value); err != nil {
+			return nil, errors.New("Invalid filter!")
+		}
+		return value, nil
+	}
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, errors.New("Invalid filter!")
+	}
+	return number, nil
+}
+
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scimTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	parsed, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errors.New("Invalid filter!")
+	}
+	return parsed, nil
+}
+
+// scimPath is a PATCH target: attr, optionally narrowed to the elements
+// matching filter, and optionally their sub-attribute sub.
+type scimPath struct {
+	attr   string
+	filter scimFilter
+	sub    string
+}
+
+func parseSCIMPath(path string) (scimPath, error) {
+	open := strings.Index(path, "[")
+	if open < 0 {
+		attr, sub := scimAttrPath(path)
+		if attr == "" {
+			return scimPath{}, errors.New("Invalid path!")
+		}
+		return scimPath{attr: attr, sub: sub}, nil
+	}
+	end := strings.LastIndex(path, "]")
+	if end < open {
+		return scimPath{}, errors.New("Invalid path!")
+	}
+	attr, sub := scimAttrPath(path[:open])
+	filter, err := parseSCIMFilter(path[open+1 : end])
+	if attr == "" || sub != "" || err != nil {
+		return scimPath{}, errors.New("Invalid path!")
+	}
+	rest := path[end+1:]
+	if rest != "" && !strings.HasPrefix(rest, ".") {
+		return scimPath{}, errors.New("Invalid path!")
+	}
+	return scimPath{attr: attr, filter: filter, sub: strings.TrimPrefix(rest, ".")}, nil
+}
+
+// applySCIMOperation applies one PATCH operation to resource.
+func applySCIMOperation(resource map[string]any, operation models.SCIMPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return errors.New("Invalid operation!")
+	}
+	if operation.Path == "" {
+		if op == "remove" {
+			return errors.New("No target!")
+		}
+		values, ok := operation.Value.(map[string]any)
+		if !ok {
+			return errors.New("Invalid value!")
+		}
+		for path, value := range values {
+			err := applySCIMOperation(resource, models.SCIMPatchOperation{Op: op, Path: path, Value: value})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path, err := parseSCIMPath(operation.Path)
+	if err != nil {
+		return err
+	}
+	key := scimKey(resource, path.attr)
+	if path.filter == nil {
+		if path.sub == "" {
+			return setSCIMAttribute(resource, key, op, operation.Value)
+		}
+		parent, ok := resource[key].(map[string]any)
+		if !ok {
+			if op == "remove" {
+				return nil
+			}
+			parent = map[string]any{}
+			resource[key] = parent
+		}
+		return setSCIMAttribute(parent, scimKey(parent, path.sub), op, operation.Value)
+	}
+
+	elements, _ := resource[key].([]any)
+	kept := []any{}
+	matched := false
+	for _, element := range elements {
+		object, ok := element.(map[string]any)
+		if !ok || !path.filter.match(object) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case path.sub != "":
+			err = setSCIMAttribute(object, scimKey(object, path.sub), op, operation.Value)
+			if err != nil {
+				return err
+			}
+		case op == "remove":
+			continue
+		default:
+			values, ok := operation.Value.(map[string]any)
+			if !ok {
+				return errors.New("Invalid value!")
+			}
+			if op == "replace" {
+				element = values
+				break
+			}
+			for name, value := range values {
+				object[scimKey(object, name)] = value
+			}
+		}
+		kept = append(kept, element)
+	}
+	if !matched && op != "remove" {
+		return errors.New("No target!")
+	}
+	resource[key] = kept
+	return nil
+}
+
+// setSCIMAttribute adds, replaces or removes object[key]. Adding to a
+// multi-valued attribute appends, and complex values are merged into the
+// existing ones, leaving unmentioned sub-attributes alone.
+func setSCIMAttribute(object map[string]any, key string, op string, value any) error {
+	existing := object[key]
+	if op == "remove" {
+		removed, isList := value.([]any)
+		elements, ok := existing.([]any)
+		if isList && ok {
+			object[key] = withoutSCIMValues(elements, removed)
+		} else {
+			delete(object, key)
+		}
+		return nil
+	}
+
+	if elements, ok := existing.([]any); ok && op == "add" {
+		added, ok := value.([]any)
+		if !ok {
+			added = []any{value}
+		}
+		for _, element := range added {
+			if len(withoutSCIMValues([]any{element}, elements)) > 0 {
+				elements = append(elements, element)
+			}
+		}
+		object[key] = elements
+		return nil
+	}
+	current, isObject := existing.(map[string]any)
+	values, ok := value.(map[string]any)
+	if isObject && ok {
+		for name, sub := range values {
+			current[scimKey(current, name)] = sub
+		}
+		return nil
+	}
+	if value == nil {
+		return errors.New("Invalid value!")
+	}
+	object[key] = value
+	return nil
+}
+
+// withoutSCIMValues drops the elements of removed from elements, comparing
+// complex values by their "value".
+func withoutSCIMValues(elements []any, removed []any) []any {
+	kept := []any{}
+	for _, element := range elements {
+		found := false
+		for _, other := range removed {
+			if scimSameValue(element, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, element)
+		}
+	}
+	return kept
+}
+
+func scimSameValue(a any, b any) bool {
+	objectA, okA := a.(map[string]any)
+	objectB, okB := b.(map[string]any)
+	if okA && okB {
+		valueA, hasA := objectA[scimKey(objectA, "value")]
+		valueB, hasB := objectB[scimKey(objectB, "value")]
+		if hasA && hasB {
+			return reflect.DeepEqual(valueA, valueB)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// scimResource decodes a resource into the map form patches work on.
+func scimResource(resource any) (map[string]any, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var decoded map[string]any
+	err = json.Unmarshal(data, &decoded)
+	return decoded, err
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"backend/models"
+	"reflect"
+	"testing"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	userName := scimComparison{attr: "userName", op: "eq", value: "alice@example.test"}
+	active := scimComparison{attr: "active", op: "eq", value: true}
+	external := scimComparison{attr: "externalId", op: "pr"}
+
+	tests := []struct {
+		filter string
+		want   scimFilter
+	}{
+		{filter: `userName eq "alice@example.test"`, want: userName},
+		{filter: `userName EQ "alice@example.test"`, want: userName},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice@example.test"`, want: userName},
+		{filter: `name.givenName sw "Al"`, want: scimComparison{attr: "name", sub: "givenName", op: "sw", value: "Al"}},
+		{filter: `title eq "say \"hi\""`, want: scimComparison{attr: "title", op: "eq", value: `say "hi"`}},
+		{filter: `meta.version gt 2.5`, want: scimComparison{attr: "meta", sub: "version", op: "gt", value: 2.5}},
+		{filter: `manager eq null`, want: scimComparison{attr: "manager", op: "eq"}},
+		{filter: `externalId pr`, want: external},
+		// and binds tighter than or, and both associate to the left.
+		{
+			filter: `externalId pr or userName eq "alice@example.test" and active eq true`,
+			want:   scimLogical{left: external, right: scimLogical{and: true, left: userName, right: active}},
+		},
+		{
+			filter: `userName eq "alice@example.test" and active eq true or externalId pr`,
+			want:   scimLogical{left: scimLogical{and: true, left: userName, right: active}, right: external},
+		},
+		{
+			filter: `(externalId pr or userName eq "alice@example.test") and active eq true`,
+			want:   scimLogical{and: true, left: scimLogical{left: external, right: userName}, right: active},
+		},
+		{
+			filter: `externalId pr AND active eq true and userName eq "alice@example.test"`,
+			want:   scimLogical{and: true, left: scimLogical{and: true, left: external, right: active}, right: userName},
+		},
+		{
+			filter: `not (externalId pr) and active eq true`,
+			want:   scimLogical{and: true, left: scimNot{filter: external}, right: active},
+		},
+		{
+			filter: `emails[type eq "work" and value co "@example.test"]`,
+			want: scimValueFilter{attr: "emails", filter: scimLogical{
+				and:   true,
+				left:  scimComparison{attr: "type", op: "eq", value: "work"},
+				right: scimComparison{attr: "value", op: "co", value: "@example.test"},
+			}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseSCIMFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseSCIMFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSCIMFilter(%q) = %#v, want %#v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParseSCIMFilterMalformed(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName like "alice"`,
+		`userName eq "alice`,
+		`userName eq alice`,
+		`userName eq "alice" "bob"`,
+		`userName eq "alice" and`,
+		`and userName eq "alice"`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`not userName eq "alice"`,
+		`emails[type eq "work"`,
+		`emails[type eq "work"]]`,
+		`"userName" eq "alice"`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil || err.Error() != "Invalid filter!" {
+			t.Errorf("parseSCIMFilter(%q) = %v, want Invalid filter!", filter, err)
+		}
+	}
+}
+
+func TestSCIMFilterMatch(t *testing.T) {
+	user, err := scimResource(models.SCIMUser{
+		ID:         "2819c223-7f76-453a-919d-413861904646",
+		ExternalID: "Alice-1",
+		UserName:   "Alice@Example.test",
+		Name:       models.SCIMName{GivenName: "Alice", FamilyName: "Smith"},
+		Emails:     []models.SCIMEmail{{Value: "Alice@Example.test", Type: "work", Primary: true}},
+		Active:     new(bool),
+	})
+	if err != nil {
+		t.Fatalf("decoding user: %v", err)
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "alice@example.test"`, true},
+		{`USERNAME eq "ALICE@EXAMPLE.TEST"`, true},
+		{`userName ne "alice@example.test"`, false},
+		{`userName co "example"`, true},
+		{`userName sw "bob"`, false},
+		{`userName ew ".test"`, true},
+		{`userName gt "aardvark"`, true},
+		{`userName lt "aardvark"`, false},
+		// id and externalId are compared case-sensitively.
+		{`externalId eq "Alice-1"`, true},
+		{`externalId eq "alice-1"`, false},
+		{`name.familyName eq "smith"`, true},
+		{`name.middleName pr`, false},
+		{`name.middleName eq null`, true},
+		{`active eq false`, true},
+		{`active eq "false"`, false},
+		{`emails[type eq "work" and primary eq true]`, true},
+		{`emails[type eq "home"]`, false},
+		{`emails.value ew "example.test"`, true},
+		{`emails co "alice"`, true},
+		// Attributes the resource doesn't have never match.
+		{`nickName eq "ally"`, false},
+		{`nickName pr`, false},
+		{`not (nickName pr)`, true},
+		{`nickName gt 3`, false},
+		// With and binding first this is true or (false and false).
+		{`userName eq "alice@example.test" or userName eq "bob@example.test" and active eq true`, true},
+		{`(userName eq "alice@example.test" or userName eq "bob@example.test") and active eq true`, false},
+		{`not (userName eq "bob@example.test") and active eq false`, true},
+	}
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseSCIMFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if got := filter.match(user); got != test.want {
+			t.Errorf("%q matched %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestSCIMSQLFilter(t *testing.T) {
+	const roleID = "2819c223-7f76-453a-919d-413861904646"
+
+	tests := []struct {
+		filter    string
+		condition string
+		args      []any
+		inSQL     bool
+	}{
+		{filter: `displayName eq "admin"`, condition: " and lower(name) = lower($2)", args: []any{"admin"}, inSQL: true},
+		{
+			filter:    `displayName eq "admin" and id eq "` + roleID + `"`,
+			condition: " and lower(name) = lower($2) and id = $3::uuid",
+			args:      []any{"admin", roleID},
+			inSQL:     true,
+		},
+		{filter: `DISPLAYNAME eq "admin"`, condition: " and lower(name) = lower($2)", args: []any{"admin"}, inSQL: true},
+		{filter: `displayName eq "admin" or displayName eq "user"`},
+		{filter: `displayName co "adm"`},
+		{filter: `not (displayName eq "admin")`},
+		{filter: `members[value eq "` + roleID + `"]`},
+		{filter: `members.value eq "` + roleID + `"`},
+		{filter: `displayName eq null`},
+		{filter: `id eq "not-a-uuid"`},
+		// Attributes without a column are left to the in-memory filter.
+		{filter: `externalId eq "admins"`},
+		{filter: `displayName eq "admin" and externalId eq "admins"`},
+	}
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseSCIMFilter(%q): %v", test.filter, err)
+			continue
+		}
+		condition, args, inSQL, err := scimSQLFilter(filter, scimGroupColumn, 2)
+		if err != nil {
+			t.Errorf("scimSQLFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if inSQL != test.inSQL || condition != test.condition || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("scimSQLFilter(%q) = %q, %v, %v, want %q, %v, %v",
+				test.filter, condition, args, inSQL, test.condition, test.args, test.inSQL)
+		}
+	}
+
+	condition, args, inSQL, err := scimSQLFilter(nil, scimGroupColumn, 2)
+	if err != nil || condition != "" || args != nil || !inSQL {
+		t.Errorf("scimSQLFilter(nil) = %q, %v, %v, %v, want an empty condition", condition, args, inSQL, err)
+	}
+}
+
+func TestParseSCIMPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		attr   string
+		sub    string
+		filter bool
+	}{
+		{path: "active", attr: "active"},
+		{path: "name.givenName", attr: "name", sub: "givenName"},
+		{path: "urn:ietf:params:scim:schemas:core:2.0:User:name.givenName", attr: "name", sub: "givenName"},
+		{path: `members[value eq "1"]`, attr: "members", filter: true},
+		{path: `emails[type eq "work"].value`, attr: "emails", sub: "value", filter: true},
+	}
+	for _, test := range tests {
+		got, err := parseSCIMPath(test.path)
+		if err != nil {
+			t.Errorf("parseSCIMPath(%q): %v", test.path, err)
+			continue
+		}
+		if got.attr != test.attr || got.sub != test.sub || (got.filter != nil) != test.filter {
+			t.Errorf("parseSCIMPath(%q) = %+v, want %v.%v with filter %v", test.path, got, test.attr, test.sub, test.filter)
+		}
+	}
+
+	for _, path := range []string{
+		``,
+		`.givenName`,
+		`members[value eq "1"`,
+		`members]value eq "1"[`,
+		`members[value eq "1"]value`,
+		`name.givenName[value eq "1"]`,
+		`members[value]`,
+		`[value eq "1"]`,
+	} {
+		if _, err := parseSCIMPath(path); err == nil || err.Error() != "Invalid path!" {
+			t.Errorf("parseSCIMPath(%q) = %v, want Invalid path!", path, err)
+		}
+	}
+}
+
+func TestApplySCIMOperation(t *testing.T) {
+	group := func() map[string]any {
+		return map[string]any{
+			"displayName": "admin",
+			"members": []any{
+				map[string]any{"value": "1", "display": "Alice"},
+				map[string]any{"value": "2", "display": "Bob"},
+			},
+			"name": map[string]any{"givenName": "Alice", "familyName": "Smith"},
+		}
+	}
+	members := func(values ...string) []any {
+		names := map[string]string{"1": "Alice", "2": "Bob", "3": "Carol"}
+		list := []any{}
+		for _, value := range values {
+			list = append(list, map[string]any{"value": value, "display": names[value]})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name      string
+		operation models.SCIMPatchOperation
+		attr      string
+		want      any
+		err       string
+	}{
+		{
+			name:      "add member",
+			operation: models.SCIMPatchOperation{Op: "add", Path: "members", Value: []any{map[string]any{"value": "3", "display": "Carol"}}},
+			attr:      "members",
+			want:      members("1", "2", "3"),
+		},
+		{
+			name:      "add existing member",
+			operation: models.SCIMPatchOperation{Op: "Add", Path: "members", Value: []any{map[string]any{"value": "1", "display": "Alice"}}},
+			attr:      "members",
+			want:      members("1", "2"),
+		},
+		{
+			name:      "remove filtered member",
+			operation: models.SCIMPatchOperation{Op: "remove", Path: `members[value eq "2"]`},
+			attr:      "members",
+			want:      members("1"),
+		},
+		{
+			name:      "remove listed member",
+			operation: models.SCIMPatchOperation{Op: "remove", Path: "members", Value: []any{map[string]any{"value": "1"}}},
+			attr:      "members",
+			want:      members("2"),
+		},
+		{
+			name:      "replace sub-attribute",
+			operation: models.SCIMPatchOperation{Op: "replace", Path: "name.givenName", Value: "Alicia"},
+			attr:      "name",
+			want:      map[string]any{"givenName": "Alicia", "familyName": "Smith"},
+		},
+		{
+			name:      "replace without path merges",
+			operation: models.SCIMPatchOperation{Op: "replace", Value: map[string]any{"NAME": map[string]any{"familyName": "Jones"}}},
+			attr:      "name",
+			want:      map[string]any{"givenName": "Alice", "familyName": "Jones"},
+		},
+		{
+			name:      "replace sub-attribute of filtered member",
+			operation: models.SCIMPatchOperation{Op: "replace", Path: `members[value eq "2"].display`, Value: "Robert"},
+			attr:      "members",
+			want:      []any{map[string]any{"value": "1", "display": "Alice"}, map[string]any{"value": "2", "display": "Robert"}},
+		},
+		{
+			name:      "unknown operation",
+			operation: models.SCIMPatchOperation{Op: "move", Path: "members"},
+			err:       "Invalid operation!",
+		},
+		{
+			name:      "remove without path",
+			operation: models.SCIMPatchOperation{Op: "remove"},
+			err:       "No target!",
+		},
+		{
+			name:      "replace unmatched filter",
+			operation: models.SCIMPatchOperation{Op: "replace", Path: `members[value eq "9"].display`, Value: "Nobody"},
+			err:       "No target!",
+		},
+		{
+			name:      "add without path or object",
+			operation: models.SCIMPatchOperation{Op: "add", Value: "admin"},
+			err:       "Invalid value!",
+		},
+		{
+			name:      "replace with null",
+			operation: models.SCIMPatchOperation{Op: "replace", Path: "displayName"},
+			err:       "Invalid value!",
+		},
+		{
+			name:      "malformed path",
+			operation: models.SCIMPatchOperation{Op: "replace", Path: `members[value eq "1"`, Value: "x"},
+			err:       "Invalid path!",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resource := group()
+			err := applySCIMOperation(resource, test.operation)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applySCIMOperation: %v", err)
+			}
+			if !reflect.DeepEqual(resource[test.attr], test.want) {
+				t.Errorf("%v = %#v, want %#v", test.attr, resource[test.attr], test.want)
+			}
+		})
+	}
+}
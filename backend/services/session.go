@@ -0,0 +1,419 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(GetEnvDefault(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// SessionLifetime is how long a session lives after login, no matter how
+// active it is.
+func SessionLifetime() time.Duration {
+	return envDuration("SESSION_LIFETIME", 7*24*time.Hour)
+}
+
+// SessionIdleTimeout ends sessions that haven't been used for that long. Each
+// request pushes the deadline back, up to SessionLifetime.
+func SessionIdleTimeout() time.Duration {
+	return envDuration("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+}
+
+// ReapSessions deletes the sessions that expired or went idle.
+func ReapSessions() (int64, error) {
+	db := DB
+	var err error
+	var data int64
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.Exec("delete from auth.sessions where expires_at <= now() or last_seen_at <= now() - $1 * interval '1 second'",
+		int64(SessionIdleTimeout().Seconds()))
+	if err != nil {
+		return data, err
+	}
+	data, err = res.RowsAffected()
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// StartSessionReaper runs ReapSessions in the background every
+// SESSION_REAPER_INTERVAL.
+func StartSessionReaper() {
+	interval := envDuration("SESSION_REAPER_INTERVAL", time.Hour)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			reaped, err := ReapSessions()
+			if err != nil {
+				log.Printf("Session reaper failed: %v", err)
+			} else if reaped > 0 {
+				log.Printf("Session reaper removed %d sessions", reaped)
+			}
+			if err := GetLimiterStore().Prune(loginFailureWindow()); err != nil {
+				log.Printf("Pruning login throttles failed: %v", err)
+			}
+			if err := PruneDeviceCodes(); err != nil {
+				log.Printf("Pruning device codes failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// revokedSessions maps the sessions this instance revoked to when. Their
+// access tokens issued before are refused until they expire; other instances
+// refuse the session at its next refresh, within ACCESS_TOKEN_LIFETIME.
+var revokedSessions = map[string]time.Time{}
+var revokedSessionsMu sync.Mutex
+
+// denySessions refuses the access tokens issued so far for sessionIDs. It is
+// called before the revocation commits: should that fail, the next refresh
+// issues a token that is accepted again.
+func denySessions(sessionIDs ...string) {
+	now := time.Now()
+	revokedSessionsMu.Lock()
+	defer revokedSessionsMu.Unlock()
+	for id, revokedAt := range revokedSessions {
+		if now.Sub(revokedAt) > AccessTokenLifetime() {
+			delete(revokedSessions, id)
+		}
+	}
+	for _, id := range sessionIDs {
+		revokedSessions[id] = now
+	}
+}
+
+// SessionRevoked reports whether this instance revoked sessionID after its
+// access token was issued at issuedAt.
+func SessionRevoked(sessionID string, issuedAt time.Time) bool {
+	revokedSessionsMu.Lock()
+	defer revokedSessionsMu.Unlock()
+	revokedAt, ok := revokedSessions[sessionID]
+	return ok && !issuedAt.After(revokedAt)
+}
+
+// sessionByToken finds the session a refresh token belongs to by its prefix
+// and locks it. Only the keyed hash of the token is stored.
+func sessionByToken(tx *sqlx.Tx, token string) (models.Session, bool, error) {
+	var sessions []models.Session
+	err := tx.Select(&sessions, "select id, user_id, token_hash, impersonator_id, expires_at, last_seen_at from auth.sessions where token_prefix = $1 for update", TokenPrefix(token))
+	if err != nil {
+		return models.Session{}, false, err
+	}
+	for _, session := range sessions {
+		if TokenMatches(token, session.TokenHash) {
+			return session, true, nil
+		}
+	}
+	return models.Session{}, false, nil
+}
+
+func listSessions(tx *sqlx.Tx, uID string, currentID string) ([]models.UActiveSession, error) {
+	data := []models.UActiveSession{}
+	err := tx.Select(&data, `select id, coalesce(user_agent, '') as user_agent, coalesce(host(ip), '') as ip, created_at,
+		last_seen_at, expires_at, id::text = $2 as current, impersonator_id
+		from auth.sessions where user_id = $1 and expires_at > now() and last_seen_at > now() - $3 * interval '1 second'
+		order by last_seen_at desc`, uID, currentID, int64(SessionIdleTimeout().Seconds()))
+	return data, err
+}
+
+func revokeSession(tx *sqlx.Tx, uID string, sessionID string) error {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return errors.New("Session doesn't exist!")
+	}
+	res, err := tx.Exec("delete from auth.sessions where id = $1 and user_id = $2", sessionID, uID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("Session doesn't exist!")
+	}
+	denySessions(sessionID)
+	return nil
+}
+
+// revokeSessions deletes every session of uID except exceptID, which may be
+// empty to delete them all.
+func revokeSessions(tx *sqlx.Tx, uID string, exceptID string) (int64, error) {
+	var ids []string
+	err := tx.Select(&ids, "delete from auth.sessions where user_id = $1 and id::text <> $2 returning id", uID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	denySessions(ids...)
+	return int64(len(ids)), nil
+}
+
+func Sessions(uID string, currentID string) ([]models.UActiveSession, error) {
+	db := DB
+	var err error
+	var data []models.UActiveSession
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = listSessions(tx, uID, currentID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func RevokeSession(uID string, sessionID string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = revokeSession(tx, uID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+func RevokeOtherSessions(uID string, currentID string) (int64, error) {
+	db := DB
+	var err error
+	var data int64
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = revokeSessions(tx, uID, currentID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func UserSessions(adminID string, targetID string) ([]models.UActiveSession, error) {
+	db := DB
+	var err error
+	var data []models.UActiveSession
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return data, err
+	}
+
+	data, err = listSessions(tx, targetID, "")
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func RevokeUserSession(adminID string, targetID string, sessionID string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+
+	err = revokeSession(tx, targetID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+func RevokeUserSessions(adminID string, targetID string) (int64, error) {
+	db := DB
+	var err error
+	var data int64
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return data, err
+	}
+
+	data, err = revokeSessions(tx, targetID, "")
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
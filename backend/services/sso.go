@@ -0,0 +1,170 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultRoleName = "user"
+const organizationUserType = "organization"
+const ssoRequestLifetime = 10 * time.Minute
+
+const insertSSOUserString = "INSERT INTO auth.users (id, email, email_index, email_domain_index, password, firstname, lastname, organization, type, verified) VALUES ($1, $2, $3, $4, '', $5, $6, $7, $8, true);"
+
+// FrontendURL is where browsers are sent after a redirect-based login.
+func FrontendURL() string {
+	return GetEnvDefault("FRONTEND_URL", "http://localhost:3000")
+}
+
+// provisionSSOUser returns the user an identity provider of org vouched for,
+// creating it on first sign-in. Names are kept in sync with the IdP.
+func provisionSSOUser(tx *sqlx.Tx, org models.Organization, email string, firstName string, lastName string) (string, error) {
+	if !organizationOwnsEmail(org, email) {
+		return "", errors.New("Email domain not allowed for this organization!")
+	}
+
+	encEmail, err := encryptEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	var users []models.User
+	err = tx.Select(&users, "select id, coalesce(organization::text, '') as organization from auth.users where email_index = $1", encEmail.Index)
+	if err != nil {
+		return "", err
+	}
+
+	if len(users) == 1 {
+		if users[0].OrganizationID != org.ID {
+			return "", errors.New("User belongs to another organization!")
+		}
+		_, err = tx.Exec(`update auth.users set firstname = coalesce(nullif($1, ''), firstname), lastname = coalesce(nullif($2, ''), lastname),
+			verified = true, updated_at = now() where id = $3`, firstName, lastName, users[0].ID)
+		if err != nil {
+			return "", err
+		}
+		return users[0].ID, nil
+	}
+
+	userID := uuid.New().String()
+	_, err = tx.Exec(insertSSOUserString, userID, encEmail.Value, encEmail.Index, encEmail.DomainIndex, firstName, lastName, org.ID, organizationUserType)
+	if err != nil {
+		return "", err
+	}
+
+	err = grantInitialRoles(tx, org.ID, encEmail.Index, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// grantInitialRoles gives a user provisioned into orgID the roles of their
+// open invitation, or the default role if they weren't invited.
+func grantInitialRoles(tx *sqlx.Tx, orgID string, emailIndex string, userID string) error {
+	invitation, invited, err := invitationForEmail(tx, orgID, emailIndex)
+	if err != nil {
+		return err
+	}
+	if invited {
+		return acceptInvitation(tx, invitation, userID)
+	}
+
+	var roles []string
+	err = tx.Select(&roles, "select id from auth.roles where name = $1", defaultRoleName)
+	if err != nil {
+		return err
+	}
+	if len(roles) != 1 {
+		return errors.New("Role doesn't exists!")
+	}
+	_, err = tx.Exec("INSERT INTO auth.user_roles (user_id, role_id) VALUES ($1, $2);", userID, roles[0])
+	return err
+}
+
+func loadSSOOrganization(orgID string) (models.Organization, error) {
+	db := DB
+	var err error
+	var data models.Organization
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data, err = getOrganization(tx, orgID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+// takeSSORequest consumes the pending request matching state, so a callback
+// can't be replayed.
+func takeSSORequest(orgID string, protocol string, state string) (models.SSORequest, error) {
+	db := DB
+	var err error
+	var data models.SSORequest
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var requests []models.SSORequest
+	err = tx.Select(&requests, "delete from auth.sso_requests where state = $1 and organization = $2 and protocol = $3 returning *", state, orgID, protocol)
+	if err != nil {
+		return data, err
+	}
+	if len(requests) != 1 || requests[0].ExpiresAt.Before(time.Now()) {
+		err = errors.New("Invalid or expired SSO request!")
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return requests[0], err
+}
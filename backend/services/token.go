@@ -0,0 +1,292 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const signingKeyAlgorithm = "RS256"
+const signingKeyBits = 2048
+
+// signingKeyReload bounds how often verification goes back to the database
+// for a key ID it doesn't know yet.
+const signingKeyReload = 10 * time.Second
+
+type signingKey struct {
+	ID        string
+	Key       *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// AccessClaims are carried by the access token in the session_token cookie.
+type AccessClaims struct {
+	SessionID string `json:"sid"`
+	// Impersonator is the super admin acting as Subject, if any.
+	Impersonator string `json:"imp,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// signingKeys holds the published keys, newest first.
+var signingKeys []signingKey
+var signingKeysLoadedAt time.Time
+var signingKeysMu sync.Mutex
+
+// AccessTokenLifetime is how long an access token is accepted before it has
+// to be refreshed. Sessions revoked on another instance, idle or deactivated
+// users are only noticed at the refresh, so it is kept short.
+func AccessTokenLifetime() time.Duration {
+	return envDuration("ACCESS_TOKEN_LIFETIME", 5*time.Minute)
+}
+
+func signingKeyRotation() time.Duration {
+	return envDuration("SIGNING_KEY_ROTATION", 30*24*time.Hour)
+}
+
+// signingKeyRetention is how long a key stays published after it was
+// created: its signing period plus the lifetime of the last token it signed.
+func signingKeyRetention() time.Duration {
+	return signingKeyRotation() + AccessTokenLifetime()
+}
+
+func tokenIssuer() string {
+	return GetEnvDefault("PUBLIC_URL", "http://localhost:3000")
+}
+
+// loadSigningKeys replaces the cached keys with those in auth.signing_keys.
+// The caller holds signingKeysMu.
+func loadSigningKeys() error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var rows []models.SigningKey
+	err = tx.Select(&rows, "select * from auth.signing_keys where algorithm = $1 and created_at > now() - $2 * interval '1 second' order by created_at desc",
+		signingKeyAlgorithm, int64(signingKeyRetention().Seconds()))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	keys := make([]signingKey, 0, len(rows))
+	for _, row := range rows {
+		var encoded string
+		encoded, err = Decrypt(row.PrivateKey)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			err = fmt.Errorf("signing key %s is not PEM encoded", row.ID)
+			return err
+		}
+		var parsed any
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			err = fmt.Errorf("signing key %s is not an RSA key", row.ID)
+			return err
+		}
+		keys = append(keys, signingKey{ID: row.ID, Key: key, CreatedAt: row.CreatedAt})
+	}
+
+	signingKeys = keys
+	signingKeysLoadedAt = time.Now()
+	return err
+}
+
+// rotateSigningKey stores a fresh key and drops those no longer published.
+// The caller holds signingKeysMu.
+func rotateSigningKey() error {
+	db := DB
+	var err error
+
+	key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	encKey, err := Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	if err != nil {
+		err = errors.New("Encryption failed!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("INSERT INTO auth.signing_keys (id, algorithm, private_key) VALUES ($1, $2, $3);", uuid.New().String(), signingKeyAlgorithm, encKey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from auth.signing_keys where created_at <= now() - $1 * interval '1 second'", int64(signingKeyRetention().Seconds()))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return loadSigningKeys()
+}
+
+// currentSigningKey returns the key new tokens are signed with, rotating it
+// once it is older than SIGNING_KEY_ROTATION.
+func currentSigningKey() (signingKey, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+
+	// Other instances may have rotated in the meantime.
+	if len(signingKeys) == 0 || time.Since(signingKeysLoadedAt) > time.Minute {
+		if err := loadSigningKeys(); err != nil {
+			return signingKey{}, err
+		}
+	}
+	if len(signingKeys) == 0 || time.Since(signingKeys[0].CreatedAt) > signingKeyRotation() {
+		if err := rotateSigningKey(); err != nil {
+			return signingKey{}, err
+		}
+	}
+	return signingKeys[0], nil
+}
+
+func verificationKey(kid string) (*rsa.PublicKey, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, key := range signingKeys {
+			if key.ID == kid {
+				return &key.Key.PublicKey, nil
+			}
+		}
+		if attempt > 0 || time.Since(signingKeysLoadedAt) < signingKeyReload {
+			break
+		}
+		if err := loadSigningKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func issueAccessToken(userID string, sessionID string, impersonatorID string) (string, time.Time, error) {
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenLifetime())
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, AccessClaims{
+		SessionID:    sessionID,
+		Impersonator: impersonatorID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer(),
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(key.Key)
+	return signed, expiresAt, err
+}
+
+// ParseAccessToken checks the signature and expiry of an access token. It
+// only needs the database when the token was signed by a key this instance
+// hasn't seen yet.
+func ParseAccessToken(accessToken string) (AccessClaims, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return verificationKey(kid)
+	}, jwt.WithValidMethods([]string{signingKeyAlgorithm}), jwt.WithIssuer(tokenIssuer()), jwt.WithExpirationRequired())
+	if err != nil {
+		return claims, errors.New("Invalid access token!")
+	}
+	if claims.Subject == "" || claims.SessionID == "" || claims.IssuedAt == nil {
+		return claims, errors.New("Invalid access token!")
+	}
+	return claims, nil
+}
+
+// JWKS lists the public halves of all published signing keys.
+func JWKS() (models.UJWKS, error) {
+	data := models.UJWKS{Keys: []models.UJWK{}}
+	if _, err := currentSigningKey(); err != nil {
+		return data, err
+	}
+
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+	for _, key := range signingKeys {
+		data.Keys = append(data.Keys, models.UJWK{
+			Kty: "RSA",
+			Kid: key.ID,
+			Use: "sig",
+			Alg: signingKeyAlgorithm,
+			N:   base64.RawURLEncoding.EncodeToString(key.Key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.Key.PublicKey.E)).Bytes()),
+		})
+	}
+	return data, nil
+}
@@ -5,12 +5,14 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 )
 
 const userSearchQuery = "SELECT id, firstname, lastname, organization FROM auth.users WHERE lower(concat(firstname,' ', lastname)) LIKE $1"
-const userSearchQueryWithOrg = "SELECT id, firstname, lastname, organization FROM auth.users WHERE lower(concat(firstname,' ', lastname)) LIKE $1 and organization = $2"
 
+// UserSearch finds users by name, optionally narrowed to an organization, an
+// exact email or an email domain. Emails are matched by their blind indexes.
 func UserSearch(body models.RUserSearch) ([]models.UserSearchReturn, error) {
 	db := DB
 	var err error
@@ -34,24 +36,38 @@ func UserSearch(body models.RUserSearch) ([]models.UserSearchReturn, error) {
 		}
 	}()
 
-	if len(body.OrganizationId) == 0 {
-		err = tx.Select(&searchReturn, userSearchQuery, "%"+strings.ToLower(body.Name)+"%")
+	query := userSearchQuery
+	args := []any{"%" + strings.ToLower(body.Name) + "%"}
+	if len(body.OrganizationId) > 0 {
+		args = append(args, body.OrganizationId)
+		query += fmt.Sprintf(" and organization = $%d", len(args))
+	}
+	if len(body.Email) > 0 {
+		var index string
+		index, err = EmailIndex(body.Email)
 		if err != nil {
 			return nil, err
 		}
-		if len(searchReturn) == 0 {
-			err = errors.New("No users found!")
-			return nil, err
-		}
-	} else {
-		err = tx.Select(&searchReturn, userSearchQueryWithOrg, "%"+strings.ToLower(body.Name)+"%", body.OrganizationId)
+		args = append(args, index)
+		query += fmt.Sprintf(" and email_index = $%d", len(args))
+	}
+	if len(body.Domain) > 0 {
+		var index string
+		index, err = DomainIndex(body.Domain)
 		if err != nil {
 			return nil, err
 		}
-		if len(searchReturn) == 0 {
-			err = errors.New("No users found!")
-			return nil, err
-		}
+		args = append(args, index)
+		query += fmt.Sprintf(" and email_domain_index = $%d", len(args))
+	}
+
+	err = tx.Select(&searchReturn, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchReturn) == 0 {
+		err = errors.New("No users found!")
+		return nil, err
 	}
 
 	if err = tx.Commit(); err != nil {
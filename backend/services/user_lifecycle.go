@@ -0,0 +1,304 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// deviceTables are the devices.* tables whose rows record their creator and
+// last editor.
+var deviceTables = []string{"devices.subnet", "devices.role", "devices.icon", "devices.os", "devices.document", "devices.server"}
+
+// checkUserActive refuses logins of deactivated users.
+func checkUserActive(tx *sqlx.Tx, uID string) error {
+	var active []bool
+	err := tx.Select(&active, "select coalesce(active, true) from auth.users where id = $1", uID)
+	if err != nil {
+		return err
+	}
+	if len(active) == 1 && !active[0] {
+		return errors.New("User deactivated!")
+	}
+	return nil
+}
+
+// deactivateUser marks uID inactive and revokes their credentials.
+func deactivateUser(tx *sqlx.Tx, uID string) error {
+	_, err := tx.Exec("update auth.users set active = false, updated_at = now() where id = $1", uID)
+	if err != nil {
+		return err
+	}
+	return revokeCredentials(tx, uID)
+}
+
+// revokeCredentials ends everything that authenticates as uID: sessions,
+// personal access tokens and pending logins, and impersonations by them.
+func revokeCredentials(tx *sqlx.Tx, uID string) error {
+	_, err := revokeSessions(tx, uID, "")
+	if err != nil {
+		return err
+	}
+	var impersonations []string
+	err = tx.Select(&impersonations, "delete from auth.sessions where impersonator_id = $1 returning id", uID)
+	if err != nil {
+		return err
+	}
+	denySessions(impersonations...)
+	_, err = tx.Exec("delete from auth.personal_tokens where user_id = $1", uID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from auth.login_challenges where user_id = $1", uID)
+	return err
+}
+
+func DeactivateUser(adminID string, targetID string) error {
+	db := DB
+	var err error
+
+	if adminID == targetID {
+		err = errors.New("Can't change own account!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+	err = deactivateUser(tx, targetID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+func ReactivateUser(adminID string, targetID string) error {
+	db := DB
+	var err error
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update auth.users set active = true, updated_at = now() where id = $1", targetID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// DeleteUser removes targetID for good. Device records they created or last
+// edited are handed over to the deleting admin; everything else of theirs
+// goes with them.
+func DeleteUser(adminID string, targetID string) error {
+	db := DB
+	var err error
+
+	if adminID == targetID {
+		err = errors.New("Can't change own account!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = canManageUser(tx, adminID, targetID, PermissionUsersManage)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range deviceTables {
+		_, err = tx.Exec("update "+table+" set created_by = $1 where created_by = $2", adminID, targetID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("update "+table+" set updated_by = $1 where updated_by = $2", adminID, targetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("delete from auth.users where id = $1", targetID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// ExportUser collects the personal data stored about uID.
+func ExportUser(uID string) (models.UUserExport, error) {
+	db := DB
+	var err error
+	var data models.UUserExport
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data.Profile, err = userProfile(tx, uID)
+	if err != nil {
+		return data, err
+	}
+	data.Roles = []string{}
+	err = tx.Select(&data.Roles, `select r.name from auth.user_roles ur join auth.roles r on r.id = ur.role_id
+		where ur.user_id = $1 order by r.name`, uID)
+	if err != nil {
+		return data, err
+	}
+	data.Sessions, err = listSessions(tx, uID, "")
+	if err != nil {
+		return data, err
+	}
+	data.LoginEvents = []models.LoginEvent{}
+	err = tx.Select(&data.LoginEvents, "select * from auth.login_events where user_id = $1 order by created_at", uID)
+	if err != nil {
+		return data, err
+	}
+	data.PersonalTokens = []models.UPersonalToken{}
+	err = tx.Select(&data.PersonalTokens, `select id, name, scopes, expires_at, last_used_at, last_used_ip, created_at
+		from auth.personal_tokens where user_id = $1 order by created_at`, uID)
+	if err != nil {
+		return data, err
+	}
+	data.Passkeys = []models.WebauthnCredential{}
+	err = tx.Select(&data.Passkeys, "select * from auth.webauthn_credentials where user_id = $1 order by created_at", uID)
+	if err != nil {
+		return data, err
+	}
+	data.Impersonations = []models.ImpersonationEvent{}
+	err = tx.Select(&data.Impersonations, "select * from auth.impersonation_events where user_id = $1 order by created_at", uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data.ExportedAt = time.Now()
+	return data, err
+}
+
+// userProfile loads uID with the email decrypted.
+func userProfile(tx *sqlx.Tx, uID string) (models.UUser, error) {
+	var users []models.User
+	err := tx.Select(&users, `select id, email, coalesce(firstname, '') as firstname, coalesce(lastname, '') as lastname,
+		coalesce(organization::text, '') as organization, type, mfa_enabled, last_login, coalesce(verified, false) as verified,
+		coalesce(active, true) as active, preferences, created_at, updated_at from auth.users where id = $1`, uID)
+	if err != nil {
+		return models.UUser{}, err
+	}
+	if len(users) != 1 {
+		return models.UUser{}, errors.New("User doesn't exist!")
+	}
+	user := users[0]
+	email, err := Decrypt(user.Email)
+	if err != nil {
+		return models.UUser{}, err
+	}
+	return models.UUser{
+		ID:             user.ID,
+		Email:          email,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		OrganizationID: user.OrganizationID,
+		UserType:       user.UserType,
+		MFAEnabled:     user.MFAEnabled.Bool,
+		LastLogin:      user.LastLogin,
+		EmailVerified:  user.EmailVerified,
+		Active:         user.Active,
+		Preferences:    user.Preferences,
+		CreatedAt:      user.CreatedAt,
+		UpdatedAt:      user.UpdatedAt,
+	}, nil
+}
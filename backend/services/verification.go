@@ -0,0 +1,214 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+const emailVerificationPurpose = "email_verification"
+const emailChangePurpose = "email_change"
+
+type emailVerificationClaims struct {
+	// EmailHash ties the link to the address it was sent to.
+	EmailHash string `json:"eml"`
+	jwt.RegisteredClaims
+}
+
+func emailVerificationLifetime() time.Duration {
+	return envDuration("EMAIL_VERIFICATION_LIFETIME", 24*time.Hour)
+}
+
+func verificationResendInterval() time.Duration {
+	return envDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+}
+
+// newEmailToken signs a link token for purpose that only works while userID's
+// address, or pending address for an email change, is still email. The
+// plaintext is hashed so re-encrypting the column keeps the link valid.
+func newEmailToken(purpose string, userID string, email string) (string, error) {
+	secret, err := signingSecret(purpose)
+	if err != nil {
+		return "", err
+	}
+	emailHash, err := HashToken(email)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, emailVerificationClaims{
+		EmailHash: emailHash,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{purpose},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailVerificationLifetime())),
+		},
+	})
+	return token.SignedString(secret)
+}
+
+func parseEmailToken(purpose string, token string) (emailVerificationClaims, error) {
+	var claims emailVerificationClaims
+	secret, err := signingSecret(purpose)
+	if err != nil {
+		return claims, err
+	}
+	_, err = jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(purpose), jwt.WithExpirationRequired())
+	if err != nil {
+		return claims, errors.New("Invalid or expired token!")
+	}
+	return claims, nil
+}
+
+// sendVerificationEmail mails email a link that verifies it for userID.
+func sendVerificationEmail(userID string, email string) error {
+	token, err := newEmailToken(emailVerificationPurpose, userID, email)
+	if err != nil {
+		return err
+	}
+
+	link := GetEnvDefault("PUBLIC_URL", "http://localhost:3000") + "/auth/verify-email?token=" + url.QueryEscape(token)
+	return GetMailer().Send(Mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Please confirm your email address by opening the link below.\n\n" + link +
+			"\n\nThe link expires in " + emailVerificationLifetime().String() + ". If you didn't create an account, you can ignore this mail.\n",
+	})
+}
+
+// checkEmailVerified refuses unverified users of organizations that require
+// a verified address, and unverified users who registered themselves, since
+// anyone can sign up with an address of the organization's domain.
+func checkEmailVerified(tx *sqlx.Tx, userID string) error {
+	var blocked []bool
+	err := tx.Select(&blocked, `select not coalesce(u.verified, false) and (coalesce(o.require_verified_email, false) or u.self_registered)
+		from auth.users u left join auth.organizations o on o.id = u.organization where u.id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if len(blocked) == 1 && blocked[0] {
+		return errors.New("Email not verified!")
+	}
+	return nil
+}
+
+func VerifyEmail(token string) error {
+	db := DB
+	var err error
+
+	claims, err := parseEmailToken(emailVerificationPurpose, token)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var users []models.User
+	err = tx.Select(&users, "select id, email from auth.users where id = $1", claims.Subject)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 {
+		err = errors.New("Invalid or expired token!")
+		return err
+	}
+	email, err := Decrypt(users[0].Email)
+	if err != nil {
+		return err
+	}
+	if !TokenMatches(email, claims.EmailHash) {
+		err = errors.New("Invalid or expired token!")
+		return err
+	}
+
+	_, err = tx.Exec("update auth.users set verified = true, updated_at = now() where id = $1", users[0].ID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+// ResendVerification mails a new link to email unless it is unknown, already
+// verified or got one less than EMAIL_VERIFICATION_RESEND_INTERVAL ago. The
+// caller can't tell these cases apart.
+func ResendVerification(body models.REmail) error {
+	db := DB
+	var err error
+
+	emailIndex, err := EmailIndex(body.Email)
+	if err != nil {
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var ids []string
+	err = tx.Select(&ids, `update auth.users set verification_sent_at = now()
+		where email_index = $1 and not coalesce(verified, false) and (verification_sent_at is null or verification_sent_at < now() - $2 * interval '1 second')
+		returning id`, emailIndex, int64(verificationResendInterval().Seconds()))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	if len(ids) == 1 {
+		if mailErr := sendVerificationEmail(ids[0], body.Email); mailErr != nil {
+			log.Printf("Sending verification mail failed: %v", mailErr)
+		}
+	}
+	return err
+}
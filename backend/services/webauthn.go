@@ -0,0 +1,572 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const webauthnCeremonyLifetime = 5 * time.Minute
+
+const insertWebauthnCeremonyString = "INSERT INTO auth.webauthn_ceremonies (id, user_id, type, data, expires_at) VALUES ($1, $2, $3, $4, $5);"
+const insertWebauthnCredentialString = `INSERT INTO auth.webauthn_credentials
+	(user_id, credential_id, public_key, attestation_type, aaguid, sign_count, clone_warning, flags, backup_eligible, backup_state, transports, name)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);`
+
+var webAuthn *webauthn.WebAuthn
+var webAuthnErr error
+var webAuthnOnce sync.Once
+
+func getWebAuthn() (*webauthn.WebAuthn, error) {
+	webAuthnOnce.Do(func() {
+		webAuthn, webAuthnErr = webauthn.New(&webauthn.Config{
+			RPID:          GetEnvDefault("WEBAUTHN_RP_ID", "localhost"),
+			RPDisplayName: GetEnvDefault("WEBAUTHN_RP_NAME", "Zendoc"),
+			RPOrigins:     strings.Split(GetEnvDefault("WEBAUTHN_RP_ORIGINS", "http://localhost:3000"), ","),
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				ResidentKey:      protocol.ResidentKeyRequirementRequired,
+				UserVerification: protocol.VerificationRequired,
+			},
+		})
+	})
+	return webAuthn, webAuthnErr
+}
+
+// webauthnCeremonyData is what is kept between the begin and finish calls of
+// a ceremony.
+type webauthnCeremonyData struct {
+	Session webauthn.SessionData `json:"session"`
+	Name    string               `json:"name,omitempty"`
+}
+
+type webauthnUser struct {
+	id          uuid.UUID
+	name        string
+	displayName string
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	return u.id[:]
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.name
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.displayName
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func loadWebauthnUser(tx *sqlx.Tx, userID string) (*webauthnUser, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, errors.New("User doesn't exist!")
+	}
+
+	var users []models.User
+	err = tx.Select(&users, "select id, email, firstname, lastname from auth.users where id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, errors.New("User doesn't exist!")
+	}
+	email, err := Decrypt(users[0].Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []models.WebauthnCredential
+	err = tx.Select(&stored, "select * from auth.webauthn_credentials where user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]webauthn.Credential, 0, len(stored))
+	for _, cred := range stored {
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range strings.Split(cred.Transports, ",") {
+			if transport != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              cred.CredentialID,
+			PublicKey:       cred.PublicKey,
+			AttestationType: cred.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(cred.Flags)),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       cred.AAGUID,
+				SignCount:    uint32(cred.SignCount),
+				CloneWarning: cred.CloneWarning,
+			},
+		})
+	}
+
+	return &webauthnUser{
+		id:          id,
+		name:        email,
+		displayName: strings.TrimSpace(users[0].FirstName + " " + users[0].LastName),
+		credentials: credentials,
+	}, nil
+}
+
+func createWebauthnCeremony(tx *sqlx.Tx, userID sql.NullString, ceremonyType string, data webauthnCeremonyData) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	id := uuid.New().String()
+	_, err = tx.Exec(insertWebauthnCeremonyString, id, userID, ceremonyType, encoded, time.Now().Add(webauthnCeremonyLifetime))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takeWebauthnCeremony loads a ceremony and deletes it in a transaction of
+// its own, so every ceremony can only be tried once even if verifying the
+// response fails afterwards.
+func takeWebauthnCeremony(id string, ceremonyType string) (models.WebauthnCeremony, webauthnCeremonyData, error) {
+	db := DB
+	var err error
+	var data webauthnCeremonyData
+	var ceremonies []models.WebauthnCeremony
+
+	if _, err = uuid.Parse(id); err != nil {
+		return models.WebauthnCeremony{}, data, errors.New("Invalid or expired ceremony!")
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return models.WebauthnCeremony{}, data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Select(&ceremonies, "delete from auth.webauthn_ceremonies where id = $1 and type = $2 returning *", id, ceremonyType)
+	if err != nil {
+		return models.WebauthnCeremony{}, data, err
+	}
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return models.WebauthnCeremony{}, data, err
+	}
+
+	if len(ceremonies) != 1 || ceremonies[0].ExpiresAt.Before(time.Now()) {
+		return models.WebauthnCeremony{}, data, errors.New("Invalid or expired ceremony!")
+	}
+	if err = json.Unmarshal(ceremonies[0].Data, &data); err != nil {
+		return models.WebauthnCeremony{}, data, err
+	}
+	return ceremonies[0], data, nil
+}
+
+func BeginWebauthnRegistration(uID string, body models.RWebauthnRegisterBegin) (models.UWebauthnCeremony, error) {
+	db := DB
+	var err error
+	var data models.UWebauthnCeremony
+
+	wa, err := getWebAuthn()
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	user, err := loadWebauthnUser(tx, uID)
+	if err != nil {
+		return data, err
+	}
+
+	creation, session, err := wa.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		return data, err
+	}
+
+	ceremonyID, err := createWebauthnCeremony(tx, sql.NullString{String: uID, Valid: true}, models.CeremonyTypeRegistration, webauthnCeremonyData{
+		Session: *session,
+		Name:    body.Name,
+	})
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data = models.UWebauthnCeremony{
+		Ceremony: ceremonyID,
+		Options:  creation,
+	}
+	return data, err
+}
+
+func FinishWebauthnRegistration(uID string, ceremonyID string, response *protocol.ParsedCredentialCreationData) error {
+	db := DB
+	var err error
+
+	wa, err := getWebAuthn()
+	if err != nil {
+		return err
+	}
+
+	ceremony, ceremonyData, err := takeWebauthnCeremony(ceremonyID, models.CeremonyTypeRegistration)
+	if err != nil {
+		return err
+	}
+	if ceremony.UserID.String != uID {
+		err = errors.New("Invalid or expired ceremony!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	user, err := loadWebauthnUser(tx, uID)
+	if err != nil {
+		return err
+	}
+
+	credential, err := wa.CreateCredential(user, ceremonyData.Session, response)
+	if err != nil {
+		log.Printf("WebAuthn registration failed: %v", err)
+		err = errors.New("Credential verification failed!")
+		return err
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	_, err = tx.Exec(insertWebauthnCredentialString,
+		uID,
+		credential.ID,
+		credential.PublicKey,
+		credential.AttestationType,
+		credential.Authenticator.AAGUID,
+		int64(credential.Authenticator.SignCount),
+		credential.Authenticator.CloneWarning,
+		int16(credential.Flags.ProtocolValue()),
+		credential.Flags.BackupEligible,
+		credential.Flags.BackupState,
+		strings.Join(transports, ","),
+		ceremonyData.Name,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate") {
+			err = errors.New("Credential already registered!")
+		}
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
+
+func BeginWebauthnLogin() (models.UWebauthnCeremony, error) {
+	db := DB
+	var err error
+	var data models.UWebauthnCeremony
+
+	wa, err := getWebAuthn()
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	assertion, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return data, err
+	}
+
+	ceremonyID, err := createWebauthnCeremony(tx, sql.NullString{}, models.CeremonyTypeLogin, webauthnCeremonyData{
+		Session: *session,
+	})
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	data = models.UWebauthnCeremony{
+		Ceremony: ceremonyID,
+		Options:  assertion,
+	}
+	return data, err
+}
+
+// FinishWebauthnLogin verifies a passkey assertion and issues a session. A
+// user-verified passkey already counts as multi-factor, so no TOTP challenge
+// follows.
+func FinishWebauthnLogin(ceremonyID string, response *protocol.ParsedCredentialAssertionData, userAgent string, ip string) (models.USesssion, error) {
+	db := DB
+	var err error
+	var data models.USesssion
+
+	var userID string
+	defer func() {
+		if err != nil {
+			logFailedLogin(userID, loginMethodPasskey, userAgent, ip, err.Error())
+		}
+	}()
+
+	wa, err := getWebAuthn()
+	if err != nil {
+		return data, err
+	}
+
+	_, ceremonyData, err := takeWebauthnCeremony(ceremonyID, models.CeremonyTypeLogin)
+	if err != nil {
+		return data, err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	handler := func(rawID []byte, userHandle []byte) (webauthn.User, error) {
+		id, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		user, err := loadWebauthnUser(tx, id.String())
+		if err != nil {
+			return nil, err
+		}
+		userID = user.id.String()
+		return user, nil
+	}
+
+	credential, err := wa.ValidateDiscoverableLogin(handler, ceremonyData.Session, response)
+	if err != nil {
+		log.Printf("WebAuthn login failed: %v", err)
+		err = errors.New("Credential verification failed!")
+		return data, err
+	}
+
+	_, err = tx.Exec(`update auth.webauthn_credentials set sign_count = $1, clone_warning = $2, flags = $3, backup_state = $4,
+		last_used_at = now(), updated_at = now() where credential_id = $5 and user_id = $6`,
+		int64(credential.Authenticator.SignCount),
+		credential.Authenticator.CloneWarning,
+		int16(credential.Flags.ProtocolValue()),
+		credential.Flags.BackupState,
+		credential.ID,
+		userID,
+	)
+	if err != nil {
+		return data, err
+	}
+
+	// A signature counter that didn't increase means the key may have been
+	// copied. The credential stays flagged and can't log in anymore until the
+	// user deletes it and registers the authenticator again.
+	if credential.Authenticator.CloneWarning {
+		log.Printf("WebAuthn clone warning for credential of user %v", userID)
+		if err = tx.Commit(); err != nil {
+			err = errors.New("Transaction commit failed!")
+			return data, err
+		}
+		err = errors.New("Credential may be cloned!")
+		return data, err
+	}
+
+	data, err = createSession(tx, userID, loginMethodPasskey, userAgent, ip)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func WebauthnCredentials(uID string) ([]models.WebauthnCredential, error) {
+	db := DB
+	var err error
+	var data []models.WebauthnCredential
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return data, fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Select(&data, "select * from auth.webauthn_credentials where user_id = $1 order by created_at", uID)
+	if err != nil {
+		return data, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return data, err
+	}
+
+	return data, err
+}
+
+func DeleteWebauthnCredential(uID string, credentialID string) error {
+	db := DB
+	var err error
+
+	if _, err = uuid.Parse(credentialID); err != nil {
+		err = errors.New("Credential doesn't exist!")
+		return err
+	}
+
+	var ctx = context.Background()
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction failed %v!", err.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.Exec("delete from auth.webauthn_credentials where id = $1 and user_id = $2", credentialID, uID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = errors.New("Credential doesn't exist!")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = errors.New("Transaction commit failed!")
+		return err
+	}
+
+	return err
+}
@@ -2,7 +2,9 @@ CREATE SCHEMA IF NOT EXISTS auth;
 
 CREATE TABLE IF NOT EXISTS auth.users (
   id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-  email TEXT UNIQUE NOT NULL,
+  email TEXT NOT NULL,
+  email_index VARCHAR(64) UNIQUE,
+  email_domain_index VARCHAR(64),
   password TEXT NOT NULL,
   firstname VARCHAR(100),
   lastname VARCHAR(100),
@@ -10,9 +12,15 @@ CREATE TABLE IF NOT EXISTS auth.users (
   type VARCHAR(20) NOT NULL,
   mfa_enabled BOOLEAN DEFAULT FALSE,
   mfa_secret VARCHAR(255),
+  mfa_last_step BIGINT,
   last_login TIMESTAMP WITH TIME ZONE,
   verified BOOLEAN DEFAULT FALSE,
+  verification_sent_at TIMESTAMP WITH TIME ZONE,
+  self_registered BOOLEAN NOT NULL DEFAULT FALSE,
   active BOOLEAN DEFAULT TRUE,
+  preferences JSONB NOT NULL DEFAULT '{}',
+  pending_email TEXT,
+  external_id VARCHAR(255),
   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -25,12 +33,18 @@ CREATE TABLE IF NOT EXISTS auth.organizations (
   sso_provider VARCHAR(50),
   sso_metadata_url TEXT,
   sso_entity_id VARCHAR(255),
+  sso_client_secret TEXT,
   ldap BOOLEAN DEFAULT FALSE,
   ldap_server VARCHAR(255),
   ldap_bind_dn VARCHAR(255),
   ldap_search_base VARCHAR(255),
+  ldap_bind_password TEXT,
+  ldap_user_filter VARCHAR(255),
+  ldap_start_tls BOOLEAN DEFAULT FALSE,
   allowed_domains TEXT,
   mfa_required BOOLEAN DEFAULT FALSE,
+  require_verified_email BOOLEAN DEFAULT FALSE,
+  registration_mode VARCHAR(20),
   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -44,13 +58,225 @@ ALTER TABLE auth.users
 CREATE TABLE IF NOT EXISTS auth.sessions (
   id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id UUID NOT NULL,
-  refresh_token VARCHAR(255) NOT NULL,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
   user_agent TEXT,
   ip INET,
+  impersonator_id UUID,
   expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-  CONSTRAINT fk_session_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+  CONSTRAINT fk_session_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE,
+  CONSTRAINT fk_session_impersonator FOREIGN KEY (impersonator_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.refresh_tokens (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  session_id UUID NOT NULL,
+  rotated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_refresh_token_session FOREIGN KEY (session_id) REFERENCES auth.sessions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.signing_keys (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  algorithm VARCHAR(10) NOT NULL,
+  private_key TEXT NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS auth.password_resets (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_password_reset_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.personal_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  scopes TEXT[] NOT NULL DEFAULT '{}',
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  last_used_ip INET,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_personal_token_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+-- One SCIM bearer token per organization, stored as a keyed hash.
+CREATE TABLE IF NOT EXISTS auth.scim_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  organization_id UUID NOT NULL UNIQUE,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  created_by UUID,
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_scim_token_organization FOREIGN KEY (organization_id) REFERENCES auth.organizations(id) ON DELETE CASCADE,
+  CONSTRAINT fk_scim_token_created_by FOREIGN KEY (created_by) REFERENCES auth.users(id) ON DELETE SET NULL
+);
+
+-- Pending device logins. Both codes are stored as keyed hashes; approval
+-- records the user, and the personal token is issued on the next poll.
+CREATE TABLE IF NOT EXISTS auth.device_codes (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  device_code_hash VARCHAR(64) NOT NULL UNIQUE,
+  user_code_hash VARCHAR(64) NOT NULL UNIQUE,
+  client_name VARCHAR(100) NOT NULL,
+  scopes TEXT[] NOT NULL DEFAULT '{}',
+  status VARCHAR(20) NOT NULL DEFAULT 'pending',
+  user_id UUID,
+  interval_seconds INTEGER NOT NULL,
+  last_polled_at TIMESTAMP WITH TIME ZONE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_device_code_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+-- Append-only: rows are inserted on every login attempt and never updated.
+CREATE TABLE IF NOT EXISTS auth.login_events (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID,
+  success BOOLEAN NOT NULL,
+  method VARCHAR(20) NOT NULL,
+  ip INET,
+  user_agent TEXT NOT NULL DEFAULT '',
+  failure_reason VARCHAR(100),
+  new_device BOOLEAN NOT NULL DEFAULT FALSE,
+  new_ip BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_login_event_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE SET NULL
+);
+
+-- Deleting a user only unlinks their events, so the trail outlives the account.
+CREATE OR REPLACE FUNCTION auth.login_events_append_only() RETURNS trigger AS $$
+BEGIN
+  IF NEW.user_id IS NULL AND to_jsonb(NEW) - 'user_id' = to_jsonb(OLD) - 'user_id' THEN
+    RETURN NEW;
+  END IF;
+  RAISE EXCEPTION 'auth.login_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER login_events_append_only BEFORE UPDATE ON auth.login_events
+  FOR EACH ROW EXECUTE FUNCTION auth.login_events_append_only();
+
+-- Append-only: one row per start, stop and request of an impersonation. The
+-- impersonator has no foreign key so the trail outlives their account.
+CREATE TABLE IF NOT EXISTS auth.impersonation_events (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  session_id UUID NOT NULL,
+  impersonator_id UUID NOT NULL,
+  user_id UUID NOT NULL,
+  action VARCHAR(20) NOT NULL,
+  method VARCHAR(10) NOT NULL DEFAULT '',
+  path TEXT NOT NULL DEFAULT '',
+  status INTEGER,
+  ip INET,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_impersonation_event_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE OR REPLACE FUNCTION auth.impersonation_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'auth.impersonation_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER impersonation_events_append_only BEFORE UPDATE ON auth.impersonation_events
+  FOR EACH ROW EXECUTE FUNCTION auth.impersonation_events_append_only();
+
+CREATE TABLE IF NOT EXISTS auth.login_throttles (
+  key VARCHAR(100) PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  locked_until TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT to_timestamp(0)
+);
+
+CREATE TABLE IF NOT EXISTS auth.invitations (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  organization_id UUID NOT NULL,
+  email TEXT NOT NULL,
+  email_index VARCHAR(64),
+  role_ids UUID[] NOT NULL DEFAULT '{}',
+  invited_by UUID,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  accepted_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_invitation_organization FOREIGN KEY (organization_id) REFERENCES auth.organizations(id) ON DELETE CASCADE,
+  CONSTRAINT fk_invitation_invited_by FOREIGN KEY (invited_by) REFERENCES auth.users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS auth.login_challenges (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  token_prefix VARCHAR(32) NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  type VARCHAR(20) NOT NULL,
+  method VARCHAR(20) NOT NULL DEFAULT 'password',
+  attempts SMALLINT NOT NULL DEFAULT 0,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_login_challenge_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.webauthn_credentials (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  credential_id BYTEA UNIQUE NOT NULL,
+  public_key BYTEA NOT NULL,
+  attestation_type VARCHAR(50) NOT NULL DEFAULT '',
+  aaguid BYTEA,
+  sign_count BIGINT NOT NULL DEFAULT 0,
+  clone_warning BOOLEAN NOT NULL DEFAULT FALSE,
+  flags SMALLINT NOT NULL DEFAULT 0,
+  backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+  backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+  transports TEXT NOT NULL DEFAULT '',
+  name VARCHAR(100) NOT NULL DEFAULT '',
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_webauthn_credential_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.webauthn_ceremonies (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID,
+  type VARCHAR(20) NOT NULL,
+  data JSONB NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_webauthn_ceremony_user FOREIGN KEY (user_id) REFERENCES auth.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.sso_requests (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  organization UUID NOT NULL,
+  protocol VARCHAR(10) NOT NULL,
+  state VARCHAR(255) UNIQUE NOT NULL,
+  nonce VARCHAR(255) NOT NULL DEFAULT '',
+  code_verifier VARCHAR(255) NOT NULL DEFAULT '',
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT fk_sso_request_organization FOREIGN KEY (organization) REFERENCES auth.organizations(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.saml_logout_requests (
+  organization UUID NOT NULL,
+  request_id VARCHAR(255) NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (organization, request_id),
+  CONSTRAINT fk_saml_logout_request_organization FOREIGN KEY (organization) REFERENCES auth.organizations(id) ON DELETE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS auth.roles (
@@ -71,10 +297,48 @@ CREATE TABLE IF NOT EXISTS auth.user_roles (
   CONSTRAINT fk_user_role_role FOREIGN KEY (role_id) REFERENCES auth.roles(id) ON DELETE CASCADE
 );
 
-CREATE INDEX idx_users_email ON auth.users(email);
+CREATE TABLE IF NOT EXISTS auth.permissions (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  name VARCHAR(50) UNIQUE NOT NULL,
+  description TEXT,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS auth.role_permissions (
+  role_id UUID NOT NULL,
+  permission_id UUID NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (role_id, permission_id),
+  CONSTRAINT fk_role_permission_role FOREIGN KEY (role_id) REFERENCES auth.roles(id) ON DELETE CASCADE,
+  CONSTRAINT fk_role_permission_permission FOREIGN KEY (permission_id) REFERENCES auth.permissions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS auth.ldap_group_roles (
+  organization UUID NOT NULL,
+  group_dn VARCHAR(255) NOT NULL,
+  role_id UUID NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (organization, group_dn, role_id),
+  CONSTRAINT fk_ldap_group_role_organization FOREIGN KEY (organization) REFERENCES auth.organizations(id) ON DELETE CASCADE,
+  CONSTRAINT fk_ldap_group_role_role FOREIGN KEY (role_id) REFERENCES auth.roles(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_users_email_domain_index ON auth.users(email_domain_index);
 CREATE INDEX idx_users_organization ON auth.users(organization);
+CREATE UNIQUE INDEX idx_users_external_id ON auth.users(organization, external_id);
+CREATE INDEX idx_scim_tokens_token_prefix ON auth.scim_tokens(token_prefix);
 CREATE INDEX idx_sessions_user ON auth.sessions(user_id);
-CREATE INDEX idx_sessions_token ON auth.sessions(refresh_token);
+CREATE INDEX idx_sessions_token_prefix ON auth.sessions(token_prefix);
+CREATE INDEX idx_refresh_tokens_session ON auth.refresh_tokens(session_id);
+CREATE INDEX idx_personal_tokens_token_prefix ON auth.personal_tokens(token_prefix);
+CREATE INDEX idx_personal_tokens_user ON auth.personal_tokens(user_id);
+CREATE INDEX idx_login_events_user ON auth.login_events(user_id, created_at);
+CREATE INDEX idx_impersonation_events_user ON auth.impersonation_events(user_id, created_at);
+CREATE INDEX idx_invitations_token_prefix ON auth.invitations(token_prefix);
+CREATE INDEX idx_invitations_organization ON auth.invitations(organization_id, email_index);
+CREATE INDEX idx_password_resets_token_prefix ON auth.password_resets(token_prefix);
+CREATE INDEX idx_login_challenges_token_prefix ON auth.login_challenges(token_prefix);
+CREATE INDEX idx_webauthn_credentials_user ON auth.webauthn_credentials(user_id);
 CREATE INDEX idx_user_roles_user ON auth.user_roles(user_id);
 CREATE INDEX idx_user_roles_role ON auth.user_roles(role_id);
 
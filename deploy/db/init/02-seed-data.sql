@@ -19,6 +19,47 @@ INSERT INTO auth.roles (id, name, description) VALUES
 INSERT INTO auth.user_roles (user_id, role_id) VALUES
 ('d8221e3e-7d6e-4169-9f7d-7b6c591b2dfe', 'c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567');
 
+-- Insert Permissions
+INSERT INTO auth.permissions (id, name, description) VALUES
+('dc3fe539-ea2d-4315-826d-c2e78be334ef', 'devices:read', 'Search servers'),
+('999b3577-aec8-480a-8952-6c4d0e54e31a', 'devices:write', 'Create and change servers and device roles'),
+('47c9ab4f-e1b6-44e8-abb5-6f7e511734ab', 'roles:read', 'List roles'),
+('849abf40-84ed-490e-8079-b47cc5c7b23f', 'roles:write', 'Create and delete roles and change their permissions'),
+('466ad682-662a-4410-9b1c-92d23d83a0ae', 'roles:assign', 'Assign roles to users'),
+('c2380d70-7d83-4e35-9e2c-e054151d2143', 'users:read', 'Search users'),
+('5af28736-ca7f-4a5b-85f4-e067389427e4', 'users:manage', 'Manage sessions, lockouts and status of users'),
+('9ff794fb-47c2-4dbd-b158-0a0ec9b3f0b8', 'users:impersonate', 'Impersonate users'),
+('7bb6b445-8300-4eda-9c52-6f1d826caff9', 'audit:read', 'Read login events'),
+('ba79bf68-0589-4fa7-89a6-0cfd81671799', 'invitations:manage', 'Invite users'),
+('d7210297-ad0a-4518-993b-7f57275e9f32', 'scim:manage', 'Manage the organization''s SCIM token'),
+('13cd4dad-9dd7-4b7d-b2da-de8f5fdb610e', 'organizations:all', 'Extend the other permissions to every organization and to its admins');
+
+-- Insert Role Permissions
+INSERT INTO auth.role_permissions (role_id, permission_id) VALUES
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', 'dc3fe539-ea2d-4315-826d-c2e78be334ef'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '999b3577-aec8-480a-8952-6c4d0e54e31a'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '47c9ab4f-e1b6-44e8-abb5-6f7e511734ab'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '849abf40-84ed-490e-8079-b47cc5c7b23f'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '466ad682-662a-4410-9b1c-92d23d83a0ae'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', 'c2380d70-7d83-4e35-9e2c-e054151d2143'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '5af28736-ca7f-4a5b-85f4-e067389427e4'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '9ff794fb-47c2-4dbd-b158-0a0ec9b3f0b8'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '7bb6b445-8300-4eda-9c52-6f1d826caff9'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', 'ba79bf68-0589-4fa7-89a6-0cfd81671799'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', 'd7210297-ad0a-4518-993b-7f57275e9f32'),
+('c8d9e0f1-a2b3-4567-c8d9-e0f1a2b34567', '13cd4dad-9dd7-4b7d-b2da-de8f5fdb610e'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', 'dc3fe539-ea2d-4315-826d-c2e78be334ef'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', '999b3577-aec8-480a-8952-6c4d0e54e31a'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', '47c9ab4f-e1b6-44e8-abb5-6f7e511734ab'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', 'c2380d70-7d83-4e35-9e2c-e054151d2143'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', '5af28736-ca7f-4a5b-85f4-e067389427e4'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', '7bb6b445-8300-4eda-9c52-6f1d826caff9'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', 'ba79bf68-0589-4fa7-89a6-0cfd81671799'),
+('d9e0f1a2-b3c4-5678-d9e0-f1a2b3c45678', 'd7210297-ad0a-4518-993b-7f57275e9f32'),
+('e0f1a2b3-c4d5-6789-e0f1-a2b3c4d56789', 'dc3fe539-ea2d-4315-826d-c2e78be334ef'),
+('e0f1a2b3-c4d5-6789-e0f1-a2b3c4d56789', '999b3577-aec8-480a-8952-6c4d0e54e31a'),
+('f1a2b3c4-d5e6-7890-f1a2-b3c4d5e67890', 'dc3fe539-ea2d-4315-826d-c2e78be334ef');
+
 -- Insert Subnets
 INSERT INTO devices.subnet (id, name, mask, gateway, dns, created_by, updated_by) VALUES
 ('d5e6f7a8-b9c0-1234-d5e6-f7a8b9c01234', 'Production Network', 24, '10.0.1.1', '10.0.1.2', 'd8221e3e-7d6e-4169-9f7d-7b6c591b2dfe', 'd8221e3e-7d6e-4169-9f7d-7b6c591b2dfe'),